@@ -1,4 +1,4 @@
-package main
+package bittorrent
 
 import (
 	"fmt"
@@ -41,7 +41,8 @@ func encodeBencode(data interface{}) ([]byte, error) {
 			encodedElements[i] = string(encodedElement)
 		}
 
-		sort.Strings(encodedElements)
+		// unlike dictionary keys list elements keep their order, otherwise
+		// the info hash of multi file torrents would change
 		encodedList := strings.Join(encodedElements, "")
 		encoded = fmt.Sprintf("l%se", encodedList)
 
@@ -105,10 +106,11 @@ func decodeString(bencode string) (interface{}, int, error) {
 		return "", 0, err
 	}
 
-	endDelimeter := firstColonIndex + 1 + length
-	if endDelimeter > len(bencode) {
+	// compared before adding, so huge lengths from peers can't overflow
+	if length > len(bencode)-firstColonIndex-1 {
 		return "", 0, fmt.Errorf("invalid string encoding")
 	}
+	endDelimeter := firstColonIndex + 1 + length
 
 	result := bencode[firstColonIndex+1 : endDelimeter]
 
@@ -1,4 +1,4 @@
-package main
+package bittorrent
 
 import (
 	"fmt"
@@ -45,7 +45,7 @@ func TestEncodeBencode(t *testing.T) {
 			data: map[string]interface{}{
 				"key": []interface{}{"nested", "list"},
 			},
-			want:    []byte("d3:keyl4:list6:nestedee"),
+			want:    []byte("d3:keyl6:nested4:listee"),
 			wantErr: false,
 		},
 		{
@@ -93,6 +93,7 @@ func TestDecodeBencode(t *testing.T) {
 		{"i3", "", true},
 		{"l4:spami42e", "", true},
 		{"d3:cow3:moo4:spam4:egg", "", true},
+		{"9223372036854775807:spam", "", true},
 	}
 
 	for _, test := range tests {
@@ -0,0 +1,263 @@
+package bittorrent
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	rechokeInterval           = 10 * time.Second
+	optimisticUnchokeInterval = 30 * time.Second
+	snubTimeout               = 60 * time.Second
+	defaultUploadSlots        = 4
+)
+
+type ChokerPeer struct {
+	address       string
+	interested    bool
+	choked        bool
+	snubbed       bool
+	downloadRate  float64 // bytes per second received from the peer
+	uploadRate    float64 // bytes per second sent to the peer
+	downloaded    int
+	uploaded      int
+	lastPieceTime time.Time
+}
+
+type ChokeDecision struct {
+	address string
+	choke   bool
+}
+
+// Choker decides which peers get an upload slot using the tit-for-tat
+// algorithm: the fastest peers are unchoked every rechoke interval and one
+// extra slot rotates between the remaining peers every optimistic interval.
+type Choker struct {
+	mu             sync.Mutex
+	uploadSlots    int
+	peers          map[string]*ChokerPeer
+	optimistic     string
+	lastRechoke    time.Time
+	lastOptimistic time.Time
+	random         *rand.Rand
+}
+
+func newChoker(uploadSlots int, now time.Time) *Choker {
+	if uploadSlots < 1 {
+		uploadSlots = defaultUploadSlots
+	}
+
+	return &Choker{
+		uploadSlots: uploadSlots,
+		peers:       make(map[string]*ChokerPeer),
+		lastRechoke: now,
+		random:      rand.New(rand.NewSource(now.UnixNano())),
+	}
+}
+
+func (c *Choker) addPeer(address string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.peers[address]; ok {
+		return
+	}
+	// every peer starts choked and gets the full snub timeout to send us something
+	c.peers[address] = &ChokerPeer{address: address, choked: true, lastPieceTime: now}
+}
+
+func (c *Choker) removePeer(address string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.peers, address)
+	if c.optimistic == address {
+		c.optimistic = ""
+	}
+}
+
+func (c *Choker) setInterested(address string, interested bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if peer, ok := c.peers[address]; ok {
+		peer.interested = interested
+	}
+}
+
+// recordDownload registers n bytes of piece data received from the peer.
+func (c *Choker) recordDownload(address string, n int, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if peer, ok := c.peers[address]; ok {
+		peer.downloaded += n
+		peer.lastPieceTime = now
+		peer.snubbed = false
+	}
+}
+
+// recordUpload registers n bytes of piece data sent to the peer.
+func (c *Choker) recordUpload(address string, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if peer, ok := c.peers[address]; ok {
+		peer.uploaded += n
+	}
+}
+
+// fillSlot unchokes the peer if it is interested and a regular upload slot
+// is free, so peers that connect don't wait for the next rechoke. Like in
+// rechoke one slot is left to the optimistic unchoke. It reports whether
+// the peer was unchoked.
+func (c *Choker) fillSlot(address string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	peer, ok := c.peers[address]
+	if !ok || !peer.interested || !peer.choked {
+		return false
+	}
+
+	unchoked := 0
+	for other, state := range c.peers {
+		if !state.choked && other != c.optimistic {
+			unchoked++
+		}
+	}
+	if unchoked >= c.uploadSlots-1 {
+		return false
+	}
+
+	peer.choked = false
+	return true
+}
+
+// rechoke recalculates the transfer rates and returns the peers whose choke
+// state changed. When seeding, peers are ranked by how fast we upload to
+// them instead of how fast they upload to us.
+func (c *Choker) rechoke(now time.Time, seeding bool) []ChokeDecision {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.updateRates(now)
+
+	candidates := make([]*ChokerPeer, 0, len(c.peers))
+	for _, peer := range c.peers {
+		if !peer.interested {
+			continue
+		}
+		// snubbed peers only get a chance through the optimistic slot
+		if peer.snubbed && !seeding {
+			continue
+		}
+		candidates = append(candidates, peer)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if seeding {
+			return candidates[i].uploadRate > candidates[j].uploadRate
+		}
+		return candidates[i].downloadRate > candidates[j].downloadRate
+	})
+
+	// one slot is always reserved for the optimistic unchoke
+	unchoked := make(map[string]bool)
+	for i := 0; i < len(candidates) && i < c.uploadSlots-1; i++ {
+		unchoked[candidates[i].address] = true
+	}
+
+	c.updateOptimistic(now, unchoked)
+	if c.optimistic != "" {
+		unchoked[c.optimistic] = true
+	}
+
+	var decisions []ChokeDecision
+	for address, peer := range c.peers {
+		choke := !unchoked[address]
+		if peer.choked != choke {
+			peer.choked = choke
+			decisions = append(decisions, ChokeDecision{address: address, choke: choke})
+		}
+	}
+
+	sort.Slice(decisions, func(i, j int) bool {
+		return decisions[i].address < decisions[j].address
+	})
+
+	return decisions
+}
+
+func (c *Choker) updateRates(now time.Time) {
+	elapsed := now.Sub(c.lastRechoke).Seconds()
+	c.lastRechoke = now
+
+	for _, peer := range c.peers {
+		if elapsed > 0 {
+			peer.downloadRate = float64(peer.downloaded) / elapsed
+			peer.uploadRate = float64(peer.uploaded) / elapsed
+		}
+		peer.downloaded = 0
+		peer.uploaded = 0
+
+		if !peer.snubbed && now.Sub(peer.lastPieceTime) >= snubTimeout {
+			peer.snubbed = true
+			log.Debug().Msg(fmt.Sprintf("[Choker] peer %s snubbed us", peer.address))
+		}
+	}
+}
+
+func (c *Choker) updateOptimistic(now time.Time, unchoked map[string]bool) {
+	current, ok := c.peers[c.optimistic]
+	valid := ok && current.interested && !unchoked[c.optimistic]
+
+	if valid && now.Sub(c.lastOptimistic) < optimisticUnchokeInterval {
+		return
+	}
+
+	var choices []string
+	for address, peer := range c.peers {
+		if peer.interested && !unchoked[address] && address != c.optimistic {
+			choices = append(choices, address)
+		}
+	}
+
+	if len(choices) == 0 {
+		// keep the current optimistic peer if nobody else is waiting for a slot
+		if !valid {
+			c.optimistic = ""
+		}
+		return
+	}
+
+	// map iteration order is random, sort so the seeded source is reproducible
+	sort.Strings(choices)
+	c.optimistic = choices[c.random.Intn(len(choices))]
+	c.lastOptimistic = now
+	log.Debug().Msg(fmt.Sprintf("[Choker] optimistically unchoked peer %s", c.optimistic))
+}
+
+// run rechokes every rechoke interval until done is closed and hands every
+// state change to apply, which is responsible for sending the choke or
+// unchoke message to the peer.
+func (c *Choker) run(done <-chan struct{}, seeding func() bool, apply func(ChokeDecision)) {
+	ticker := time.NewTicker(rechokeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			for _, decision := range c.rechoke(now, seeding()) {
+				apply(decision)
+			}
+		}
+	}
+}
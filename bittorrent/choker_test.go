@@ -0,0 +1,162 @@
+package bittorrent
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestChoker(uploadSlots int, addresses ...string) (*Choker, time.Time) {
+	now := time.Unix(1000, 0)
+	choker := newChoker(uploadSlots, now)
+	for _, address := range addresses {
+		choker.addPeer(address, now)
+		choker.setInterested(address, true)
+	}
+	return choker, now
+}
+
+func unchokedPeers(c *Choker) []string {
+	var unchoked []string
+	for _, address := range []string{"a", "b", "c", "d", "e"} {
+		if peer, ok := c.peers[address]; ok && !peer.choked {
+			unchoked = append(unchoked, address)
+		}
+	}
+	return unchoked
+}
+
+func TestRechokeUnchokesFastestPeers(t *testing.T) {
+	choker, now := newTestChoker(3, "a", "b", "c", "d")
+	now = now.Add(rechokeInterval)
+
+	choker.recordDownload("a", 100, now)
+	choker.recordDownload("b", 4000, now)
+	choker.recordDownload("c", 3000, now)
+	choker.recordDownload("d", 200, now)
+
+	choker.rechoke(now, false)
+
+	// two regular slots plus one optimistic slot for a or d
+	if choker.peers["b"].choked || choker.peers["c"].choked {
+		t.Errorf("expected fastest peers b and c to be unchoked, got %v", unchokedPeers(choker))
+	}
+	if len(unchokedPeers(choker)) != 3 {
+		t.Errorf("expected 3 unchoked peers, got %v", unchokedPeers(choker))
+	}
+	if choker.optimistic != "a" && choker.optimistic != "d" {
+		t.Errorf("expected optimistic peer to be a or d, got %q", choker.optimistic)
+	}
+}
+
+func TestRechokeSeedingRanksByUploadRate(t *testing.T) {
+	choker, now := newTestChoker(2, "a", "b", "c")
+	now = now.Add(rechokeInterval)
+
+	choker.recordDownload("a", 9000, now)
+	choker.recordUpload("b", 5000)
+	choker.recordUpload("c", 100)
+
+	choker.rechoke(now, true)
+
+	if choker.peers["b"].choked {
+		t.Errorf("expected b to be unchoked while seeding, got %v", unchokedPeers(choker))
+	}
+}
+
+func TestRechokeSkipsUninterestedPeers(t *testing.T) {
+	choker, now := newTestChoker(4, "a", "b")
+	choker.addPeer("c", now)
+	now = now.Add(rechokeInterval)
+
+	choker.recordDownload("c", 9000, now)
+	choker.rechoke(now, false)
+
+	if !choker.peers["c"].choked {
+		t.Errorf("expected uninterested peer c to stay choked")
+	}
+}
+
+func TestRechokeSnubsSilentPeers(t *testing.T) {
+	choker, now := newTestChoker(2, "a", "b", "c")
+	now = now.Add(snubTimeout)
+
+	choker.recordDownload("b", 10, now)
+	choker.recordDownload("c", 20, now)
+	choker.rechoke(now, false)
+
+	if !choker.peers["a"].snubbed {
+		t.Errorf("expected peer a to be snubbed after %v", snubTimeout)
+	}
+	if choker.peers["b"].snubbed || choker.peers["c"].snubbed {
+		t.Errorf("expected peers b and c not to be snubbed")
+	}
+	if !choker.peers["a"].choked && choker.optimistic != "a" {
+		t.Errorf("expected snubbed peer a to only be unchoked optimistically")
+	}
+
+	choker.recordDownload("a", 10, now)
+	if choker.peers["a"].snubbed {
+		t.Errorf("expected peer a to be unsnubbed after sending data")
+	}
+}
+
+func TestRechokeRotatesOptimisticUnchoke(t *testing.T) {
+	choker, now := newTestChoker(1, "a", "b", "c")
+
+	choker.rechoke(now, false)
+	first := choker.optimistic
+	if first == "" {
+		t.Fatalf("expected an optimistic unchoke")
+	}
+
+	choker.rechoke(now.Add(rechokeInterval), false)
+	if choker.optimistic != first {
+		t.Errorf("expected optimistic peer %q to be kept before the interval, got %q", first, choker.optimistic)
+	}
+
+	decisions := choker.rechoke(now.Add(optimisticUnchokeInterval), false)
+	if choker.optimistic == first {
+		t.Errorf("expected optimistic peer to rotate away from %q", first)
+	}
+
+	want := []ChokeDecision{{address: first, choke: true}, {address: choker.optimistic, choke: false}}
+	if want[0].address > want[1].address {
+		want[0], want[1] = want[1], want[0]
+	}
+	if !reflect.DeepEqual(decisions, want) {
+		t.Errorf("rechoke() = %v, want %v", decisions, want)
+	}
+}
+
+func TestFillSlotUnchokesUpToUploadSlots(t *testing.T) {
+	// one of the three slots is left to the optimistic unchoke
+	choker, now := newTestChoker(3, "a", "b", "c")
+	choker.addPeer("d", now)
+
+	tests := []struct {
+		address string
+		want    bool
+	}{
+		{"a", true},
+		{"a", false},
+		{"d", false},
+		{"b", true},
+		{"c", false},
+	}
+
+	for _, test := range tests {
+		if got := choker.fillSlot(test.address); got != test.want {
+			t.Errorf("fillSlot(%q) = %v, want %v", test.address, got, test.want)
+		}
+	}
+	if !reflect.DeepEqual(unchokedPeers(choker), []string{"a", "b"}) {
+		t.Errorf("expected a and b to be unchoked, got %v", unchokedPeers(choker))
+	}
+
+	// the optimistic peer doesn't take a regular slot
+	choker.optimistic = "a"
+	if !choker.fillSlot("c") {
+		t.Errorf("fillSlot(\"c\") = false with the optimistic peer unchoked, want true")
+	}
+}
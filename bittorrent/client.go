@@ -0,0 +1,421 @@
+package bittorrent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+type EventType string
+
+const (
+	EVENT_STARTED        EventType = "started"
+	EVENT_PAUSED         EventType = "paused"
+	EVENT_RESUMED        EventType = "resumed"
+	EVENT_PIECE_VERIFIED EventType = "piece verified"
+	EVENT_COMPLETED      EventType = "completed"
+	EVENT_STOPPED        EventType = "stopped"
+	EVENT_FAILED         EventType = "failed"
+)
+
+// Event is passed to the event handler of a Client whenever one of its
+// torrents changes state or verifies a piece.
+type Event struct {
+	Type    EventType
+	Torrent *Torrent
+	// Piece is the index of the verified piece
+	Piece int
+	// Err is why the torrent failed
+	Err error
+}
+
+// Client downloads torrents for a program that embeds it, the CLI is just
+// one of them. All methods are safe for concurrent use and every Client has
+// its own peer ID, settings and bandwidth limits, so a process can run
+// several of them.
+type Client struct {
+	session   *Session
+	network   *PeerNetwork
+	server    *PeerServer
+	config    clientConfig
+	closeOnce sync.Once
+	closeErr  error
+}
+
+type clientConfig struct {
+	maxConnections int
+	downloadLimit  int
+	uploadLimit    int
+	encryption     EncryptionPolicy
+	transport      PeerTransport
+	localDiscovery bool
+	portMapping    bool
+	listenPort     int
+	peerIdFile     string
+	progress       func(torrent *Torrent, finished int, total int)
+	events         func(event Event)
+}
+
+// Option changes a setting of the Client created by NewClient.
+type Option func(*clientConfig)
+
+// WithMaxConnections limits the peer connections open at the same time
+// across all torrents.
+func WithMaxConnections(maxConnections int) Option {
+	return func(c *clientConfig) { c.maxConnections = maxConnections }
+}
+
+// WithBandwidthLimits sets the global limits in bytes per second, 0 is
+// unlimited.
+func WithBandwidthLimits(download int, upload int) Option {
+	return func(c *clientConfig) { c.downloadLimit, c.uploadLimit = download, upload }
+}
+
+func WithEncryption(policy EncryptionPolicy) Option {
+	return func(c *clientConfig) { c.encryption = policy }
+}
+
+func WithTransport(transport PeerTransport) Option {
+	return func(c *clientConfig) { c.transport = transport }
+}
+
+// WithLocalDiscovery finds peers on the LAN with local service discovery.
+func WithLocalDiscovery() Option {
+	return func(c *clientConfig) { c.localDiscovery = true }
+}
+
+// WithPortMapping maps the listening port on the gateway with UPnP, PCP or
+// NAT-PMP. Without a gateway that supports it the client runs without.
+func WithPortMapping() Option {
+	return func(c *clientConfig) { c.portMapping = true }
+}
+
+// WithListenPort accepts peers on port, 0 picks any free port. By default
+// the client listens on DefaultListenPort or any free port if that is taken.
+func WithListenPort(port int) Option {
+	return func(c *clientConfig) { c.listenPort = port }
+}
+
+// WithPeerIdFile keeps the peer ID in the file at path, so the client uses
+// the same ID across runs. Without it every client gets a new random ID.
+func WithPeerIdFile(path string) Option {
+	return func(c *clientConfig) { c.peerIdFile = path }
+}
+
+// WithProgress calls progress whenever a torrent finishes a piece, with the
+// pieces finished out of the pieces needed for its selected files.
+func WithProgress(progress func(torrent *Torrent, finished int, total int)) Option {
+	return func(c *clientConfig) { c.progress = progress }
+}
+
+// WithEventHandler calls handler for every event of the client's torrents.
+// It's called from the download goroutines, so it has to return quickly.
+func WithEventHandler(handler func(event Event)) Option {
+	return func(c *clientConfig) { c.events = handler }
+}
+
+func NewClient(options ...Option) (*Client, error) {
+	config := clientConfig{
+		maxConnections: DefaultMaxConnections,
+		encryption:     ENCRYPTION_DISABLE,
+		transport:      TRANSPORT_TCP,
+		listenPort:     DefaultListenPort,
+	}
+	for _, option := range options {
+		option(&config)
+	}
+
+	if _, err := ParseEncryptionPolicy(string(config.encryption)); err != nil {
+		return nil, err
+	}
+	if _, err := ParsePeerTransport(string(config.transport)); err != nil {
+		return nil, err
+	}
+
+	var peerId []byte
+	var err error
+	if config.peerIdFile != "" {
+		peerId, err = loadPeerId(config.peerIdFile)
+		// an ID that couldn't be stored still works for this run
+		if peerId != nil && err != nil {
+			log.Error().Msg(fmt.Sprintf("[Client] %s", err))
+			err = nil
+		}
+	} else {
+		peerId, err = newPeerId()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	network := newPeerNetwork(peerId)
+	network.encryption = config.encryption
+	network.transport = config.transport
+	network.bandwidth.download.setRate(config.downloadLimit)
+	network.bandwidth.upload.setRate(config.uploadLimit)
+
+	listener, err := listenPeers(fmt.Sprintf(":%d", config.listenPort))
+	if err != nil && config.listenPort == DefaultListenPort {
+		// another client has the default port, any other port works as well
+		log.Debug().Msg(fmt.Sprintf("[Client] port %d is taken, listening on any port: %s", config.listenPort, err))
+		listener, err = listenPeers(":0")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for peers: %w", err)
+	}
+	// trackers, LAN peers and the gateway are told the port that is bound
+	network.port = listener.Addr().(*net.TCPAddr).Port
+
+	if config.localDiscovery {
+		discovery, err := listenLocalDiscovery(network.port)
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to start local service discovery: %w", err)
+		}
+		network.discovery = discovery
+	}
+
+	if config.portMapping {
+		mapper, err := discoverPortMapper()
+		if err == nil {
+			network.mapping, err = newPortMapping(mapper, network.port)
+		}
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("[PortMapping] continuing without port mapping: %s", err))
+		}
+	}
+
+	session := newSession(config.maxConnections, network)
+	client := &Client{session: session, network: network, config: config}
+	client.server = newPeerServer(session, listener, config.maxConnections)
+	network.server = client.server
+	go client.server.run()
+	client.session.progress = client.reportProgress
+	client.session.events = client.emit
+	return client, nil
+}
+
+func (c *Client) reportProgress(torrent *SessionTorrent, finished int, total int) {
+	if c.config.progress != nil {
+		c.config.progress(&Torrent{torrent: torrent}, finished, total)
+	}
+}
+
+func (c *Client) emit(torrent *SessionTorrent, event Event) {
+	if c.config.events != nil {
+		event.Torrent = &Torrent{torrent: torrent}
+		c.config.events(event)
+	}
+}
+
+// TorrentOption changes how a torrent added to the Client is downloaded.
+type TorrentOption func(*torrentConfig)
+
+type torrentConfig struct {
+	fileSelection string
+	sequential    bool
+	paused        bool
+}
+
+// WithFiles picks the files to download, a comma separated list of file
+// indexes or glob patterns, each optionally followed by =skip, =normal or
+// =high. All files are downloaded by default.
+func WithFiles(fileSelection string) TorrentOption {
+	return func(c *torrentConfig) { c.fileSelection = fileSelection }
+}
+
+// WithSequential downloads the pieces in order.
+func WithSequential() TorrentOption {
+	return func(c *torrentConfig) { c.sequential = true }
+}
+
+// WithPaused adds the torrent without starting it.
+func WithPaused() TorrentOption {
+	return func(c *torrentConfig) { c.paused = true }
+}
+
+// AddTorrent adds the torrent file in data and starts downloading it to
+// output. Adding a torrent that the client already has returns it.
+func (c *Client) AddTorrent(data []byte, output string, options ...TorrentOption) (*Torrent, error) {
+	config := torrentConfig{}
+	for _, option := range options {
+		option(&config)
+	}
+
+	torrentMeta, err := ParseTorrent(data)
+	if err != nil {
+		return nil, err
+	}
+
+	filePriorities, err := parseFileSelection(config.fileSelection, torrentMeta.getFiles())
+	if err != nil {
+		return nil, err
+	}
+
+	torrent, err := c.session.addTorrent(torrentMeta, output, filePriorities)
+	if err != nil {
+		return nil, err
+	}
+	return c.startTorrent(torrent, config), nil
+}
+
+// AddMagnet adds the torrent of the magnet link and starts downloading it
+// to output. Its metadata is fetched from the peers first, so the files
+// are only known and WithFiles is only applied once that is done.
+func (c *Client) AddMagnet(uri string, output string, options ...TorrentOption) (*Torrent, error) {
+	config := torrentConfig{}
+	for _, option := range options {
+		option(&config)
+	}
+
+	magnet, err := ParseMagnet(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	torrent, err := c.session.addMagnet(magnet, output, config.fileSelection)
+	if err != nil {
+		return nil, err
+	}
+	return c.startTorrent(torrent, config), nil
+}
+
+func (c *Client) startTorrent(torrent *SessionTorrent, config torrentConfig) *Torrent {
+	torrent.mu.Lock()
+	torrent.sequential = config.sequential
+	torrent.mu.Unlock()
+
+	if !config.paused {
+		torrent.start()
+	}
+	return &Torrent{torrent: torrent}
+}
+
+func (c *Client) Torrent(infoHash string) (*Torrent, error) {
+	torrent, err := c.session.getTorrent(infoHash)
+	if err != nil {
+		return nil, err
+	}
+	return &Torrent{torrent: torrent}, nil
+}
+
+// Torrents returns all torrents of the client sorted by name.
+func (c *Client) Torrents() []*Torrent {
+	var torrents []*Torrent
+	for _, torrent := range c.session.listTorrents() {
+		torrents = append(torrents, &Torrent{torrent: torrent})
+	}
+	return torrents
+}
+
+// RemoveTorrent stops the torrent and removes it from the client, already
+// written output is kept.
+func (c *Client) RemoveTorrent(infoHash string) error {
+	return c.session.removeTorrent(infoHash)
+}
+
+// SetBandwidthLimits changes the global limits in bytes per second, 0
+// removes the limit.
+func (c *Client) SetBandwidthLimits(download int, upload int) {
+	c.network.bandwidth.download.setRate(download)
+	c.network.bandwidth.upload.setRate(upload)
+}
+
+// Wait blocks until none of the torrents are downloading.
+func (c *Client) Wait() {
+	c.session.wait()
+}
+
+// Close removes the port mapping, stops local discovery, disconnects the
+// peers that download from us and then stops all torrents. The mapping
+// goes first so it doesn't outlive a process that gets killed while the
+// torrents stop.
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		if c.network.mapping != nil {
+			c.closeErr = c.network.mapping.Close()
+		}
+		if c.network.discovery != nil {
+			c.closeErr = errors.Join(c.closeErr, c.network.discovery.Close())
+		}
+		c.closeErr = errors.Join(c.closeErr, c.server.Close())
+
+		for _, torrent := range c.session.listTorrents() {
+			torrent.stop()
+		}
+	})
+	return c.closeErr
+}
+
+// Torrent is a handle to a torrent of a Client.
+type Torrent struct {
+	torrent *SessionTorrent
+}
+
+func (t *Torrent) InfoHash() string {
+	return t.torrent.metadata().InfoHash
+}
+
+// Name returns the torrent's name, for magnet links without a display name
+// the info hash until the metadata is fetched.
+func (t *Torrent) Name() string {
+	return t.torrent.metadata().Name
+}
+
+// Files returns the paths of the torrent's files relative to its output,
+// nil while the metadata of a magnet link is fetched.
+func (t *Torrent) Files() []string {
+	t.torrent.mu.Lock()
+	defer t.torrent.mu.Unlock()
+
+	if t.torrent.magnet != nil {
+		return nil
+	}
+	return t.torrent.meta.getFilePaths()
+}
+
+func (t *Torrent) Status() TorrentStatus {
+	return getTorrentStatus(t.torrent)
+}
+
+// Start starts a torrent that was added paused or stopped and resumes a
+// paused one.
+func (t *Torrent) Start() {
+	t.torrent.start()
+}
+
+func (t *Torrent) Pause() {
+	t.torrent.pause()
+}
+
+// Stop ends the torrent's download and waits until it has stopped, Start
+// downloads what is missing again.
+func (t *Torrent) Stop() {
+	t.torrent.stop()
+}
+
+// SetBandwidthLimits changes the limits of the torrent in bytes per second,
+// 0 removes the limit.
+func (t *Torrent) SetBandwidthLimits(download int, upload int) error {
+	return t.torrent.session.setTorrentLimits(t.InfoHash(), download, upload)
+}
+
+// Wait blocks until the torrent is no longer downloading and returns why
+// it failed or ErrDownloadStopped if it was stopped.
+func (t *Torrent) Wait() error {
+	t.torrent.wait()
+
+	t.torrent.mu.Lock()
+	defer t.torrent.mu.Unlock()
+
+	switch t.torrent.status {
+	case FAILED:
+		return t.torrent.err
+	case STOPPED:
+		return ErrDownloadStopped
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+package bittorrent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientDownload(t *testing.T) {
+	data := make([]byte, 3*defaultBlockSize+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	swarm := newTestSwarm(t, data, defaultBlockSize)
+	swarm.addSeeder(SeederFaults{})
+
+	var mu sync.Mutex
+	var events []EventType
+	verified := make(map[int]bool)
+	lastProgress := 0
+	client, err := NewClient(
+		WithProgress(func(torrent *Torrent, finished int, total int) {
+			mu.Lock()
+			defer mu.Unlock()
+			if total != len(swarm.meta.Pieces) || torrent.InfoHash() != swarm.meta.InfoHash {
+				t.Errorf("progress reported %d/%d for %s", finished, total, torrent.Name())
+			}
+			lastProgress = finished
+		}),
+		WithEventHandler(func(event Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			if event.Type == EVENT_PIECE_VERIFIED {
+				verified[event.Piece] = true
+				return
+			}
+			events = append(events, event.Type)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	output := filepath.Join(t.TempDir(), "swarm.bin")
+	torrent, err := client.AddTorrent([]byte(swarm.torrent), output, WithPaused(), WithSequential())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := torrent.Status(); status.Status != WAITING || status.TotalPieces != 4 {
+		t.Errorf("status of paused torrent = %+v", status)
+	}
+
+	torrent.Start()
+	if err := torrent.Wait(); err != nil {
+		t.Fatalf("Wait() unexpected error %v", err)
+	}
+
+	written, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, data) {
+		t.Errorf("downloaded data differs from the seeded data")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 2 || events[0] != EVENT_STARTED || events[1] != EVENT_COMPLETED {
+		t.Errorf("events = %v, expected started and completed", events)
+	}
+	if len(verified) != 4 || lastProgress != 4 {
+		t.Errorf("verified pieces %v and progress %d, expected all 4 pieces", verified, lastProgress)
+	}
+
+	if torrents := client.Torrents(); len(torrents) != 1 || torrents[0].Status().Status != COMPLETE {
+		t.Errorf("Torrents() = %v", torrents)
+	}
+	if err := client.RemoveTorrent(torrent.InfoHash()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Torrent(torrent.InfoHash()); err == nil {
+		t.Errorf("expected the removed torrent to be gone")
+	}
+}
+
+func TestClientAddMagnet(t *testing.T) {
+	data := make([]byte, 3*defaultBlockSize+100)
+	for i := range data {
+		data[i] = byte(i % 241)
+	}
+	swarm := newTestSwarm(t, data, defaultBlockSize)
+	swarm.addSeeder(SeederFaults{})
+	// only the uploader supports metadata exchange
+	uploader := newTestUploader(t, swarm)
+	address := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(uploader.network.port))
+	_, err := swarm.tracker.announce(AnnounceRequest{infoHash: string(swarm.meta.InfoHashBytes), peerId: string(uploader.network.peerId), address: address}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	lastFinished, lastTotal := 0, 0
+	client, err := NewClient(WithListenPort(0), WithProgress(func(torrent *Torrent, finished int, total int) {
+		mu.Lock()
+		defer mu.Unlock()
+		lastFinished, lastTotal = finished, total
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	output := filepath.Join(t.TempDir(), "swarm.bin")
+	uri := fmt.Sprintf("magnet:?xt=urn:btih:%s&tr=%s", swarm.meta.InfoHash, url.QueryEscape(swarm.meta.Announce))
+	torrent, err := client.AddMagnet(uri, output, WithPaused())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent.Name() != swarm.meta.InfoHash || torrent.Files() != nil || torrent.Status().TotalPieces != 0 {
+		t.Errorf("magnet without metadata has name %s, files %v and status %+v", torrent.Name(), torrent.Files(), torrent.Status())
+	}
+
+	torrent.Start()
+	if err := torrent.Wait(); err != nil {
+		t.Fatalf("Wait() unexpected error %v", err)
+	}
+
+	written, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, data) {
+		t.Errorf("downloaded data differs from the seeded data")
+	}
+	if torrent.Name() != "swarm.bin" || len(torrent.Files()) != 1 {
+		t.Errorf("magnet with metadata has name %s and files %v", torrent.Name(), torrent.Files())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if lastFinished != 4 || lastTotal != 4 {
+		t.Errorf("progress reported %d/%d, expected 4/4", lastFinished, lastTotal)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	if _, err := NewClient(WithEncryption("always")); err == nil {
+		t.Errorf("expected an error for an invalid encryption policy")
+	}
+
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err := client.AddTorrent([]byte("not a torrent"), t.TempDir()); err == nil {
+		t.Errorf("expected an error for a malformed torrent")
+	}
+	if _, err := client.AddMagnet("magnet:?dn=sample", t.TempDir()); err == nil {
+		t.Errorf("expected an error for a magnet link without info hash")
+	}
+
+	torrent := encodeTestTorrent(t, map[string]interface{}{
+		"announce": "http://127.0.0.1:1/announce",
+		"info": map[string]interface{}{
+			"name":         "sample.txt",
+			"length":       10,
+			"piece length": 16,
+			"pieces":       string(make([]byte, 20)),
+		},
+	})
+	if _, err := client.AddTorrent([]byte(torrent), t.TempDir(), WithFiles("7")); err == nil {
+		t.Errorf("expected an error for a file index that doesn't exist")
+	}
+}
+
+func TestTorrentStop(t *testing.T) {
+	defer func(backoff time.Duration) { announceBackoff = backoff }(announceBackoff)
+	announceBackoff = time.Hour
+
+	// the tracker never answers properly, so the download keeps announcing
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("garbage"))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(WithListenPort(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	data := encodeTestTorrent(t, map[string]interface{}{
+		"announce": server.URL,
+		"info": map[string]interface{}{
+			"name":         "sample.txt",
+			"length":       10,
+			"piece length": 16,
+			"pieces":       string(make([]byte, 20)),
+		},
+	})
+	torrent, err := client.AddTorrent([]byte(data), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	torrent.Stop()
+	if err := torrent.Wait(); !errors.Is(err, ErrDownloadStopped) {
+		t.Errorf("Wait() error = %v, expected ErrDownloadStopped", err)
+	}
+	if status := torrent.Status(); status.Status != STOPPED {
+		t.Errorf("status of stopped torrent = %s, expected %s", status.Status, STOPPED)
+	}
+}
+
+func TestClientsAreIndependent(t *testing.T) {
+	first, err := NewClient(WithEncryption(ENCRYPTION_REQUIRE), WithBandwidthLimits(1024, 2048))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewClient(WithTransport(TRANSPORT_UTP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.SetBandwidthLimits(4096, 0)
+	second.Close()
+
+	if first.network.encryption != ENCRYPTION_REQUIRE || first.network.transport != TRANSPORT_TCP {
+		t.Errorf("first client has encryption %s and transport %s", first.network.encryption, first.network.transport)
+	}
+	if rate := first.network.bandwidth.download.getRate(); rate != 1024 {
+		t.Errorf("first client has download limit %d, expected 1024", rate)
+	}
+	if bytes.Equal(first.network.peerId, second.network.peerId) {
+		t.Errorf("both clients have peer id %s", first.network.peerId)
+	}
+	first.Close()
+}
+
+func TestClientListenPort(t *testing.T) {
+	// the second client falls back to any port if the default is taken
+	first, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	if first.network.port == second.network.port {
+		t.Errorf("both clients use port %d", first.network.port)
+	}
+	for _, client := range []*Client{first, second} {
+		// trackers, LAN peers and the gateway are told the port that is bound
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", client.network.port))
+		if err != nil {
+			t.Errorf("client doesn't listen on port %d: %v", client.network.port, err)
+			continue
+		}
+		conn.Close()
+	}
+
+	if _, err := NewClient(WithListenPort(second.network.port)); err == nil {
+		t.Errorf("expected an error for a port that is taken")
+	}
+}
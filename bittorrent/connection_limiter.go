@@ -0,0 +1,83 @@
+package bittorrent
+
+import "sync"
+
+// ConnectionLimiter caps the peer connections open at the same time. A
+// freed connection goes to the LAN peers waiting for one before the remote
+// peers, since LAN peers are fast and cheap to reach.
+type ConnectionLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	open   int
+	local  []chan struct{}
+	remote []chan struct{}
+}
+
+func newConnectionLimiter(limit int) *ConnectionLimiter {
+	return &ConnectionLimiter{limit: limit}
+}
+
+// acquire blocks until a connection may be opened and returns false if stop
+// was closed first.
+func (l *ConnectionLimiter) acquire(local bool, stop <-chan struct{}) bool {
+	l.mu.Lock()
+	// release hands connections to the waiters, so a free one means nobody waits
+	if l.open < l.limit {
+		l.open++
+		l.mu.Unlock()
+		return true
+	}
+
+	ready := make(chan struct{})
+	if local {
+		l.local = append(l.local, ready)
+	} else {
+		l.remote = append(l.remote, ready)
+	}
+	l.mu.Unlock()
+
+	select {
+	case <-ready:
+		return true
+	case <-stop:
+	}
+
+	l.mu.Lock()
+	waiting := l.removeWaiter(ready)
+	l.mu.Unlock()
+	if !waiting {
+		// the connection was handed over while stopping
+		l.release()
+	}
+	return false
+}
+
+// release frees a connection or passes it on to the next waiter.
+func (l *ConnectionLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var next chan struct{}
+	switch {
+	case len(l.local) > 0:
+		next, l.local = l.local[0], l.local[1:]
+	case len(l.remote) > 0:
+		next, l.remote = l.remote[0], l.remote[1:]
+	default:
+		l.open--
+		return
+	}
+	close(next)
+}
+
+func (l *ConnectionLimiter) removeWaiter(ready chan struct{}) bool {
+	for _, waiters := range []*[]chan struct{}{&l.local, &l.remote} {
+		for i, waiter := range *waiters {
+			if waiter == ready {
+				*waiters = append((*waiters)[:i:i], (*waiters)[i+1:]...)
+				return true
+			}
+		}
+	}
+	return false
+}
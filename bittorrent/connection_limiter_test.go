@@ -0,0 +1,77 @@
+package bittorrent
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnectionLimiterPrefersLocalPeers(t *testing.T) {
+	limiter := newConnectionLimiter(1)
+	if !limiter.acquire(false, nil) {
+		t.Fatal("expected a free connection")
+	}
+
+	order := make(chan string, 3)
+	var wg sync.WaitGroup
+	waitFor := func(name string, local bool, waiters int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if limiter.acquire(local, nil) {
+				order <- name
+				limiter.release()
+			}
+		}()
+		// the waiters queue up in the order they are started
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			limiter.mu.Lock()
+			waiting := len(limiter.local) + len(limiter.remote)
+			limiter.mu.Unlock()
+			if waiting == waiters || time.Now().After(deadline) {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFor("remote 1", false, 1)
+	waitFor("remote 2", false, 2)
+	waitFor("local", true, 3)
+
+	limiter.release()
+	wg.Wait()
+	close(order)
+	var got []string
+	for name := range order {
+		got = append(got, name)
+	}
+	if expected := []string{"local", "remote 1", "remote 2"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("connections went to %v, expected %v", got, expected)
+	}
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if limiter.open != 0 {
+		t.Errorf("%d connections left open", limiter.open)
+	}
+}
+
+func TestConnectionLimiterStop(t *testing.T) {
+	limiter := newConnectionLimiter(1)
+	limiter.acquire(false, nil)
+
+	stop := make(chan struct{})
+	acquired := make(chan bool)
+	go func() { acquired <- limiter.acquire(true, stop) }()
+
+	close(stop)
+	if <-acquired {
+		t.Errorf("expected acquire to fail once stopped")
+	}
+
+	limiter.release()
+	if limiter.open != 0 || len(limiter.local) != 0 {
+		t.Errorf("stopped waiter kept %d connections and %d waiters", limiter.open, len(limiter.local))
+	}
+}
@@ -0,0 +1,249 @@
+package bittorrent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+const DefaultDaemonAddress = "127.0.0.1:6880"
+
+// AddTorrentRequest adds a torrent file or a magnet link to the daemon. The
+// limits are the torrent's own in bytes per second, 0 leaves it unlimited.
+type AddTorrentRequest struct {
+	Torrent       []byte `json:"torrent,omitempty"`
+	Magnet        string `json:"magnet,omitempty"`
+	Output        string `json:"output"`
+	Files         string `json:"files,omitempty"`
+	Sequential    bool   `json:"sequential,omitempty"`
+	DownloadLimit int    `json:"download_limit,omitempty"`
+	UploadLimit   int    `json:"upload_limit,omitempty"`
+	Paused        bool   `json:"paused,omitempty"`
+}
+
+type LimitsRequest struct {
+	Download int `json:"download"`
+	Upload   int `json:"upload"`
+}
+
+type TorrentStatus struct {
+	InfoHash       string  `json:"info_hash"`
+	Name           string  `json:"name"`
+	Output         string  `json:"output"`
+	Status         string  `json:"status"`
+	FinishedPieces int     `json:"finished_pieces"`
+	TotalPieces    int     `json:"total_pieces"`
+	Progress       float64 `json:"progress"`
+	Peers          int     `json:"peers"`
+	Private        bool    `json:"private"`
+	DownloadRate   int     `json:"download_rate"`
+	UploadRate     int     `json:"upload_rate"`
+	Error          string  `json:"error,omitempty"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// newDaemonHandler exposes the session over a local HTTP/JSON API. Rates and
+// limits are in bytes per second.
+func newDaemonHandler(session *Session) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /torrents", func(w http.ResponseWriter, r *http.Request) {
+		statuses := []TorrentStatus{}
+		for _, torrent := range session.listTorrents() {
+			statuses = append(statuses, getTorrentStatus(torrent))
+		}
+		writeJSON(w, http.StatusOK, statuses)
+	})
+
+	mux.HandleFunc("POST /torrents", func(w http.ResponseWriter, r *http.Request) {
+		var request AddTorrentRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("invalid request body"))
+			return
+		}
+
+		torrent, status, err := addDaemonTorrent(session, request)
+		if err != nil {
+			writeError(w, status, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, getTorrentStatus(torrent))
+	})
+
+	mux.HandleFunc("GET /torrents/{infoHash}", func(w http.ResponseWriter, r *http.Request) {
+		torrent, err := session.getTorrent(r.PathValue("infoHash"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, getTorrentStatus(torrent))
+	})
+
+	mux.HandleFunc("POST /torrents/{infoHash}/pause", func(w http.ResponseWriter, r *http.Request) {
+		torrent, err := session.getTorrent(r.PathValue("infoHash"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		torrent.pause()
+		writeJSON(w, http.StatusOK, getTorrentStatus(torrent))
+	})
+
+	mux.HandleFunc("POST /torrents/{infoHash}/resume", func(w http.ResponseWriter, r *http.Request) {
+		torrent, err := session.getTorrent(r.PathValue("infoHash"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		torrent.start()
+		writeJSON(w, http.StatusOK, getTorrentStatus(torrent))
+	})
+
+	mux.HandleFunc("DELETE /torrents/{infoHash}", func(w http.ResponseWriter, r *http.Request) {
+		if err := session.removeTorrent(r.PathValue("infoHash")); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("PUT /torrents/{infoHash}/limits", func(w http.ResponseWriter, r *http.Request) {
+		var request LimitsRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("invalid request body"))
+			return
+		}
+
+		if err := session.setTorrentLimits(r.PathValue("infoHash"), request.Download, request.Upload); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, request)
+	})
+
+	mux.HandleFunc("PUT /limits", func(w http.ResponseWriter, r *http.Request) {
+		var request LimitsRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("invalid request body"))
+			return
+		}
+
+		session.network.bandwidth.download.setRate(request.Download)
+		session.network.bandwidth.upload.setRate(request.Upload)
+		writeJSON(w, http.StatusOK, request)
+	})
+
+	return mux
+}
+
+// addDaemonTorrent adds and starts the requested torrent and returns the
+// HTTP status to report if that fails.
+func addDaemonTorrent(session *Session, request AddTorrentRequest) (*SessionTorrent, int, error) {
+	if request.Output == "" {
+		return nil, http.StatusBadRequest, errors.New("output not specified")
+	}
+
+	if len(request.Torrent) == 0 && request.Magnet == "" {
+		return nil, http.StatusBadRequest, errors.New("torrent or magnet not specified")
+	}
+	if len(request.Torrent) != 0 && request.Magnet != "" {
+		return nil, http.StatusBadRequest, errors.New("only one of torrent and magnet can be specified")
+	}
+
+	var torrent *SessionTorrent
+	if request.Magnet != "" {
+		magnet, err := ParseMagnet(request.Magnet)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		// the file selection is checked once the metadata is there
+		torrent, err = session.addMagnet(magnet, request.Output, request.Files)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	} else {
+		torrentMeta, err := ParseTorrent(request.Torrent)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+
+		filePriorities, err := parseFileSelection(request.Files, torrentMeta.getFiles())
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+
+		torrent, err = session.addTorrent(torrentMeta, request.Output, filePriorities)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+
+	torrent.mu.Lock()
+	torrent.sequential = request.Sequential
+	torrent.mu.Unlock()
+
+	if request.DownloadLimit != 0 || request.UploadLimit != 0 {
+		err := session.setTorrentLimits(torrent.metadata().InfoHash, request.DownloadLimit, request.UploadLimit)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+
+	if !request.Paused {
+		torrent.start()
+	}
+	return torrent, http.StatusCreated, nil
+}
+
+func getTorrentStatus(torrent *SessionTorrent) TorrentStatus {
+	torrent.mu.Lock()
+	defer torrent.mu.Unlock()
+
+	limits := torrent.session.network.bandwidthForTorrent(torrent.meta.InfoHash)
+	status := TorrentStatus{
+		InfoHash:       torrent.meta.InfoHash,
+		Name:           torrent.meta.Name,
+		Output:         torrent.output,
+		Status:         torrent.status,
+		FinishedPieces: torrent.finished,
+		TotalPieces:    torrent.selected,
+		Peers:          torrent.peers,
+		Private:        torrent.meta.Private,
+		DownloadRate:   limits.download.transferRate(),
+		UploadRate:     limits.upload.transferRate(),
+	}
+
+	if status.TotalPieces > 0 {
+		status.Progress = float64(status.FinishedPieces) / float64(status.TotalPieces)
+	}
+	if torrent.err != nil {
+		status.Error = torrent.err.Error()
+	}
+
+	return status
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Debug().Msg(fmt.Sprintf("[Daemon] failed to write response: %s", err))
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, ErrorResponse{Error: err.Error()})
+}
+
+// RunDaemon serves the control API for the torrents of the client.
+func RunDaemon(address string, client *Client) error {
+	log.Info().Msg(fmt.Sprintf("[Daemon] listening on %s", address))
+	return http.ListenAndServe(address, newDaemonHandler(client.session))
+}
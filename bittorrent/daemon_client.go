@@ -0,0 +1,97 @@
+package bittorrent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// DaemonClient lets the CLI commands control a running daemon.
+type DaemonClient struct {
+	baseUrl string
+	client  *http.Client
+}
+
+func NewDaemonClient(address string) DaemonClient {
+	return DaemonClient{
+		baseUrl: fmt.Sprintf("http://%s", address),
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c DaemonClient) AddTorrent(request AddTorrentRequest) (TorrentStatus, error) {
+	var status TorrentStatus
+	err := c.do(http.MethodPost, "/torrents", request, &status)
+	return status, err
+}
+
+func (c DaemonClient) ListTorrents() ([]TorrentStatus, error) {
+	var statuses []TorrentStatus
+	err := c.do(http.MethodGet, "/torrents", nil, &statuses)
+	return statuses, err
+}
+
+func (c DaemonClient) PauseTorrent(infoHash string) (TorrentStatus, error) {
+	var status TorrentStatus
+	err := c.do(http.MethodPost, "/torrents/"+infoHash+"/pause", nil, &status)
+	return status, err
+}
+
+func (c DaemonClient) ResumeTorrent(infoHash string) (TorrentStatus, error) {
+	var status TorrentStatus
+	err := c.do(http.MethodPost, "/torrents/"+infoHash+"/resume", nil, &status)
+	return status, err
+}
+
+func (c DaemonClient) RemoveTorrent(infoHash string) error {
+	return c.do(http.MethodDelete, "/torrents/"+infoHash, nil, nil)
+}
+
+// SetLimits changes the limits of the torrent with the given info hash or
+// the global limits if the info hash is empty.
+func (c DaemonClient) SetLimits(infoHash string, limits LimitsRequest) error {
+	path := "/limits"
+	if infoHash != "" {
+		path = "/torrents/" + infoHash + "/limits"
+	}
+	return c.do(http.MethodPut, path, limits, nil)
+}
+
+func (c DaemonClient) do(method string, path string, body interface{}, result interface{}) error {
+	var requestBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		requestBody = bytes.NewReader(encoded)
+	}
+
+	request, err := http.NewRequest(method, c.baseUrl+path, requestBody)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to reach daemon: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= http.StatusBadRequest {
+		var errorResponse ErrorResponse
+		if err := json.NewDecoder(response.Body).Decode(&errorResponse); err != nil {
+			return fmt.Errorf("daemon returned %s", response.Status)
+		}
+		return fmt.Errorf("daemon returned %s: %s", response.Status, errorResponse.Error)
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
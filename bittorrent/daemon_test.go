@@ -0,0 +1,143 @@
+package bittorrent
+
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newTestDaemon(t *testing.T) (*Session, DaemonClient) {
+	session := newSession(0, newTestNetwork())
+	server := httptest.NewServer(newDaemonHandler(session))
+	t.Cleanup(server.Close)
+
+	return session, NewDaemonClient(strings.TrimPrefix(server.URL, "http://"))
+}
+
+func TestDaemonAddTorrent(t *testing.T) {
+	session, client := newTestDaemon(t)
+
+	file, err := os.ReadFile("../torrents/sample.torrent")
+	if err != nil {
+		t.Fatalf("failed to read sample torrent: %v", err)
+	}
+
+	status, err := client.AddTorrent(AddTorrentRequest{Torrent: file, Output: "sample.txt", Sequential: true, DownloadLimit: 2048, Paused: true})
+	if err != nil {
+		t.Fatalf("addTorrent() unexpected error %v", err)
+	}
+	if status.Name != "sample.txt" || status.Status != WAITING || status.TotalPieces != 3 {
+		t.Errorf("addTorrent() returned unexpected status %+v", status)
+	}
+
+	torrent, _ := session.getTorrent(status.InfoHash)
+	limits := session.network.bandwidthForTorrent(status.InfoHash)
+	if !torrent.sequential || limits.download.getRate() != 2048 || limits.upload.getRate() != 0 {
+		t.Errorf("added torrent has sequential %t and limits %d/%d", torrent.sequential, limits.download.getRate(), limits.upload.getRate())
+	}
+
+	statuses, err := client.ListTorrents()
+	if err != nil {
+		t.Fatalf("listTorrents() unexpected error %v", err)
+	}
+	if len(statuses) != 1 || statuses[0].InfoHash != status.InfoHash {
+		t.Errorf("listTorrents() = %+v, expected the added torrent", statuses)
+	}
+
+	if err := client.RemoveTorrent(status.InfoHash); err != nil {
+		t.Errorf("removeTorrent() unexpected error %v", err)
+	}
+	if len(session.listTorrents()) != 0 {
+		t.Errorf("expected session to be empty after removing the torrent")
+	}
+}
+
+func TestDaemonAddMagnet(t *testing.T) {
+	session, client := newTestDaemon(t)
+
+	magnet := "magnet:?xt=urn:btih:c77829d2a77d6516f88cd7a3de1a26abcbfab0db&dn=sample.txt"
+	status, err := client.AddTorrent(AddTorrentRequest{Magnet: magnet, Output: "sample.txt", Files: "*.txt", Paused: true})
+	if err != nil {
+		t.Fatalf("addTorrent() unexpected error %v", err)
+	}
+	if status.InfoHash != "c77829d2a77d6516f88cd7a3de1a26abcbfab0db" || status.Name != "sample.txt" || status.Status != WAITING || status.TotalPieces != 0 {
+		t.Errorf("addTorrent() returned unexpected status %+v", status)
+	}
+
+	torrent, err := session.getTorrent(status.InfoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent.magnet == nil || torrent.fileSelection != "*.txt" || torrent.serving() {
+		t.Errorf("added magnet has selection %q and serves %t before its metadata is fetched", torrent.fileSelection, torrent.serving())
+	}
+}
+
+func TestDaemonAddTorrentErrors(t *testing.T) {
+	_, client := newTestDaemon(t)
+
+	tests := []struct {
+		name    string
+		request AddTorrentRequest
+		want    string
+	}{
+		{
+			name:    "Missing output",
+			request: AddTorrentRequest{Torrent: []byte("d4:infode")},
+			want:    "400 Bad Request: output not specified",
+		},
+		{
+			name:    "Missing torrent",
+			request: AddTorrentRequest{Output: "out"},
+			want:    "400 Bad Request: torrent or magnet not specified",
+		},
+		{
+			name:    "Torrent and magnet",
+			request: AddTorrentRequest{Torrent: []byte("d4:infode"), Magnet: "magnet:?xt=urn:btih:c77829d2a77d6516f88cd7a3de1a26abcbfab0db", Output: "out"},
+			want:    "400 Bad Request: only one of torrent and magnet",
+		},
+		{
+			name:    "Invalid magnet",
+			request: AddTorrentRequest{Magnet: "magnet:?dn=sample", Output: "out"},
+			want:    "400 Bad Request: magnet link has no btih info hash",
+		},
+		{
+			name:    "Invalid torrent",
+			request: AddTorrentRequest{Torrent: []byte("not bencode"), Output: "out"},
+			want:    "400 Bad Request: invalid metainfo",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := client.AddTorrent(tt.request)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("addTorrent() error = %v, expected %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDaemonUnknownTorrent(t *testing.T) {
+	_, client := newTestDaemon(t)
+
+	if _, err := client.PauseTorrent("unknown"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("pauseTorrent() error = %v, expected 404", err)
+	}
+	if err := client.SetLimits("unknown", LimitsRequest{}); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("setLimits() error = %v, expected 404", err)
+	}
+}
+
+func TestDaemonSetGlobalLimits(t *testing.T) {
+	session, client := newTestDaemon(t)
+	bandwidth := session.network.bandwidth
+
+	if err := client.SetLimits("", LimitsRequest{Download: 4096, Upload: 1024}); err != nil {
+		t.Fatalf("setLimits() unexpected error %v", err)
+	}
+	if bandwidth.download.getRate() != 4096 || bandwidth.upload.getRate() != 1024 {
+		t.Errorf("unexpected global limits %d/%d", bandwidth.download.getRate(), bandwidth.upload.getRate())
+	}
+}
@@ -0,0 +1,526 @@
+package bittorrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const defaultBlockSize int = 16 * 1024
+
+const (
+	WAITING     = "waiting"
+	IN_PROGRESS = "in progress"
+	COMPLETE    = "complete"
+	PAUSED      = "paused"
+	STOPPED     = "stopped"
+	FAILED      = "failed"
+)
+
+// ErrDownloadStopped is returned for downloads that were stopped before
+// they finished.
+var ErrDownloadStopped = errors.New("download stopped")
+
+// ErrNoPeers is returned for downloads whose peers all gave up or
+// excluded the pieces that are left.
+var ErrNoPeers = errors.New("no peers left to download from")
+
+// maxPeerFailures is how many pieces in a row a peer may fail before it is
+// dropped from the download.
+const maxPeerFailures = 10
+
+// webSeedRetryDelay is how long a web seed rests after a failed piece, it
+// doubles with every failure in a row up to maxWebSeedRetryDelay.
+var webSeedRetryDelay = time.Second
+
+const maxWebSeedRetryDelay = 30 * time.Second
+
+// lanPeerWait is how long a download without workers waits for LAN peers to
+// announce themselves before it fails with ErrNoPeers.
+var lanPeerWait = 2 * lsdInterval
+
+// errPieceCorrupt means the data of a piece did not match its hash.
+var errPieceCorrupt = errors.New("integrity check failed")
+
+type Piece struct {
+	number int
+	status string
+}
+
+type Peer struct {
+	id         int
+	address    netip.AddrPort
+	status     string
+	webSeedUrl string
+	// local peers were found on the LAN through local service discovery
+	local bool
+}
+
+type Result struct {
+	piece  int
+	result []byte
+}
+
+type PeerRequestMessage struct {
+	lengthPrefix uint32
+	id           uint8
+	index        uint32
+	begin        uint32
+	length       uint32
+}
+
+// downloadControl lets the owner of a download pause, resume or stop it
+// and limits how many peer connections are open at the same time.
+type downloadControl struct {
+	mu          sync.Mutex
+	paused      bool
+	resumed     chan struct{}
+	stopped     chan struct{}
+	stopOnce    sync.Once
+	connections *ConnectionLimiter
+	progress    func(finishedPieces int)
+	verified    func(result Result)
+}
+
+func newDownloadControl(connections *ConnectionLimiter) *downloadControl {
+	return &downloadControl{
+		resumed:     make(chan struct{}),
+		stopped:     make(chan struct{}),
+		connections: connections,
+	}
+}
+
+func (c *downloadControl) pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.paused {
+		c.paused = true
+		c.resumed = make(chan struct{})
+	}
+}
+
+func (c *downloadControl) resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.paused {
+		c.paused = false
+		close(c.resumed)
+	}
+}
+
+func (c *downloadControl) stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopped)
+	})
+}
+
+func (c *downloadControl) isStopped() bool {
+	select {
+	case <-c.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitWhilePaused blocks until the download is running and returns false
+// if it was stopped instead.
+func (c *downloadControl) waitWhilePaused() bool {
+	c.mu.Lock()
+	paused, resumed := c.paused, c.resumed
+	c.mu.Unlock()
+
+	if paused {
+		select {
+		case <-resumed:
+		case <-c.stopped:
+		}
+	}
+
+	return !c.isStopped()
+}
+
+// sleep waits for the duration and returns false if the download was
+// stopped in the meantime.
+func (c *downloadControl) sleep(duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-c.stopped:
+		return false
+	}
+}
+
+// acquireConnection waits for a free connection, LAN peers get one before
+// remote peers. It returns false if the download was stopped first.
+func (c *downloadControl) acquireConnection(local bool) bool {
+	if c.connections == nil {
+		return true
+	}
+	return c.connections.acquire(local, c.stopped)
+}
+
+func (c *downloadControl) releaseConnection() {
+	if c.connections != nil {
+		c.connections.release()
+	}
+}
+
+func (c *downloadControl) reportVerified(result Result) {
+	if c.verified != nil {
+		c.verified(result)
+	}
+}
+
+func (c *downloadControl) reportProgress(finishedPieces int) {
+	if c.progress != nil {
+		c.progress(finishedPieces)
+	}
+}
+
+// getTorrentPeers returns the peers from the tracker and the web seeds of
+// the torrent. A tracker error is only returned if there are no web seeds
+// to fall back to, closing stop ends the announce with ErrDownloadStopped.
+func getTorrentPeers(network *PeerNetwork, torrentMeta TorrentMeta, stop <-chan struct{}) ([]Peer, error) {
+	peers := []Peer{}
+
+	// every source is checked, so none of them bypasses the private flag
+	var webSeeds []string
+	if torrentMeta.allowsPeerSource(PEER_SOURCE_WEB_SEED) {
+		webSeeds = torrentMeta.UrlList
+	}
+
+	var addresses []netip.AddrPort
+	if torrentMeta.allowsPeerSource(PEER_SOURCE_TRACKER) {
+		var err error
+		addresses, err = getPeers(network, torrentMeta, stop)
+		if err != nil {
+			if len(webSeeds) == 0 || errors.Is(err, ErrDownloadStopped) {
+				return nil, err
+			}
+			log.Error().Msg(fmt.Sprintf("continuing with web seeds only: %s", err))
+		}
+	}
+
+	for j, address := range addresses {
+		peer := Peer{j, address, "idle", "", false}
+		peers = append(peers, peer)
+	}
+
+	// web seeds download pieces over HTTP but otherwise work like any other peer
+	for _, url := range webSeeds {
+		peer := Peer{len(peers), netip.AddrPort{}, "idle", url, false}
+		peers = append(peers, peer)
+	}
+
+	return peers, nil
+}
+
+func getTorrentPieces(torrentMeta TorrentMeta) []Piece {
+	pieces := []Piece{}
+
+	for i := 0; i < len(torrentMeta.Pieces); i++ {
+		piece := Piece{i, WAITING}
+		pieces = append(pieces, piece)
+	}
+
+	return pieces
+}
+
+// downloadTorrentPieces downloads the pieces of the picker until all of them
+// are finished, the download is stopped or no peer is left. The pieces
+// finished so far are returned together with ErrDownloadStopped or
+// ErrNoPeers in the last two cases. With local discovery the download
+// waits up to lanPeerWait for LAN peers before running out of peers.
+func downloadTorrentPieces(network *PeerNetwork, torrentMeta TorrentMeta, picker *PiecePicker, peers []Peer, control *downloadControl) ([]Result, error) {
+	numJobs := picker.remaining()
+	results := make(chan Result, numJobs)
+
+	// exited is signalled whenever a worker is gone, live counts the workers
+	// that are still running
+	var workers sync.WaitGroup
+	var live atomic.Int32
+	exited := make(chan struct{}, 1)
+	startWorker := func(worker Peer) {
+		workers.Add(1)
+		live.Add(1)
+		picker.addWorker()
+		go func() {
+			defer workers.Done()
+			downloadTorrentPieceWorker(network, torrentMeta, worker, control, picker, results)
+
+			picker.removeWorker()
+			live.Add(-1)
+			select {
+			case exited <- struct{}{}:
+			default:
+			}
+		}()
+	}
+
+	// Create a goroutine for each peer
+	known := make(map[netip.AddrPort]bool)
+	for _, peer := range peers {
+		known[peer.address] = true
+		startWorker(peer)
+	}
+
+	// peers found on the LAN join the download while it runs
+	var discovered <-chan netip.AddrPort
+	nextId := len(peers)
+	if network.discovery != nil && torrentMeta.allowsPeerSource(PEER_SOURCE_LOCAL_DISCOVERY) {
+		var cancel func()
+		discovered, cancel = network.discovery.watch(torrentMeta.InfoHash)
+		defer cancel()
+	}
+
+	// Wait until all pieces are downloaded, the download was stopped or
+	// there is no one left to download from
+	var totalResults []Result
+	var err error
+	// idle fires once the download went lanPeerWait without workers
+	var idleTimer *time.Timer
+	var idle <-chan time.Time
+	idleTimedOut := false
+	for len(totalResults) < numJobs {
+		if control.isStopped() {
+			log.Debug().Msg("Download stopped, stopping workers")
+			err = ErrDownloadStopped
+			break
+		}
+		// workers report their pieces before they exit, so none are on the way
+		if live.Load() == 0 && len(results) == 0 {
+			if discovered == nil || idleTimedOut {
+				log.Debug().Msg("No peers left, stopping download")
+				err = fmt.Errorf("%w, %d of %d pieces missing", ErrNoPeers, numJobs-len(totalResults), numJobs)
+				break
+			}
+			if idleTimer == nil {
+				idleTimer = time.NewTimer(lanPeerWait)
+				idle = idleTimer.C
+			}
+		} else if idleTimer != nil {
+			idleTimer.Stop()
+			idleTimer, idle = nil, nil
+		}
+
+		select {
+		case result := <-results:
+			totalResults = append(totalResults, result)
+			control.reportProgress(len(totalResults))
+		case address := <-discovered:
+			if !known[address] {
+				known[address] = true
+				startWorker(Peer{nextId, address, "idle", "", true})
+				nextId++
+			}
+		case <-exited:
+		case <-idle:
+			idleTimedOut = true
+		case <-control.stopped:
+		}
+	}
+	if idleTimer != nil {
+		idleTimer.Stop()
+	}
+
+	// workers may still report pieces they were working on, so the results
+	// are only closed once all of them are gone
+	picker.close()
+	workers.Wait()
+	close(results)
+
+	for r := range results {
+		totalResults = append(totalResults, r)
+	}
+
+	return totalResults, err
+}
+
+func downloadTorrentPieceWorker(network *PeerNetwork, torrentMeta TorrentMeta, peer Peer, control *downloadControl, picker *PiecePicker, results chan<- Result) {
+	// pieces the peer sent corrupt data for are left to the other peers
+	corrupt := make(map[int]bool)
+	// pieces the peer suggested or allows while choking are asked for first
+	hints := make(map[int]bool)
+	failures := 0
+	retryDelay := webSeedRetryDelay
+	for {
+		piece, ok := picker.nextFor(corrupt, hints)
+		if !ok {
+			log.Debug().Msg(fmt.Sprintf("[Peer %d] stopped", peer.id))
+			return
+		}
+
+		// a paused download keeps its workers but lets them idle
+		if !control.waitWhilePaused() || !control.acquireConnection(peer.local) {
+			picker.requeue(piece)
+			log.Debug().Msg(fmt.Sprintf("[Peer %d] stopped", peer.id))
+			return
+		}
+
+		log.Debug().Msg(fmt.Sprintf("[Peer %d] started downloading piece: %d", peer.id, piece.number))
+		piece.status = IN_PROGRESS
+		var result []byte
+		var err error
+		if peer.webSeedUrl != "" {
+			result, err = downloadWebSeedPiece(network, torrentMeta, peer.webSeedUrl, piece.number)
+		} else {
+			result, err = downloadTorrentPiece(network, torrentMeta, peer.address, piece.number, hints)
+		}
+		control.releaseConnection()
+		if err != nil {
+			if errors.Is(err, errPieceCorrupt) {
+				corrupt[piece.number] = true
+			}
+			piece.status = WAITING
+			picker.requeue(piece)
+			log.Debug().Msg(fmt.Sprintf("[Peer %d] failed downloading piece: %d - %s", peer.id, piece.number, err))
+
+			failures++
+			if failures >= maxPeerFailures {
+				log.Debug().Msg(fmt.Sprintf("[Peer %d] giving up after %d failed pieces", peer.id, failures))
+				return
+			}
+
+			// a failing web seed is likely overloaded or down, so it isn't
+			// asked again right away. The piece is left to the other peers.
+			if peer.webSeedUrl != "" {
+				if !control.sleep(retryDelay) {
+					return
+				}
+				retryDelay = min(2*retryDelay, maxWebSeedRetryDelay)
+			}
+		} else {
+			failures = 0
+			retryDelay = webSeedRetryDelay
+			piece.status = COMPLETE
+			delete(hints, piece.number)
+
+			res := Result{piece: piece.number, result: result}
+			control.reportVerified(res)
+			results <- res
+
+			log.Debug().Msg(fmt.Sprintf("[Peer %d] downloaded piece: %d", peer.id, piece.number))
+		}
+	}
+}
+
+// downloadTorrentPiece downloads the piece from the peer over a new
+// connection and adds the pieces the peer hinted at to hints.
+func downloadTorrentPiece(network *PeerNetwork, torrentMeta TorrentMeta, peer netip.AddrPort, pieceIndex int, hints map[int]bool) ([]byte, error) {
+	conn, handshake, err := peerHandshake(network, peer, torrentMeta.InfoHashBytes)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	state := newPeerState(handshake, len(torrentMeta.Pieces))
+	defer state.addHints(hints)
+	err = exchangePeerMessages(conn, state, pieceIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	pieceOffset := 0
+
+	pieceLength := getPieceLength(pieceIndex, torrentMeta)
+	blocks := int(math.Ceil(float64(pieceLength) / float64(defaultBlockSize)))
+
+	// pipeline block request messages
+	for range blocks {
+		nextLength := pieceLength - pieceOffset
+		blockSize := math.Min(float64(defaultBlockSize), float64(nextLength))
+
+		payload := PeerRequestMessage{
+			lengthPrefix: 13,
+			id:           request,
+			index:        uint32(pieceIndex),
+			begin:        uint32(pieceOffset),
+			length:       uint32(blockSize),
+		}
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, payload)
+
+		err = sendMessageToPeer(conn, buf.Bytes())
+		if err != nil {
+			return nil, err
+		}
+
+		pieceOffset += int(blockSize)
+	}
+
+	// receive block messages and assemble the piece
+	downloadedPiece := make([]byte, pieceLength)
+	receivedBlocks := make(map[int]bool)
+	for len(receivedBlocks) < blocks {
+		payload, err := readMessage(conn, maxMessageLength(len(torrentMeta.Pieces)))
+		if err != nil {
+			return nil, errors.New("error receiving data message")
+		}
+
+		switch payload[0] {
+		case piece:
+			message, err := parsePieceMessage(payload)
+			if err != nil {
+				return nil, err
+			}
+			if message.index != pieceIndex || message.begin%defaultBlockSize != 0 || message.begin+len(message.data) > pieceLength {
+				return nil, errors.New("peer sent a block that wasn't requested")
+			}
+			copy(downloadedPiece[message.begin:], message.data)
+			receivedBlocks[message.begin] = true
+		case rejectRequest:
+			// fails for peers without the Fast extension
+			err = state.handleMessage(payload)
+			if err != nil {
+				return nil, err
+			}
+			// the piece goes back to the queue right away instead of waiting for a timeout
+			return nil, errRequestRejected
+		case hashRequest:
+			response, err := createHashResponse(torrentMeta, payload)
+			if err != nil {
+				return nil, err
+			}
+			err = sendMessageToPeer(conn, response)
+			if err != nil {
+				return nil, err
+			}
+		case choke:
+			// without the Fast extension a choke drops all requests, with it
+			// every dropped request is rejected explicitly
+			if !state.fast {
+				return nil, errors.New("peer choked us")
+			}
+			state.choked = true
+		default:
+			err = state.handleMessage(payload)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if !torrentMeta.verifyPiece(pieceIndex, downloadedPiece) {
+		return nil, errPieceCorrupt
+	}
+	// peers that upload to us get our upload slots in return
+	if network.server != nil {
+		network.server.recordDownload(torrentMeta.InfoHash, handshake.peerId, pieceLength)
+	}
+
+	return downloadedPiece, nil
+}
@@ -0,0 +1,159 @@
+package bittorrent
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// Fast extension (BEP 6) messages
+const (
+	suggestPiece  = 13
+	haveAll       = 14
+	haveNone      = 15
+	rejectRequest = 16
+	allowedFast   = 17
+)
+
+// allowedFastSetSize is how many pieces choked peers may download from us.
+const allowedFastSetSize = 10
+
+// fastExtensionBit is set in the last reserved byte of the handshake by
+// peers that support the Fast extension.
+const fastExtensionBit = 0x04
+
+var errRequestRejected = errors.New("peer rejected the request")
+
+// PeerState is what we know about a connected peer from its messages.
+type PeerState struct {
+	fast        bool
+	pieces      int
+	bitfield    Bitfield
+	choked      bool
+	interested  bool
+	allowedFast map[int]bool
+	suggested   []int
+}
+
+func newPeerState(handshake Handshake, pieces int) *PeerState {
+	return &PeerState{
+		fast:        handshake.reserved[7]&fastExtensionBit != 0,
+		pieces:      pieces,
+		bitfield:    make(Bitfield, (pieces+7)/8),
+		choked:      true,
+		allowedFast: make(map[int]bool),
+	}
+}
+
+func (s *PeerState) hasPiece(index int) bool {
+	return index >= 0 && index < s.pieces && s.bitfield.hasPiece(index)
+}
+
+// canRequest reports whether a request for the piece would be served.
+func (s *PeerState) canRequest(index int) bool {
+	return !s.choked || s.allowedFast[index]
+}
+
+// handleMessage updates the state from a message that is not part of a
+// piece transfer. Unknown messages are ignored.
+func (s *PeerState) handleMessage(payload []byte) error {
+	id := payload[0]
+	if id >= suggestPiece && id <= allowedFast && !s.fast {
+		return fmt.Errorf("peer sent fast extension message %d without supporting it", id)
+	}
+
+	switch id {
+	case choke:
+		s.choked = true
+	case unchoke:
+		s.choked = false
+	case bitfield:
+		if len(payload)-1 != len(s.bitfield) {
+			return fmt.Errorf("bitfield has %d bytes, expected %d", len(payload)-1, len(s.bitfield))
+		}
+		copy(s.bitfield, payload[1:])
+	case haveAll:
+		for i := range s.pieces {
+			s.bitfield.setPiece(i)
+		}
+	case haveNone:
+		clear(s.bitfield)
+	case have, suggestPiece, allowedFast:
+		index, err := parsePieceIndex(payload, s.pieces)
+		if err != nil {
+			return err
+		}
+		switch id {
+		case have:
+			s.bitfield.setPiece(index)
+		case suggestPiece:
+			s.suggested = append(s.suggested, index)
+		case allowedFast:
+			s.allowedFast[index] = true
+		}
+	}
+	return nil
+}
+
+// addHints adds the pieces the peer suggested or allows while choking to
+// hints, the pieces worth asking the peer for next.
+func (s *PeerState) addHints(hints map[int]bool) {
+	if hints == nil {
+		return
+	}
+
+	for _, index := range s.suggested {
+		hints[index] = true
+	}
+	for index := range s.allowedFast {
+		hints[index] = true
+	}
+}
+
+func (bf Bitfield) setPiece(index int) {
+	bf[index/8] |= 1 << (7 - index%8)
+}
+
+func parsePieceIndex(payload []byte, pieces int) (int, error) {
+	if len(payload) != 5 {
+		return 0, fmt.Errorf("message %d has length %d, expected 5", payload[0], len(payload))
+	}
+
+	index := int(binary.BigEndian.Uint32(payload[1:5]))
+	if index >= pieces {
+		return 0, fmt.Errorf("piece index %d out of range, torrent has %d pieces", index, pieces)
+	}
+	return index, nil
+}
+
+// generateAllowedFastSet returns the pieces a choked peer at the address may
+// download with the algorithm of BEP 6, so both sides agree on the set
+// without telling each other. It is only defined for IPv4.
+func generateAllowedFastSet(k int, pieces int, infoHash []byte, address netip.Addr) []int {
+	address = address.Unmap()
+	if !address.Is4() {
+		return nil
+	}
+
+	// the set is the same for every address in the /24
+	ip := address.As4()
+	x := append([]byte{ip[0], ip[1], ip[2], 0}, infoHash...)
+
+	k = min(k, pieces)
+	set := make([]int, 0, k)
+	seen := make(map[int]bool)
+	for len(set) < k {
+		hash := sha1.Sum(x)
+		x = hash[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:i*4+4]) % uint32(pieces))
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
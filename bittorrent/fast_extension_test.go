@@ -0,0 +1,186 @@
+package bittorrent
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestGenerateAllowedFastSet(t *testing.T) {
+	infoHash := make([]byte, 20)
+	for i := range infoHash {
+		infoHash[i] = 0xAA
+	}
+	address := netip.MustParseAddr("80.4.4.200")
+
+	// the examples of BEP 6
+	tests := []struct {
+		k        int
+		expected []int
+	}{
+		{k: 7, expected: []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		{k: 9, expected: []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}},
+	}
+
+	for _, tt := range tests {
+		result := generateAllowedFastSet(tt.k, 1313, infoHash, address)
+		if !reflect.DeepEqual(result, tt.expected) {
+			t.Errorf("generateAllowedFastSet(%d) = %v, expected %v", tt.k, result, tt.expected)
+		}
+	}
+
+	if result := generateAllowedFastSet(10, 3, infoHash, address); len(result) != 3 {
+		t.Errorf("generateAllowedFastSet() for 3 pieces = %v, expected all of them", result)
+	}
+	if result := generateAllowedFastSet(7, 1313, infoHash, netip.MustParseAddr("::1")); result != nil {
+		t.Errorf("generateAllowedFastSet() for IPv6 = %v, expected nil", result)
+	}
+}
+
+func TestPeerStateHandleMessage(t *testing.T) {
+	fastHandshake := Handshake{}
+	fastHandshake.reserved[7] = fastExtensionBit
+
+	state := newPeerState(fastHandshake, 10)
+	messages := [][]byte{
+		{haveAll},
+		{haveNone},
+		{have, 0, 0, 0, 3},
+		{allowedFast, 0, 0, 0, 5},
+		{suggestPiece, 0, 0, 0, 3},
+	}
+	for _, message := range messages {
+		if err := state.handleMessage(message); err != nil {
+			t.Fatalf("handleMessage(%v) unexpected error %v", message, err)
+		}
+	}
+
+	if !state.hasPiece(3) || state.hasPiece(0) || state.hasPiece(9) {
+		t.Errorf("hasPiece() does not match have none followed by have 3: %08b", state.bitfield)
+	}
+	if !state.canRequest(5) || state.canRequest(3) {
+		t.Errorf("canRequest() only expected for the allowed fast piece while choked")
+	}
+	if !reflect.DeepEqual(state.suggested, []int{3}) {
+		t.Errorf("suggested = %v, expected [3]", state.suggested)
+	}
+	hints := map[int]bool{7: true}
+	state.addHints(hints)
+	if !reflect.DeepEqual(hints, map[int]bool{3: true, 5: true, 7: true}) {
+		t.Errorf("addHints() = %v, expected the suggested and allowed fast pieces added", hints)
+	}
+
+	if err := state.handleMessage([]byte{have, 0, 0, 0, 10}); err == nil {
+		t.Errorf("handleMessage() expected error for piece index out of range")
+	}
+	if err := state.handleMessage([]byte{bitfield, 0xFF}); err == nil {
+		t.Errorf("handleMessage() expected error for short bitfield")
+	}
+	if err := newPeerState(Handshake{}, 10).handleMessage([]byte{haveAll}); err == nil {
+		t.Errorf("handleMessage() expected error for fast message from a peer without the extension")
+	}
+}
+
+// runFastSeeder serves the data as a peer that only serves its allowed fast
+// piece and rejects all other requests, whether it unchokes or not.
+func runFastSeeder(t *testing.T, torrentMeta TorrentMeta, data []byte, allowed int, unchoked bool) netip.AddrPort {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFastPeer(conn, torrentMeta, data, allowed, unchoked)
+		}
+	}()
+
+	return netip.MustParseAddrPort(listener.Addr().String())
+}
+
+func serveFastPeer(conn net.Conn, torrentMeta TorrentMeta, data []byte, allowed int, unchoked bool) {
+	defer conn.Close()
+
+	handshake := make([]byte, handshakeLength)
+	if _, err := io.ReadFull(conn, handshake); err != nil {
+		return
+	}
+	copy(handshake[48:], "-qB4520-abcdefghijkl")
+	conn.Write(handshake)
+
+	conn.Write([]byte{0, 0, 0, 1, haveAll})
+	conn.Write([]byte{0, 0, 0, 5, allowedFast, 0, 0, 0, byte(allowed)})
+	if unchoked {
+		conn.Write([]byte{0, 0, 0, 1, unchoke})
+	}
+
+	var requests [][]byte
+	for {
+		payload, err := readMessage(conn, maxMessageLength(len(torrentMeta.Pieces)))
+		if err != nil {
+			return
+		}
+		if payload[0] != request {
+			continue
+		}
+
+		index := int(binary.BigEndian.Uint32(payload[1:5]))
+		if index != allowed {
+			conn.Write(append([]byte{0, 0, 0, 13, rejectRequest}, payload[1:]...))
+			continue
+		}
+
+		// blocks are answered in reverse order once the whole piece is requested
+		requests = append(requests, payload)
+		if len(requests) < (getPieceLength(index, torrentMeta)+defaultBlockSize-1)/defaultBlockSize {
+			continue
+		}
+		for i := len(requests) - 1; i >= 0; i-- {
+			begin := int(binary.BigEndian.Uint32(requests[i][5:9]))
+			length := int(binary.BigEndian.Uint32(requests[i][9:13]))
+			start := index*torrentMeta.PieceLength + begin
+
+			message := binary.BigEndian.AppendUint32(nil, uint32(9+length))
+			message = append(message, piece)
+			message = append(message, requests[i][1:9]...)
+			conn.Write(append(message, data[start:start+length]...))
+		}
+		requests = nil
+	}
+}
+
+func TestDownloadTorrentPieceAllowedFast(t *testing.T) {
+	data := make([]byte, 3*defaultBlockSize)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	torrentMeta := webSeedTorrent(data, 2*defaultBlockSize, nil)
+	torrentMeta.InfoHashBytes = []byte("12345678901234567890")
+
+	// the seeder never unchokes, the allowed fast piece can be downloaded anyway
+	peer := runFastSeeder(t, torrentMeta, data, 0, false)
+
+	result, err := downloadTorrentPiece(newTestNetwork(), torrentMeta, peer, 0, nil)
+	if err != nil {
+		t.Fatalf("downloadTorrentPiece() unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(result, data[:2*defaultBlockSize]) {
+		t.Errorf("downloadTorrentPiece() returned wrong data")
+	}
+
+	peer = runFastSeeder(t, torrentMeta, data, 0, true)
+
+	_, err = downloadTorrentPiece(newTestNetwork(), torrentMeta, peer, 1, nil)
+	if !errors.Is(err, errRequestRejected) {
+		t.Errorf("downloadTorrentPiece() error = %v, expected rejected request", err)
+	}
+}
@@ -0,0 +1,143 @@
+package bittorrent
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	PRIORITY_SKIP   = 0
+	PRIORITY_NORMAL = 1
+	PRIORITY_HIGH   = 2
+)
+
+var priorityNames = map[string]int{
+	"skip":   PRIORITY_SKIP,
+	"normal": PRIORITY_NORMAL,
+	"high":   PRIORITY_HIGH,
+}
+
+// parseFileSelection returns the priority of every file of the torrent.
+// The selection is a comma separated list of file indexes or glob patterns
+// matched against the file path, each optionally followed by =skip, =normal
+// or =high. Once a file is selected all files that aren't listed are
+// skipped, a selection that only skips files keeps the rest at normal.
+func parseFileSelection(selection string, files []File) ([]int, error) {
+	priorities := make([]int, len(files))
+	for i, file := range files {
+		priorities[i] = PRIORITY_NORMAL
+		// padding files never decide which pieces are downloaded
+		if file.padding {
+			priorities[i] = PRIORITY_SKIP
+		}
+	}
+
+	if strings.TrimSpace(selection) == "" {
+		return priorities, nil
+	}
+
+	selected := make(map[int]int)
+	selectsFiles := false
+
+	for _, entry := range strings.Split(selection, ",") {
+		target, priorityName, hasPriority := strings.Cut(strings.TrimSpace(entry), "=")
+
+		priority := PRIORITY_NORMAL
+		if hasPriority {
+			var ok bool
+			priority, ok = priorityNames[priorityName]
+			if !ok {
+				return nil, fmt.Errorf("unknown priority %q", priorityName)
+			}
+		}
+		if priority != PRIORITY_SKIP {
+			selectsFiles = true
+		}
+
+		matches, err := matchFiles(target, files)
+		if err != nil {
+			return nil, err
+		}
+		for _, index := range matches {
+			selected[index] = priority
+		}
+	}
+
+	for i := range priorities {
+		priority, ok := selected[i]
+		if files[i].padding {
+			continue
+		} else if ok {
+			priorities[i] = priority
+		} else if selectsFiles {
+			priorities[i] = PRIORITY_SKIP
+		}
+	}
+
+	return priorities, nil
+}
+
+func matchFiles(target string, files []File) ([]int, error) {
+	if index, err := strconv.Atoi(target); err == nil {
+		if index < 0 || index >= len(files) {
+			return nil, fmt.Errorf("file index %d out of range, torrent has %d files", index, len(files))
+		}
+		return []int{index}, nil
+	}
+
+	var matches []int
+	for i, file := range files {
+		matched, err := path.Match(target, strings.Join(file.path, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid file pattern %q", target)
+		}
+		if matched {
+			matches = append(matches, i)
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no file matches %q", target)
+	}
+	return matches, nil
+}
+
+// getPiecePriorities returns the priority of every piece, which is the
+// highest priority of the files the piece has data for.
+func getPiecePriorities(torrentMeta TorrentMeta, filePriorities []int) []int {
+	piecePriorities := make([]int, len(torrentMeta.Pieces))
+
+	offset := 0
+	for i, file := range torrentMeta.getFiles() {
+		if file.length > 0 {
+			first := offset / torrentMeta.PieceLength
+			last := (offset + file.length - 1) / torrentMeta.PieceLength
+
+			for piece := first; piece <= last && piece < len(piecePriorities); piece++ {
+				piecePriorities[piece] = max(piecePriorities[piece], filePriorities[i])
+			}
+		}
+		offset += file.length
+	}
+
+	return piecePriorities
+}
+
+// getSelectedPieces returns the pieces needed for the selected files, high
+// priority pieces first.
+func getSelectedPieces(torrentMeta TorrentMeta, filePriorities []int) []Piece {
+	piecePriorities := getPiecePriorities(torrentMeta, filePriorities)
+	pieces := []Piece{}
+
+	for _, priority := range []int{PRIORITY_HIGH, PRIORITY_NORMAL} {
+		for _, piece := range getTorrentPieces(torrentMeta) {
+			if piecePriorities[piece.number] == priority {
+				pieces = append(pieces, piece)
+			}
+		}
+	}
+
+	return pieces
+}
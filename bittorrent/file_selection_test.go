@@ -0,0 +1,119 @@
+package bittorrent
+
+import (
+	"reflect"
+	"testing"
+)
+
+func multiFileTorrent() TorrentMeta {
+	// piece 0: a.mkv, piece 1: a.mkv + b.srt, piece 2: b.srt + docs/c.nfo, piece 3: docs/c.nfo
+	return TorrentMeta{
+		Name:        "multi",
+		PieceLength: 10,
+		Pieces:      []string{"p0", "p1", "p2", "p3"},
+		Length:      38,
+		Keys: []File{
+			{length: 15, path: []string{"a.mkv"}},
+			{length: 10, path: []string{"b.srt"}},
+			{length: 0, path: []string{"empty"}},
+			{length: 13, path: []string{"docs", "c.nfo"}},
+		},
+	}
+}
+
+func TestParseFileSelection(t *testing.T) {
+	files := multiFileTorrent().Keys
+
+	tests := []struct {
+		name      string
+		selection string
+		expected  []int
+		wantErr   bool
+	}{
+		{
+			name:      "Everything",
+			selection: "",
+			expected:  []int{PRIORITY_NORMAL, PRIORITY_NORMAL, PRIORITY_NORMAL, PRIORITY_NORMAL},
+		},
+		{
+			name:      "Indexes",
+			selection: "0,3",
+			expected:  []int{PRIORITY_NORMAL, PRIORITY_SKIP, PRIORITY_SKIP, PRIORITY_NORMAL},
+		},
+		{
+			name:      "Glob with priority",
+			selection: "*.mkv=high,docs/*",
+			expected:  []int{PRIORITY_HIGH, PRIORITY_SKIP, PRIORITY_SKIP, PRIORITY_NORMAL},
+		},
+		{
+			name:      "Only skips",
+			selection: "*.srt=skip",
+			expected:  []int{PRIORITY_NORMAL, PRIORITY_SKIP, PRIORITY_NORMAL, PRIORITY_NORMAL},
+		},
+		{
+			name:      "Index out of range",
+			selection: "4",
+			wantErr:   true,
+		},
+		{
+			name:      "Unknown priority",
+			selection: "0=urgent",
+			wantErr:   true,
+		},
+		{
+			name:      "No match",
+			selection: "*.iso",
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseFileSelection(tt.selection, files)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseFileSelection(%q) error = %v, wantErr %v", tt.selection, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("parseFileSelection(%q) = %v, expected %v", tt.selection, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestGetSelectedPieces(t *testing.T) {
+	torrentMeta := multiFileTorrent()
+
+	tests := []struct {
+		name       string
+		priorities []int
+		expected   []int
+	}{
+		{
+			name:       "All files",
+			priorities: []int{PRIORITY_NORMAL, PRIORITY_NORMAL, PRIORITY_NORMAL, PRIORITY_NORMAL},
+			expected:   []int{0, 1, 2, 3},
+		},
+		{
+			name:       "Boundary pieces of a skipped file",
+			priorities: []int{PRIORITY_SKIP, PRIORITY_NORMAL, PRIORITY_SKIP, PRIORITY_SKIP},
+			expected:   []int{1, 2},
+		},
+		{
+			name:       "High priority first",
+			priorities: []int{PRIORITY_NORMAL, PRIORITY_SKIP, PRIORITY_SKIP, PRIORITY_HIGH},
+			expected:   []int{2, 3, 0, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var result []int
+			for _, piece := range getSelectedPieces(torrentMeta, tt.priorities) {
+				result = append(result, piece.number)
+			}
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("getSelectedPieces() = %v, expected %v", result, tt.expected)
+			}
+		})
+	}
+}
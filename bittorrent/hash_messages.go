@@ -0,0 +1,114 @@
+package bittorrent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// BitTorrent v2 (BEP 52) messages to exchange merkle tree hashes
+const (
+	hashRequest = 21
+	hashes      = 22
+	hashReject  = 23
+)
+
+// maxHashRequestLength is the most hashes served for one request.
+const maxHashRequestLength = 512
+
+// HashRequest asks for length hashes of a layer of a file's merkle tree,
+// starting at index, plus the uncle hashes to verify them up to the root.
+type HashRequest struct {
+	piecesRoot  []byte
+	baseLayer   int
+	index       int
+	length      int
+	proofLayers int
+}
+
+func createHashMessage(id uint8, request HashRequest, hashList []byte) []byte {
+	message := binary.BigEndian.AppendUint32(nil, uint32(49+len(hashList)))
+	message = append(message, id)
+	message = append(message, request.piecesRoot...)
+	message = binary.BigEndian.AppendUint32(message, uint32(request.baseLayer))
+	message = binary.BigEndian.AppendUint32(message, uint32(request.index))
+	message = binary.BigEndian.AppendUint32(message, uint32(request.length))
+	message = binary.BigEndian.AppendUint32(message, uint32(request.proofLayers))
+	return append(message, hashList...)
+}
+
+// parseHashMessage reads a hash request, hashes or hash reject message, the
+// hashes are only part of a hashes message.
+func parseHashMessage(payload []byte) (HashRequest, [][]byte, error) {
+	if len(payload) < 49 || (len(payload)-49)%sha256.Size != 0 {
+		return HashRequest{}, nil, fmt.Errorf("hash message has invalid length %d", len(payload))
+	}
+
+	request := HashRequest{
+		piecesRoot:  payload[1:33],
+		baseLayer:   int(binary.BigEndian.Uint32(payload[33:37])),
+		index:       int(binary.BigEndian.Uint32(payload[37:41])),
+		length:      int(binary.BigEndian.Uint32(payload[41:45])),
+		proofLayers: int(binary.BigEndian.Uint32(payload[45:49])),
+	}
+	return request, splitHashes(payload[49:]), nil
+}
+
+// getHashes returns the hashes a peer asked for followed by the uncle hashes
+// that prove them, or false if the request can't be served. Only the piece
+// layers of the torrent file are served, lower layers would need the data
+// of the pieces.
+func (t TorrentMeta) getHashes(request HashRequest) ([][]byte, bool) {
+	layer, ok := t.PieceLayers[string(request.piecesRoot)]
+	leaves := t.PieceLength / merkleBlockSize
+	if !ok || 1<<request.baseLayer != leaves {
+		return nil, false
+	}
+
+	width := nextPowerOfTwo(len(layer))
+	if request.length < 2 || request.length > maxHashRequestLength || request.length&(request.length-1) != 0 || request.index%request.length != 0 || request.index+request.length > width {
+		return nil, false
+	}
+
+	padding := merkleRoot(nil, leaves, make([]byte, sha256.Size))
+	nodes := make([][]byte, width)
+	for i := range nodes {
+		if i < len(layer) {
+			nodes[i] = layer[i]
+		} else {
+			nodes[i] = padding
+		}
+	}
+	hashList := append([][]byte{}, nodes[request.index:request.index+request.length]...)
+
+	// the uncles start at the root of the requested hashes
+	for len(nodes) > width/request.length {
+		nodes = parentLayer(nodes)
+	}
+	position := request.index / request.length
+	for range request.proofLayers {
+		if len(nodes) == 1 {
+			break
+		}
+		hashList = append(hashList, nodes[position^1])
+		nodes = parentLayer(nodes)
+		position /= 2
+	}
+	return hashList, true
+}
+
+// createHashResponse answers a hash request with the hashes or a reject if
+// they can't be served.
+func createHashResponse(torrentMeta TorrentMeta, payload []byte) ([]byte, error) {
+	request, _, err := parseHashMessage(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	hashList, ok := torrentMeta.getHashes(request)
+	if !ok {
+		return createHashMessage(hashReject, request, nil), nil
+	}
+	return createHashMessage(hashes, request, bytes.Join(hashList, nil)), nil
+}
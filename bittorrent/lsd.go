@@ -0,0 +1,274 @@
+package bittorrent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Local Service Discovery (BEP 14) announces torrents to a multicast group,
+// so peers on the same LAN find each other without going through a tracker.
+const (
+	lsdGroup    = "239.192.152.143:6771"
+	lsdInterval = 5 * time.Minute
+	// lsdMaxInfoHashes keeps an announce below 1400 bytes
+	lsdMaxInfoHashes = 20
+	// lsdMaxPeers caps the peers remembered for torrents that are watched
+	// later, anyone on the LAN can announce as many as they like
+	lsdMaxPeers = 1000
+)
+
+type LsdAnnounce struct {
+	port       int
+	infoHashes []string
+	cookie     string
+}
+
+// LocalDiscovery sends announces for the torrents that are watched and
+// collects the LAN peers announcing the same torrents.
+type LocalDiscovery struct {
+	conn     net.PacketConn
+	group    net.Addr
+	port     int
+	cookie   string
+	mu       sync.Mutex
+	peers    map[string]map[netip.AddrPort]bool
+	count    int
+	watchers map[string][]chan netip.AddrPort
+	closing  chan struct{}
+	once     sync.Once
+}
+
+// listenLocalDiscovery joins the multicast group on all interfaces and
+// announces port as the one LAN peers connect to.
+func listenLocalDiscovery(port int) (*LocalDiscovery, error) {
+	group, err := net.ResolveUDPAddr("udp4", lsdGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return nil, err
+	}
+	discovery, err := newLocalDiscovery(conn, group, port)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return discovery, nil
+}
+
+// newLocalDiscovery announces to the group over the connection and reads
+// the announces of other peers from it.
+func newLocalDiscovery(conn net.PacketConn, group net.Addr, port int) (*LocalDiscovery, error) {
+	// the cookie tells our own announces apart when the group loops them back
+	cookie := make([]byte, 4)
+	if _, err := rand.Read(cookie); err != nil {
+		return nil, fmt.Errorf("failed to generate cookie: %w", err)
+	}
+
+	d := &LocalDiscovery{
+		conn:     conn,
+		group:    group,
+		port:     port,
+		cookie:   hex.EncodeToString(cookie),
+		peers:    make(map[string]map[netip.AddrPort]bool),
+		watchers: make(map[string][]chan netip.AddrPort),
+		closing:  make(chan struct{}),
+	}
+	go d.receive()
+	go d.announceLoop()
+	return d, nil
+}
+
+func createLsdAnnounce(host string, port int, infoHashes []string, cookie string) []byte {
+	var b bytes.Buffer
+	b.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&b, "Host: %s\r\n", host)
+	fmt.Fprintf(&b, "Port: %d\r\n", port)
+	for _, infoHash := range infoHashes {
+		fmt.Fprintf(&b, "Infohash: %s\r\n", infoHash)
+	}
+	if cookie != "" {
+		fmt.Fprintf(&b, "cookie: %s\r\n", cookie)
+	}
+	b.WriteString("\r\n\r\n")
+	return b.Bytes()
+}
+
+func parseLsdAnnounce(data []byte) (LsdAnnounce, error) {
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+
+	line, err := reader.ReadLine()
+	if err != nil {
+		return LsdAnnounce{}, err
+	}
+	if line != "BT-SEARCH * HTTP/1.1" {
+		return LsdAnnounce{}, fmt.Errorf("unexpected request line %q", line)
+	}
+
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return LsdAnnounce{}, err
+	}
+
+	port, err := strconv.Atoi(header.Get("Port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return LsdAnnounce{}, fmt.Errorf("invalid port %q", header.Get("Port"))
+	}
+
+	announce := LsdAnnounce{port: port, cookie: header.Get("Cookie")}
+	for _, infoHash := range header.Values("Infohash") {
+		if decoded, err := hex.DecodeString(infoHash); err != nil || len(decoded) != 20 {
+			return LsdAnnounce{}, fmt.Errorf("invalid info hash %q", infoHash)
+		}
+		announce.infoHashes = append(announce.infoHashes, strings.ToLower(infoHash))
+	}
+	if len(announce.infoHashes) == 0 {
+		return LsdAnnounce{}, errors.New("announce has no info hash")
+	}
+	return announce, nil
+}
+
+// watch announces the torrent and returns the LAN peers that announce it,
+// starting with the ones that are already known. The returned function
+// stops watching.
+func (d *LocalDiscovery) watch(infoHash string) (<-chan netip.AddrPort, func()) {
+	infoHash = strings.ToLower(infoHash)
+	peers := make(chan netip.AddrPort, 64)
+
+	d.mu.Lock()
+	for peer := range d.peers[infoHash] {
+		select {
+		case peers <- peer:
+		default:
+		}
+	}
+	d.watchers[infoHash] = append(d.watchers[infoHash], peers)
+	d.mu.Unlock()
+
+	d.announce([]string{infoHash})
+
+	cancel := func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		watchers := d.watchers[infoHash]
+		for i, watcher := range watchers {
+			if watcher == peers {
+				d.watchers[infoHash] = append(watchers[:i:i], watchers[i+1:]...)
+				close(peers)
+				break
+			}
+		}
+		if len(d.watchers[infoHash]) == 0 {
+			delete(d.watchers, infoHash)
+		}
+	}
+	return peers, cancel
+}
+
+func (d *LocalDiscovery) announce(infoHashes []string) {
+	for start := 0; start < len(infoHashes); start += lsdMaxInfoHashes {
+		chunk := infoHashes[start:min(start+lsdMaxInfoHashes, len(infoHashes))]
+		message := createLsdAnnounce(d.group.String(), d.port, chunk, d.cookie)
+		if _, err := d.conn.WriteTo(message, d.group); err != nil {
+			log.Debug().Msg(fmt.Sprintf("[LSD] failed to announce: %s", err))
+		}
+	}
+}
+
+// announceLoop repeats the announces of the watched torrents, BEP 14 asks
+// for at most one announce per torrent and minute.
+func (d *LocalDiscovery) announceLoop() {
+	ticker := time.NewTicker(lsdInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.closing:
+			return
+		}
+
+		d.mu.Lock()
+		infoHashes := make([]string, 0, len(d.watchers))
+		for infoHash := range d.watchers {
+			infoHashes = append(infoHashes, infoHash)
+		}
+		d.mu.Unlock()
+
+		d.announce(infoHashes)
+	}
+}
+
+func (d *LocalDiscovery) receive() {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		announce, err := parseLsdAnnounce(buf[:n])
+		if err != nil {
+			log.Debug().Msg(fmt.Sprintf("[LSD] ignoring announce from %s: %s", from, err))
+			continue
+		}
+		if announce.cookie == d.cookie {
+			continue
+		}
+
+		udpAddr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		peer := netip.AddrPortFrom(udpAddr.AddrPort().Addr().Unmap(), uint16(announce.port))
+		for _, infoHash := range announce.infoHashes {
+			d.addPeer(infoHash, peer)
+		}
+	}
+}
+
+func (d *LocalDiscovery) addPeer(infoHash string, peer netip.AddrPort) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.peers[infoHash][peer] {
+		return
+	}
+	// watchers still get the peers that aren't remembered
+	if d.count < lsdMaxPeers {
+		if d.peers[infoHash] == nil {
+			d.peers[infoHash] = make(map[netip.AddrPort]bool)
+		}
+		d.peers[infoHash][peer] = true
+		d.count++
+	}
+	log.Debug().Msg(fmt.Sprintf("[LSD] found peer %s for %s", peer, infoHash))
+
+	for _, watcher := range d.watchers[infoHash] {
+		select {
+		case watcher <- peer:
+		default:
+		}
+	}
+}
+
+func (d *LocalDiscovery) Close() error {
+	d.once.Do(func() { close(d.closing) })
+	return d.conn.Close()
+}
@@ -0,0 +1,195 @@
+package bittorrent
+
+import (
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	lsdTestHash      = "0123456789abcdef0123456789abcdef01234567"
+	lsdOtherTestHash = "89abcdef0123456789abcdef0123456789abcdef"
+)
+
+func TestParseLsdAnnounce(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  string
+		expected LsdAnnounce
+		err      bool
+	}{
+		{
+			name:     "Created announce",
+			message:  string(createLsdAnnounce(lsdGroup, 6881, []string{lsdTestHash, lsdOtherTestHash}, "abcd")),
+			expected: LsdAnnounce{port: 6881, infoHashes: []string{lsdTestHash, lsdOtherTestHash}, cookie: "abcd"},
+		},
+		{
+			name:     "Uppercase info hash without cookie",
+			message:  "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 51413\r\nInfohash: " + strings.ToUpper(lsdTestHash) + "\r\n\r\n\r\n",
+			expected: LsdAnnounce{port: 51413, infoHashes: []string{lsdTestHash}},
+		},
+		{
+			name:    "Wrong request line",
+			message: "M-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: " + lsdTestHash + "\r\n\r\n",
+			err:     true,
+		},
+		{
+			name:    "Missing port",
+			message: "BT-SEARCH * HTTP/1.1\r\nInfohash: " + lsdTestHash + "\r\n\r\n",
+			err:     true,
+		},
+		{
+			name:    "Short info hash",
+			message: "BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: 0123\r\n\r\n",
+			err:     true,
+		},
+		{
+			name:    "No info hash",
+			message: "BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\n\r\n",
+			err:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			announce, err := parseLsdAnnounce([]byte(tt.message))
+			if tt.err {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", announce)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(announce, tt.expected) {
+				t.Errorf("parseLsdAnnounce() = %+v, expected %+v", announce, tt.expected)
+			}
+		})
+	}
+}
+
+// TestLocalDiscovery lets two instances announce to each other over
+// loopback in place of the multicast group.
+func TestLocalDiscovery(t *testing.T) {
+	connA, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connB, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := newLocalDiscovery(connA, connB.LocalAddr(), DefaultListenPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := newLocalDiscovery(connB, connA.LocalAddr(), DefaultListenPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// a announces before b watches, b still gets the peer it already knows
+	peersA, cancelA := a.watch(strings.ToUpper(lsdTestHash))
+	defer cancelA()
+	waitForLsdPeer(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(b.peers[lsdTestHash]) > 0
+	})
+
+	peersB, cancelB := b.watch(lsdTestHash)
+	defer cancelB()
+
+	expected := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(DefaultListenPort))
+	for name, peers := range map[string]<-chan netip.AddrPort{"a": peersA, "b": peersB} {
+		select {
+		case peer := <-peers:
+			if peer != expected {
+				t.Errorf("%s found peer %s, expected %s", name, peer, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s found no peer", name)
+		}
+	}
+
+	// watchers of other torrents do not see the peer
+	peersOther, cancelOther := a.watch(lsdOtherTestHash)
+	defer cancelOther()
+	select {
+	case peer := <-peersOther:
+		t.Errorf("found peer %s for a torrent nobody announced", peer)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestLocalDiscoveryIgnoresOwnAnnounces(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := newLocalDiscovery(conn, conn.LocalAddr(), DefaultListenPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	peers, cancel := d.watch(lsdTestHash)
+	defer cancel()
+	select {
+	case peer := <-peers:
+		t.Errorf("found own announce as peer %s", peer)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func waitForLsdPeer(t *testing.T, found func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !found() {
+		if time.Now().After(deadline) {
+			t.Fatal("announce was not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLocalDiscoveryPeerLimit(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := newLocalDiscovery(conn, conn.LocalAddr(), DefaultListenPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for port := range lsdMaxPeers + 10 {
+		d.addPeer(lsdOtherTestHash, netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), uint16(port+1)))
+	}
+	if d.count != lsdMaxPeers || len(d.peers[lsdOtherTestHash]) != lsdMaxPeers {
+		t.Errorf("remembered %d peers, expected at most %d", d.count, lsdMaxPeers)
+	}
+
+	// watched torrents still get the peers that aren't remembered
+	peers, cancel := d.watch(lsdTestHash)
+	defer cancel()
+	expected := netip.MustParseAddrPort("10.0.0.2:6881")
+	d.addPeer(lsdTestHash, expected)
+	select {
+	case peer := <-peers:
+		if peer != expected {
+			t.Errorf("found peer %s, expected %s", peer, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("found no peer")
+	}
+}
@@ -0,0 +1,119 @@
+package bittorrent
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// Magnet is a parsed magnet link. Torrents added from one get their info
+// dictionary from peers before they download (BEP 9).
+type Magnet struct {
+	InfoHash string
+	Name     string
+	Trackers []string
+}
+
+// ParseMagnet reads the info hash, display name and trackers of a magnet
+// link. Only BitTorrent v1 info hashes (btih) are supported.
+func ParseMagnet(uri string) (Magnet, error) {
+	magnet := Magnet{}
+
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Scheme != "magnet" {
+		return magnet, errors.New("invalid magnet link")
+	}
+
+	query := parsed.Query()
+	for _, topic := range query["xt"] {
+		hash, ok := strings.CutPrefix(topic, "urn:btih:")
+		if !ok {
+			continue
+		}
+
+		// info hashes are either hex or base32 encoded
+		switch len(hash) {
+		case 40:
+			decoded, err := hex.DecodeString(hash)
+			if err != nil {
+				return magnet, errors.New("invalid magnet info hash")
+			}
+			magnet.InfoHash = hex.EncodeToString(decoded)
+		case 32:
+			decoded, err := base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+			if err != nil {
+				return magnet, errors.New("invalid magnet info hash")
+			}
+			magnet.InfoHash = hex.EncodeToString(decoded)
+		default:
+			return magnet, errors.New("invalid magnet info hash")
+		}
+	}
+
+	if magnet.InfoHash == "" {
+		return magnet, errors.New("magnet link has no btih info hash")
+	}
+
+	magnet.Name = query.Get("dn")
+	magnet.Trackers = query["tr"]
+
+	return magnet, nil
+}
+
+// torrentMeta returns what is known about the torrent before its metadata
+// is fetched, enough to find peers through the trackers.
+func (m Magnet) torrentMeta() TorrentMeta {
+	infoHash, _ := hex.DecodeString(m.InfoHash)
+	meta := TorrentMeta{
+		InfoHash:      m.InfoHash,
+		InfoHashBytes: infoHash,
+		Name:          m.Name,
+		// the size isn't known yet, but trackers take peers with nothing
+		// left to download for seeders and may not send them any
+		Length: 1,
+	}
+	if meta.Name == "" {
+		meta.Name = m.InfoHash
+	}
+	if len(m.Trackers) > 0 {
+		meta.Announce = m.Trackers[0]
+		meta.AnnounceList = [][]string{m.Trackers}
+	}
+	return meta
+}
+
+// parseMetadata returns the metainfo of the torrent with the info
+// dictionary fetched from peers and the magnet's trackers.
+func (m Magnet) parseMetadata(info []byte) (TorrentMeta, error) {
+	var torrent bytes.Buffer
+	torrent.WriteString("d")
+	if len(m.Trackers) > 0 {
+		trackers := make([]interface{}, len(m.Trackers))
+		for i, tracker := range m.Trackers {
+			trackers[i] = tracker
+		}
+		announce, _ := encodeBencode(m.Trackers[0])
+		announceList, _ := encodeBencode([]interface{}{trackers})
+		torrent.WriteString("8:announce")
+		torrent.Write(announce)
+		torrent.WriteString("13:announce-list")
+		torrent.Write(announceList)
+	}
+	// the info dictionary is copied as it is, so its hash stays the same
+	torrent.WriteString("4:info")
+	torrent.Write(info)
+	torrent.WriteString("e")
+
+	torrentMeta, err := ParseTorrent(torrent.Bytes())
+	if err != nil {
+		return TorrentMeta{}, err
+	}
+	// dictionaries that aren't encoded canonically hash differently once parsed
+	if torrentMeta.InfoHash != m.InfoHash {
+		return TorrentMeta{}, &MetainfoError{Path: "info", Reason: "isn't encoded canonically"}
+	}
+	return torrentMeta, nil
+}
@@ -0,0 +1,87 @@
+package bittorrent
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	tests := []struct {
+		name     string
+		uri      string
+		infoHash string
+		trackers []string
+		wantErr  bool
+	}{
+		{
+			name:     "Hex info hash",
+			uri:      "magnet:?xt=urn:btih:C77829D2A77D6516F88CD7A3DE1A26ABCBFAB0DB&dn=sample&tr=http%3A%2F%2Ftracker",
+			infoHash: "c77829d2a77d6516f88cd7a3de1a26abcbfab0db",
+			trackers: []string{"http://tracker"},
+		},
+		{
+			name:     "Base32 info hash",
+			uri:      "magnet:?xt=urn:btih:Y54CTUVHPVSRN6EM26R54GRGVPF7VMG3",
+			infoHash: "c77829d2a77d6516f88cd7a3de1a26abcbfab0db",
+		},
+		{
+			name:    "Missing info hash",
+			uri:     "magnet:?dn=sample",
+			wantErr: true,
+		},
+		{
+			name:    "Not a magnet",
+			uri:     "http://example.com",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			magnet, err := ParseMagnet(tt.uri)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseMagnet() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if magnet.InfoHash != tt.infoHash || !reflect.DeepEqual(magnet.Trackers, tt.trackers) {
+				t.Errorf("ParseMagnet() = %+v, expected info hash %s and trackers %v", magnet, tt.infoHash, tt.trackers)
+			}
+		})
+	}
+}
+
+func TestMagnetParseMetadata(t *testing.T) {
+	swarm := newTestSwarm(t, make([]byte, 3*defaultBlockSize), defaultBlockSize)
+	magnet := Magnet{InfoHash: swarm.meta.InfoHash, Trackers: []string{"http://first/announce", "http://second/announce"}}
+
+	tests := []struct {
+		name    string
+		info    string
+		wantErr string
+	}{
+		{name: "Fetched info dictionary", info: string(swarm.meta.Info)},
+		{name: "Not bencode", info: "garbage", wantErr: "invalid metainfo"},
+		{name: "Keys out of order", info: "d4:name1:a6:lengthi1e12:piece lengthi1e6:pieces20:" + strings.Repeat("x", 20) + "e", wantErr: "info isn't encoded canonically"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			torrentMeta, err := magnet.parseMetadata([]byte(tt.info))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseMetadata() error = %v, expected %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseMetadata() unexpected error %v", err)
+			}
+			if torrentMeta.InfoHash != swarm.meta.InfoHash || torrentMeta.Name != "swarm.bin" || len(torrentMeta.Pieces) != 3 {
+				t.Errorf("parseMetadata() = %+v, expected the swarm's torrent", torrentMeta)
+			}
+			if torrentMeta.Announce != magnet.Trackers[0] || !reflect.DeepEqual(torrentMeta.AnnounceList, [][]string{magnet.Trackers}) {
+				t.Errorf("parseMetadata() trackers %s %v, expected the magnet's", torrentMeta.Announce, torrentMeta.AnnounceList)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package bittorrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Extension protocol (BEP 10) messages
+const (
+	extended          = 20
+	extendedHandshake = 0
+)
+
+// extensionProtocolBit is set in the sixth reserved byte of the handshake
+// by peers that support the extension protocol.
+const extensionProtocolBit = 0x10
+
+// utMetadataId is the extended message id we receive metadata exchange
+// (BEP 9) messages with, peers tell theirs in the extended handshake.
+const utMetadataId = 1
+
+// Metadata exchange message types
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// metadataPieceSize is the size of every piece of the info dictionary but
+// the last.
+const metadataPieceSize = 16 * 1024
+
+// maxMetadataSize limits the info dictionaries accepted from peers, who
+// announce the size before sending anything.
+const maxMetadataSize = 8 * 1024 * 1024
+
+func createExtendedMessage(id byte, dict map[string]interface{}, data []byte) []byte {
+	encoded, _ := encodeBencode(dict)
+	message := binary.BigEndian.AppendUint32(nil, uint32(2+len(encoded)+len(data)))
+	message = append(message, extended, id)
+	message = append(message, encoded...)
+	return append(message, data...)
+}
+
+// createExtendedHandshake tells the peer that we support metadata exchange
+// and, if we have it, the size of the info dictionary.
+func createExtendedHandshake(metadataSize int) []byte {
+	handshake := map[string]interface{}{
+		"m": map[string]interface{}{"ut_metadata": utMetadataId},
+	}
+	if metadataSize > 0 {
+		handshake["metadata_size"] = metadataSize
+	}
+	return createExtendedMessage(extendedHandshake, handshake, nil)
+}
+
+// createMetadataResponse returns the requested piece of the info
+// dictionary, or a reject for pieces past its end.
+func createMetadataResponse(info []byte, piece int, id byte) []byte {
+	start := piece * metadataPieceSize
+	if piece < 0 || start >= len(info) {
+		return createExtendedMessage(id, map[string]interface{}{"msg_type": metadataReject, "piece": piece}, nil)
+	}
+
+	response := map[string]interface{}{"msg_type": metadataData, "piece": piece, "total_size": len(info)}
+	return createExtendedMessage(id, response, info[start:min(start+metadataPieceSize, len(info))])
+}
+
+// parseExtendedMessage splits an extended message into its id, the
+// bencoded dictionary and the data that follows it.
+func parseExtendedMessage(payload []byte) (byte, map[string]interface{}, []byte, error) {
+	if len(payload) < 2 || payload[0] != extended {
+		return 0, nil, nil, errors.New("invalid extended message")
+	}
+
+	decoded, length, err := decodeBencodeWithDelimiter(string(payload[2:]))
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("invalid extended message: %w", err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return 0, nil, nil, errors.New("extended message is not a dictionary")
+	}
+	return payload[1], dict, payload[2+length:], nil
+}
+
+// getMetadataId returns the id the peer receives metadata messages with
+// from its extended handshake, 0 if it doesn't support them.
+func getMetadataId(handshake map[string]interface{}) int {
+	messages, _ := handshake["m"].(map[string]interface{})
+	id, _ := messages["ut_metadata"].(int)
+	if id < 0 || id > 255 {
+		return 0
+	}
+	return id
+}
+
+// fetchMetadata asks the peers one after the other for the info dictionary
+// of the torrent until one of them sends it. Web seeds only serve pieces,
+// so they are skipped.
+func fetchMetadata(network *PeerNetwork, torrentMeta TorrentMeta, peers []Peer, control *downloadControl) ([]byte, error) {
+	for _, peer := range peers {
+		if peer.webSeedUrl != "" {
+			continue
+		}
+		if !control.waitWhilePaused() || !control.acquireConnection(peer.local) {
+			return nil, ErrDownloadStopped
+		}
+
+		info, err := fetchPeerMetadata(network, torrentMeta, peer.address, control.stopped)
+		control.releaseConnection()
+		if err == nil {
+			return info, nil
+		}
+		if control.isStopped() {
+			return nil, ErrDownloadStopped
+		}
+		log.Debug().Msg(fmt.Sprintf("[Metadata] failed to fetch metadata from %s: %s", peer.address, err))
+	}
+
+	return nil, fmt.Errorf("%w, none of %d peers sent the metadata", ErrNoPeers, len(peers))
+}
+
+// fetchPeerMetadata downloads the info dictionary from the peer and checks
+// it against the info hash. Closing stop ends the transfer.
+func fetchPeerMetadata(network *PeerNetwork, torrentMeta TorrentMeta, peer netip.AddrPort, stop <-chan struct{}) ([]byte, error) {
+	conn, err := dialPeer(network, peer, torrentMeta.InfoHashBytes, network.encryption)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	message := createHandshakeMessage(torrentMeta.InfoHashBytes, network.peerId)
+	message[25] |= extensionProtocolBit
+	if err = sendMessageToPeer(conn, message); err != nil {
+		return nil, err
+	}
+	handshake, err := readHandshake(conn, torrentMeta.InfoHashBytes, network.peerId)
+	if err != nil {
+		return nil, err
+	}
+	if handshake.reserved[5]&extensionProtocolBit == 0 {
+		return nil, errors.New("peer doesn't support the extension protocol")
+	}
+	if err = sendMessageToPeer(conn, createExtendedHandshake(0)); err != nil {
+		return nil, err
+	}
+
+	// the piece count is unknown, but its hashes fit into the metadata, so
+	// that bounds the bitfield
+	maxLength := maxMessageLength(maxMetadataSize / sha1.Size)
+
+	// messages about pieces are skipped, only the extended ones matter
+	var peerMetadataId, size int
+	for peerMetadataId == 0 {
+		payload, err := readMessage(conn, maxLength)
+		if err != nil {
+			return nil, err
+		}
+		if payload[0] != extended {
+			continue
+		}
+
+		id, dict, _, err := parseExtendedMessage(payload)
+		if err != nil {
+			return nil, err
+		}
+		if id != extendedHandshake {
+			continue
+		}
+		if peerMetadataId = getMetadataId(dict); peerMetadataId == 0 {
+			return nil, errors.New("peer doesn't support metadata exchange")
+		}
+		size, _ = dict["metadata_size"].(int)
+	}
+	if size <= 0 || size > maxMetadataSize {
+		return nil, fmt.Errorf("peer announced metadata of %d bytes", size)
+	}
+
+	pieces := (size + metadataPieceSize - 1) / metadataPieceSize
+	for piece := range pieces {
+		request := map[string]interface{}{"msg_type": metadataRequest, "piece": piece}
+		if err = sendMessageToPeer(conn, createExtendedMessage(byte(peerMetadataId), request, nil)); err != nil {
+			return nil, err
+		}
+	}
+
+	metadata := make([]byte, size)
+	received := make(map[int]bool)
+	for len(received) < pieces {
+		payload, err := readMessage(conn, maxLength)
+		if err != nil {
+			return nil, err
+		}
+		if payload[0] != extended {
+			continue
+		}
+
+		id, dict, data, err := parseExtendedMessage(payload)
+		if err != nil {
+			return nil, err
+		}
+		if id != utMetadataId {
+			continue
+		}
+
+		piece, _ := dict["piece"].(int)
+		switch dict["msg_type"] {
+		case metadataReject:
+			return nil, fmt.Errorf("peer rejected metadata piece %d", piece)
+		case metadataData:
+			start := piece * metadataPieceSize
+			if piece < 0 || piece >= pieces || len(data) != min(metadataPieceSize, size-start) {
+				return nil, fmt.Errorf("peer sent metadata piece %d with %d bytes", piece, len(data))
+			}
+			copy(metadata[start:], data)
+			received[piece] = true
+		}
+	}
+
+	hash := sha1.Sum(metadata)
+	if !bytes.Equal(hash[:], torrentMeta.InfoHashBytes) {
+		return nil, errors.New("peer sent metadata that doesn't match the info hash")
+	}
+	return metadata, nil
+}
@@ -0,0 +1,129 @@
+package bittorrent
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestCreateMetadataResponse(t *testing.T) {
+	info := make([]byte, 2*metadataPieceSize+100)
+	for i := range info {
+		info[i] = byte(i % 251)
+	}
+
+	tests := []struct {
+		name    string
+		piece   int
+		msgType int
+		data    []byte
+	}{
+		{name: "First piece", piece: 0, msgType: metadataData, data: info[:metadataPieceSize]},
+		{name: "Last piece", piece: 2, msgType: metadataData, data: info[2*metadataPieceSize:]},
+		{name: "Past the end", piece: 3, msgType: metadataReject},
+		{name: "Negative piece", piece: -1, msgType: metadataReject},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := createMetadataResponse(info, tt.piece, 3)
+			id, dict, data, err := parseExtendedMessage(message[4:])
+			if err != nil {
+				t.Fatalf("parseExtendedMessage() unexpected error %v", err)
+			}
+			if id != 3 || dict["msg_type"] != tt.msgType || dict["piece"] != tt.piece || !bytes.Equal(data, tt.data) {
+				t.Errorf("response = %d %v with %d bytes, expected type %d and %d bytes", id, dict, len(data), tt.msgType, len(tt.data))
+			}
+			if tt.msgType == metadataData && dict["total_size"] != len(info) {
+				t.Errorf("response total size = %v, expected %d", dict["total_size"], len(info))
+			}
+		})
+	}
+}
+
+func TestFetchMetadata(t *testing.T) {
+	data := make([]byte, 3*defaultBlockSize)
+	for i := range data {
+		data[i] = byte(i * 11)
+	}
+	swarm := newTestSwarm(t, data, defaultBlockSize)
+	// the test seeders don't support the extension protocol
+	seeder := swarm.addSeeder(SeederFaults{fast: true})
+	uploader := newTestUploader(t, swarm)
+	uploaderAddress := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(uploader.network.port))
+
+	tests := []struct {
+		name    string
+		peers   []Peer
+		wantErr error
+	}{
+		{
+			name:  "Peer without metadata exchange is skipped",
+			peers: []Peer{{id: 0, address: seeder.address}, {id: 1, address: uploaderAddress}},
+		},
+		{
+			name:    "No peer sends the metadata",
+			peers:   []Peer{{id: 0, address: seeder.address}, {id: 1, webSeedUrl: "http://127.0.0.1:1/swarm.bin"}},
+			wantErr: ErrNoPeers,
+		},
+	}
+
+	magnet := Magnet{InfoHash: swarm.meta.InfoHash}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := fetchMetadata(newTestNetwork(), magnet.torrentMeta(), tt.peers, newDownloadControl(nil))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("fetchMetadata() error = %v, expected %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fetchMetadata() unexpected error %v", err)
+			}
+			if !bytes.Equal(info, swarm.meta.Info) {
+				t.Errorf("fetchMetadata() returned %d bytes that differ from the info dictionary", len(info))
+			}
+		})
+	}
+}
+
+func TestFetchMetadataStopped(t *testing.T) {
+	// the peer accepts the connection but never answers the handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	peers := []Peer{{address: netip.MustParseAddrPort(listener.Addr().String())}}
+	magnet := Magnet{InfoHash: "c77829d2a77d6516f88cd7a3de1a26abcbfab0db"}
+	control := newDownloadControl(nil)
+	time.AfterFunc(100*time.Millisecond, control.stop)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := fetchMetadata(newTestNetwork(), magnet.torrentMeta(), peers, control)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrDownloadStopped) {
+			t.Errorf("fetchMetadata() error = %v, expected ErrDownloadStopped", err)
+		}
+	case <-time.After(peerHandshakeTimeout / 2):
+		t.Fatal("fetchMetadata() did not return after the download was stopped")
+	}
+}
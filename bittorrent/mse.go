@@ -0,0 +1,345 @@
+package bittorrent
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	mathrand "math/rand"
+	"net"
+)
+
+type EncryptionPolicy string
+
+const (
+	ENCRYPTION_PREFER  EncryptionPolicy = "prefer"
+	ENCRYPTION_REQUIRE EncryptionPolicy = "require"
+	ENCRYPTION_DISABLE EncryptionPolicy = "disable"
+)
+
+const (
+	mseKeyLength       = 96
+	msePrivateKeyBits  = 160
+	mseMaxPadLength    = 512
+	mseCryptoPlaintext = 0x01
+	mseCryptoRC4       = 0x02
+)
+
+var (
+	msePrime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	mseGenerator = big.NewInt(2)
+
+	// mseVerificationConstant lets both sides find the start of the
+	// encrypted stream behind the random padding.
+	mseVerificationConstant = make([]byte, 8)
+)
+
+// mseConn is a peer connection whose payload is RC4 encrypted, or plaintext
+// if that is what the two sides agreed on.
+type mseConn struct {
+	net.Conn
+	reader io.Reader
+	writer io.Writer
+}
+
+func (c *mseConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *mseConn) Write(p []byte) (int, error) {
+	return c.writer.Write(p)
+}
+
+func ParseEncryptionPolicy(value string) (EncryptionPolicy, error) {
+	switch policy := EncryptionPolicy(value); policy {
+	case ENCRYPTION_PREFER, ENCRYPTION_REQUIRE, ENCRYPTION_DISABLE:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid encryption policy %s, expected prefer, require or disable", value)
+	}
+}
+
+// mseInitiate runs the outgoing side of the encrypted handshake for the
+// torrent with the given info hash. The BitTorrent handshake is sent over
+// the returned connection afterwards.
+func mseInitiate(conn net.Conn, infoHash []byte, policy EncryptionPolicy) (net.Conn, error) {
+	privateKey, publicKey, err := mseGenerateKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	err = mseWritePublicKey(conn, publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := mseReadSecret(conn, privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypt := mseCipher("keyA", secret, infoHash)
+	decrypt := mseCipher("keyB", secret, infoHash)
+
+	cryptoProvide := uint32(mseCryptoRC4)
+	if policy != ENCRYPTION_REQUIRE {
+		cryptoProvide |= mseCryptoPlaintext
+	}
+
+	padC, err := msePad()
+	if err != nil {
+		return nil, err
+	}
+
+	// the initial payload is left empty, the BitTorrent handshake follows
+	// once the crypto method is known
+	header := append([]byte{}, mseVerificationConstant...)
+	header = binary.BigEndian.AppendUint32(header, cryptoProvide)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(padC)))
+	header = append(header, padC...)
+	header = binary.BigEndian.AppendUint16(header, 0)
+	encrypt.XORKeyStream(header, header)
+
+	message := append(mseHash([]byte("req1"), secret), xorBytes(mseHash([]byte("req2"), infoHash), mseHash([]byte("req3"), secret))...)
+	_, err = conn.Write(append(message, header...))
+	if err != nil {
+		return nil, fmt.Errorf("error sending encryption header: %w", err)
+	}
+
+	// the peer's padding ends where the encrypted verification constant starts
+	expected := make([]byte, len(mseVerificationConstant))
+	mseCipher("keyB", secret, infoHash).XORKeyStream(expected, mseVerificationConstant)
+	err = mseSynchronize(conn, expected)
+	if err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(make([]byte, len(expected)), expected)
+
+	reader := cipher.StreamReader{S: decrypt, R: conn}
+	buf := make([]byte, 6)
+	_, err = io.ReadFull(reader, buf)
+	if err != nil {
+		return nil, fmt.Errorf("error reading crypto method: %w", err)
+	}
+
+	cryptoSelect := binary.BigEndian.Uint32(buf[0:4])
+	if cryptoSelect&cryptoProvide == 0 || cryptoSelect&(cryptoSelect-1) != 0 {
+		return nil, fmt.Errorf("peer selected unsupported crypto method %d", cryptoSelect)
+	}
+
+	_, err = io.CopyN(io.Discard, reader, int64(binary.BigEndian.Uint16(buf[4:6])))
+	if err != nil {
+		return nil, fmt.Errorf("error reading encryption padding: %w", err)
+	}
+
+	if cryptoSelect == mseCryptoPlaintext {
+		return conn, nil
+	}
+	return &mseConn{Conn: conn, reader: reader, writer: cipher.StreamWriter{S: encrypt, W: conn}}, nil
+}
+
+// mseAccept runs the incoming side of the encrypted handshake. The peer has
+// to pick one of the given info hashes, which is returned together with the
+// connection.
+func mseAccept(conn net.Conn, infoHashes [][]byte, policy EncryptionPolicy) (net.Conn, []byte, error) {
+	privateKey, publicKey, err := mseGenerateKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secret, err := mseReadSecret(conn, privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = mseWritePublicKey(conn, publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = mseSynchronize(conn, mseHash([]byte("req1"), secret))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	obfuscatedHash := make([]byte, sha1.Size)
+	_, err = io.ReadFull(conn, obfuscatedHash)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading torrent hash: %w", err)
+	}
+
+	var infoHash []byte
+	for _, candidate := range infoHashes {
+		if bytes.Equal(obfuscatedHash, xorBytes(mseHash([]byte("req2"), candidate), mseHash([]byte("req3"), secret))) {
+			infoHash = candidate
+		}
+	}
+	if infoHash == nil {
+		return nil, nil, errors.New("peer requested an unknown torrent")
+	}
+
+	encrypt := mseCipher("keyB", secret, infoHash)
+	decrypt := mseCipher("keyA", secret, infoHash)
+	reader := cipher.StreamReader{S: decrypt, R: conn}
+
+	buf := make([]byte, 14)
+	_, err = io.ReadFull(reader, buf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading encryption header: %w", err)
+	}
+
+	if !bytes.Equal(buf[0:8], mseVerificationConstant) {
+		return nil, nil, errors.New("invalid verification constant")
+	}
+
+	cryptoProvide := binary.BigEndian.Uint32(buf[8:12])
+	var cryptoSelect uint32
+	switch {
+	case cryptoProvide&mseCryptoRC4 != 0:
+		cryptoSelect = mseCryptoRC4
+	case cryptoProvide&mseCryptoPlaintext != 0 && policy != ENCRYPTION_REQUIRE:
+		cryptoSelect = mseCryptoPlaintext
+	default:
+		return nil, nil, fmt.Errorf("peer provided no acceptable crypto method, got %d", cryptoProvide)
+	}
+
+	_, err = io.CopyN(io.Discard, reader, int64(binary.BigEndian.Uint16(buf[12:14])))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading encryption padding: %w", err)
+	}
+
+	_, err = io.ReadFull(reader, buf[:2])
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading initial payload length: %w", err)
+	}
+	initialPayload := make([]byte, binary.BigEndian.Uint16(buf[:2]))
+	_, err = io.ReadFull(reader, initialPayload)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading initial payload: %w", err)
+	}
+
+	padD, err := msePad()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := append([]byte{}, mseVerificationConstant...)
+	header = binary.BigEndian.AppendUint32(header, cryptoSelect)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(padD)))
+	header = append(header, padD...)
+	encrypt.XORKeyStream(header, header)
+
+	_, err = conn.Write(header)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error sending encryption header: %w", err)
+	}
+
+	// the initial payload is already part of the stream and has to be read first
+	if cryptoSelect == mseCryptoPlaintext {
+		return &mseConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(initialPayload), conn), writer: conn}, infoHash, nil
+	}
+	return &mseConn{
+		Conn:   conn,
+		reader: io.MultiReader(bytes.NewReader(initialPayload), reader),
+		writer: cipher.StreamWriter{S: encrypt, W: conn},
+	}, infoHash, nil
+}
+
+func mseGenerateKeys() (*big.Int, *big.Int, error) {
+	privateKey, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), msePrivateKeyBits))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate encryption key: %w", err)
+	}
+	return privateKey, new(big.Int).Exp(mseGenerator, privateKey, msePrime), nil
+}
+
+// mseWritePublicKey sends the public key followed by random padding.
+func mseWritePublicKey(conn net.Conn, publicKey *big.Int) error {
+	pad, err := msePad()
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(append(publicKey.FillBytes(make([]byte, mseKeyLength)), pad...))
+	if err != nil {
+		return fmt.Errorf("error sending public key: %w", err)
+	}
+	return nil
+}
+
+// mseReadSecret reads the public key of the peer and returns the shared secret.
+func mseReadSecret(conn net.Conn, privateKey *big.Int) ([]byte, error) {
+	buf := make([]byte, mseKeyLength)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, fmt.Errorf("error reading public key: %w", err)
+	}
+
+	publicKey := new(big.Int).SetBytes(buf)
+	if publicKey.Cmp(big.NewInt(1)) <= 0 || publicKey.Cmp(msePrime) >= 0 {
+		return nil, errors.New("invalid public key")
+	}
+
+	return new(big.Int).Exp(publicKey, privateKey, msePrime).FillBytes(make([]byte, mseKeyLength)), nil
+}
+
+// mseSynchronize skips the padding in front of the marker and consumes the
+// marker itself. The padding is read byte by byte so nothing behind the
+// marker is read.
+func mseSynchronize(conn net.Conn, marker []byte) error {
+	window := make([]byte, 0, mseMaxPadLength+len(marker))
+	b := make([]byte, 1)
+
+	for len(window) < cap(window) {
+		_, err := io.ReadFull(conn, b)
+		if err != nil {
+			return fmt.Errorf("error reading encryption handshake: %w", err)
+		}
+		window = append(window, b[0])
+
+		if bytes.HasSuffix(window, marker) {
+			return nil
+		}
+	}
+	return errors.New("encryption handshake marker not found")
+}
+
+// mseCipher returns RC4 keyed for one direction of the connection with the
+// first 1024 bytes of the key stream discarded.
+func mseCipher(name string, secret []byte, infoHash []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(mseHash([]byte(name), secret, infoHash))
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+func mseHash(parts ...[]byte) []byte {
+	hash := sha1.New()
+	for _, part := range parts {
+		hash.Write(part)
+	}
+	return hash.Sum(nil)
+}
+
+func msePad() ([]byte, error) {
+	pad := make([]byte, mathrand.Intn(mseMaxPadLength+1))
+	_, err := rand.Read(pad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate padding: %w", err)
+	}
+	return pad, nil
+}
+
+func xorBytes(a []byte, b []byte) []byte {
+	result := make([]byte, len(a))
+	for i := range a {
+		result[i] = a[i] ^ b[i]
+	}
+	return result
+}
@@ -0,0 +1,143 @@
+package bittorrent
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// msePair connects an initiator and a responder over loopback TCP and runs
+// the encrypted handshake on both ends.
+func msePair(t *testing.T, infoHash []byte, knownHashes [][]byte) (net.Conn, net.Conn, error, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	type accepted struct {
+		conn net.Conn
+		err  error
+	}
+	responder := make(chan accepted)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			responder <- accepted{nil, err}
+			return
+		}
+		encrypted, _, err := mseAccept(conn, knownHashes, ENCRYPTION_PREFER)
+		if err != nil {
+			conn.Close()
+		}
+		responder <- accepted{encrypted, err}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	initiator, initiatorErr := mseInitiate(conn, infoHash, ENCRYPTION_PREFER)
+	if initiatorErr != nil {
+		conn.Close()
+	}
+
+	result := <-responder
+	return initiator, result.conn, initiatorErr, result.err
+}
+
+func TestMseHandshake(t *testing.T) {
+	infoHash := []byte("12345678901234567890")
+	otherHash := []byte("09876543210987654321")
+
+	initiator, responder, err, acceptErr := msePair(t, infoHash, [][]byte{otherHash, infoHash})
+	if err != nil || acceptErr != nil {
+		t.Fatalf("handshake failed: initiator %v, responder %v", err, acceptErr)
+	}
+	defer initiator.Close()
+	defer responder.Close()
+
+	if _, ok := initiator.(*mseConn); !ok {
+		t.Errorf("mseInitiate() did not select RC4")
+	}
+
+	message := createHandshakeMessage(infoHash, testPeerId)
+	go initiator.Write(message)
+	received := make([]byte, len(message))
+	if _, err := io.ReadFull(responder, received); err != nil || !bytes.Equal(received, message) {
+		t.Fatalf("responder received %q, %v", received, err)
+	}
+
+	go responder.Write([]byte("reply"))
+	received = make([]byte, 5)
+	if _, err := io.ReadFull(initiator, received); err != nil || string(received) != "reply" {
+		t.Fatalf("initiator received %q, %v", received, err)
+	}
+}
+
+func TestMseHandshakeUnknownTorrent(t *testing.T) {
+	_, _, err, acceptErr := msePair(t, []byte("12345678901234567890"), [][]byte{[]byte("09876543210987654321")})
+	if acceptErr == nil || err == nil {
+		t.Errorf("expected handshake to fail, got initiator %v, responder %v", err, acceptErr)
+	}
+}
+
+func TestDialPeerFallsBackToPlaintext(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	// a peer without encryption support hangs up on the public key
+	plaintext := make(chan []byte, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 20)
+			io.ReadFull(conn, buf)
+			if string(buf[1:]) == protocolString {
+				plaintext <- buf
+			}
+			conn.Close()
+		}
+	}()
+
+	peer := netip.MustParseAddrPort(listener.Addr().String())
+	infoHash := []byte("12345678901234567890")
+
+	_, err = dialPeer(newTestNetwork(), peer, infoHash, ENCRYPTION_REQUIRE)
+	if err == nil {
+		t.Errorf("dialPeer() with encryption required succeeded against a plaintext peer")
+	}
+
+	conn, err := dialPeer(newTestNetwork(), peer, infoHash, ENCRYPTION_PREFER)
+	if err != nil {
+		t.Fatalf("dialPeer() unexpected error %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write(createHandshakeMessage(infoHash, testPeerId))
+	select {
+	case <-plaintext:
+	case <-time.After(5 * time.Second):
+		t.Errorf("peer did not receive a plaintext handshake")
+	}
+}
+
+func TestParseEncryptionPolicy(t *testing.T) {
+	for _, value := range []string{"prefer", "require", "disable"} {
+		if policy, err := ParseEncryptionPolicy(value); err != nil || string(policy) != value {
+			t.Errorf("ParseEncryptionPolicy(%s) = %s, %v", value, policy, err)
+		}
+	}
+	if _, err := ParseEncryptionPolicy("always"); err == nil {
+		t.Errorf("ParseEncryptionPolicy(always) expected error")
+	}
+}
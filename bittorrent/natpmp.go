@@ -0,0 +1,245 @@
+package bittorrent
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// NAT-PMP (RFC 6886) and its successor PCP (RFC 6887) are spoken over UDP
+// with the default gateway. Both use the same port, a gateway that only
+// knows NAT-PMP answers PCP requests with an unsupported version error.
+const (
+	natPmpPort    = 5351
+	natPmpVersion = 0
+	pcpVersion    = 2
+
+	natPmpOpExternalAddress = 0
+	natPmpOpMapUdp          = 1
+	natPmpOpMapTcp          = 2
+	pcpOpAnnounce           = 0
+	pcpOpMap                = 1
+
+	natPmpMaxAttempts = 4
+)
+
+// natPmpTimeout is the time to wait for the first response, it doubles with every retry
+var natPmpTimeout = 250 * time.Millisecond
+
+// NatPmpGateway maps ports with PCP, or with NAT-PMP on gateways that
+// don't support PCP.
+type NatPmpGateway struct {
+	address      netip.AddrPort
+	localAddress netip.Addr
+	pcp          bool
+	mu           sync.Mutex
+	// nonces identify PCP mappings, renewing or deleting a mapping has to
+	// use the nonce it was created with
+	nonces map[string][]byte
+}
+
+// discoverNatPmp checks that the gateway speaks PCP or NAT-PMP.
+func discoverNatPmp(gateway netip.AddrPort) (*NatPmpGateway, error) {
+	localAddress, err := getLocalAddress(gateway.Addr())
+	if err != nil {
+		return nil, err
+	}
+
+	g := &NatPmpGateway{address: gateway, localAddress: localAddress, pcp: true, nonces: make(map[string][]byte)}
+	response, err := g.roundTrip(g.pcpRequest(pcpOpAnnounce, 0, nil), pcpOpAnnounce, 4)
+	if err != nil {
+		return nil, err
+	}
+	if response[0] == pcpVersion {
+		return g, checkNatPmpResult(response)
+	}
+
+	g.pcp = false
+	if _, err := g.getExternalAddress(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *NatPmpGateway) addMapping(protocol string, internalPort int, externalPort int, lifetime time.Duration) (netip.AddrPort, time.Duration, error) {
+	if g.pcp {
+		return g.pcpMap(protocol, internalPort, externalPort, lifetime)
+	}
+
+	externalIp, err := g.getExternalAddress()
+	if err != nil {
+		return netip.AddrPort{}, 0, err
+	}
+	mappedPort, granted, err := g.natPmpMap(protocol, internalPort, externalPort, lifetime)
+	if err != nil {
+		return netip.AddrPort{}, 0, err
+	}
+	return netip.AddrPortFrom(externalIp, uint16(mappedPort)), granted, nil
+}
+
+// deleteMapping asks for a lifetime of zero, which removes the mapping.
+func (g *NatPmpGateway) deleteMapping(protocol string, internalPort int, externalPort int) error {
+	var err error
+	if g.pcp {
+		_, _, err = g.pcpMap(protocol, internalPort, 0, 0)
+	} else {
+		_, _, err = g.natPmpMap(protocol, internalPort, 0, 0)
+	}
+	return err
+}
+
+func (g *NatPmpGateway) String() string {
+	if g.pcp {
+		return "PCP gateway " + g.address.String()
+	}
+	return "NAT-PMP gateway " + g.address.String()
+}
+
+func (g *NatPmpGateway) getExternalAddress() (netip.Addr, error) {
+	response, err := g.roundTrip([]byte{natPmpVersion, natPmpOpExternalAddress}, natPmpOpExternalAddress, 12)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if err := checkNatPmpResult(response); err != nil {
+		return netip.Addr{}, err
+	}
+	return netip.AddrFrom4([4]byte(response[8:12])), nil
+}
+
+func (g *NatPmpGateway) natPmpMap(protocol string, internalPort int, externalPort int, lifetime time.Duration) (int, time.Duration, error) {
+	opcode := byte(natPmpOpMapTcp)
+	if protocol == PROTOCOL_UDP {
+		opcode = natPmpOpMapUdp
+	}
+
+	request := []byte{natPmpVersion, opcode, 0, 0}
+	request = binary.BigEndian.AppendUint16(request, uint16(internalPort))
+	request = binary.BigEndian.AppendUint16(request, uint16(externalPort))
+	request = binary.BigEndian.AppendUint32(request, uint32(lifetime/time.Second))
+
+	response, err := g.roundTrip(request, opcode, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := checkNatPmpResult(response); err != nil {
+		return 0, 0, err
+	}
+	mappedPort := int(binary.BigEndian.Uint16(response[10:12]))
+	granted := time.Duration(binary.BigEndian.Uint32(response[12:16])) * time.Second
+	return mappedPort, granted, nil
+}
+
+func (g *NatPmpGateway) pcpMap(protocol string, internalPort int, externalPort int, lifetime time.Duration) (netip.AddrPort, time.Duration, error) {
+	protocolNumber := byte(6)
+	if protocol == PROTOCOL_UDP {
+		protocolNumber = 17
+	}
+
+	g.mu.Lock()
+	key := fmt.Sprintf("%s/%d", protocol, internalPort)
+	nonce, ok := g.nonces[key]
+	if !ok {
+		nonce = make([]byte, 12)
+		if _, err := rand.Read(nonce); err != nil {
+			g.mu.Unlock()
+			return netip.AddrPort{}, 0, err
+		}
+		g.nonces[key] = nonce
+	}
+	g.mu.Unlock()
+
+	payload := append([]byte{}, nonce...)
+	payload = append(payload, protocolNumber, 0, 0, 0)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(internalPort))
+	payload = binary.BigEndian.AppendUint16(payload, uint16(externalPort))
+	anyAddress := netip.IPv4Unspecified().As16()
+	payload = append(payload, anyAddress[:]...)
+
+	response, err := g.roundTrip(g.pcpRequest(pcpOpMap, lifetime, payload), pcpOpMap, 60)
+	if err != nil {
+		return netip.AddrPort{}, 0, err
+	}
+	if err := checkNatPmpResult(response); err != nil {
+		return netip.AddrPort{}, 0, err
+	}
+	if string(response[24:36]) != string(nonce) {
+		return netip.AddrPort{}, 0, errors.New("gateway answered with the nonce of another mapping")
+	}
+
+	granted := time.Duration(binary.BigEndian.Uint32(response[4:8])) * time.Second
+	mappedPort := binary.BigEndian.Uint16(response[42:44])
+	externalIp := netip.AddrFrom16([16]byte(response[44:60])).Unmap()
+	return netip.AddrPortFrom(externalIp, mappedPort), granted, nil
+}
+
+// pcpRequest returns the common header followed by the opcode specific payload.
+func (g *NatPmpGateway) pcpRequest(opcode byte, lifetime time.Duration, payload []byte) []byte {
+	request := []byte{pcpVersion, opcode, 0, 0}
+	request = binary.BigEndian.AppendUint32(request, uint32(lifetime/time.Second))
+	client := g.localAddress.As16()
+	request = append(request, client[:]...)
+	return append(request, payload...)
+}
+
+// roundTrip sends the request to the gateway and waits for the response to
+// the opcode, resending it with a doubling timeout. Only the common part of
+// the response is checked, results are left to the caller.
+func (g *NatPmpGateway) roundTrip(request []byte, opcode byte, minLength int) ([]byte, error) {
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(g.address))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	timeout := natPmpTimeout
+	buf := make([]byte, 1100)
+
+	for attempt := 0; attempt < natPmpMaxAttempts; attempt++ {
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		timeout *= 2
+
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if n < 4 || buf[1] != 0x80|opcode {
+				continue
+			}
+
+			// an unsupported version error is short and has no payload
+			if buf[0] != request[0] || n < minLength {
+				if buf[3] != 0 {
+					return append([]byte{}, buf[:n]...), nil
+				}
+				return nil, errors.New("invalid response from gateway")
+			}
+			return append([]byte{}, buf[:n]...), nil
+		}
+	}
+
+	return nil, fmt.Errorf("gateway %s did not respond", g.address)
+}
+
+// checkNatPmpResult returns the result code of the response as an error.
+// The code is one byte in PCP and two in NAT-PMP, with the same position of
+// the low byte.
+func checkNatPmpResult(response []byte) error {
+	if result := response[3]; result != 0 || response[0] == natPmpVersion && response[2] != 0 {
+		return fmt.Errorf("gateway refused the request with result code %d", binary.BigEndian.Uint16(response[2:4]))
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package bittorrent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNatPmpGateway answers PCP and NAT-PMP requests. Without pcp it
+// behaves like a gateway that only knows NAT-PMP.
+type fakeNatPmpGateway struct {
+	conn     net.PacketConn
+	pcp      bool
+	lifetime uint32
+	mu       sync.Mutex
+	mappings map[string]int
+	requests int
+}
+
+func newFakeNatPmpGateway(t *testing.T, pcp bool, lifetime uint32) *fakeNatPmpGateway {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	g := &fakeNatPmpGateway{conn: conn, pcp: pcp, lifetime: lifetime, mappings: make(map[string]int)}
+	go func() {
+		buf := make([]byte, 1100)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if response := g.handle(buf[:n]); response != nil {
+				conn.WriteTo(response, from)
+			}
+		}
+	}()
+	return g
+}
+
+func (g *fakeNatPmpGateway) address() netip.AddrPort {
+	return g.conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func (g *fakeNatPmpGateway) handle(request []byte) []byte {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.requests++
+
+	version, opcode := request[0], request[1]
+	if version == pcpVersion && !g.pcp {
+		response := []byte{natPmpVersion, 0x80 | opcode, 0, 1}
+		return binary.BigEndian.AppendUint32(response, 0)
+	}
+
+	externalIp := netip.MustParseAddr("198.51.100.4")
+	switch {
+	case version == natPmpVersion && opcode == natPmpOpExternalAddress:
+		response := []byte{natPmpVersion, 0x80, 0, 0, 0, 0, 0, 1}
+		ip := externalIp.As4()
+		return append(response, ip[:]...)
+	case version == natPmpVersion:
+		internalPort := int(binary.BigEndian.Uint16(request[4:6]))
+		lifetime := binary.BigEndian.Uint32(request[8:12])
+		// the gateway picks its own external port, offset from the internal one
+		externalPort := internalPort + 1000
+		key := fmt.Sprintf("%d/%d", opcode, internalPort)
+		if lifetime == 0 {
+			delete(g.mappings, key)
+			externalPort, lifetime = 0, 0
+		} else {
+			g.mappings[key] = externalPort
+			lifetime = min(lifetime, g.lifetime)
+		}
+		response := []byte{natPmpVersion, 0x80 | opcode, 0, 0, 0, 0, 0, 1}
+		response = binary.BigEndian.AppendUint16(response, uint16(internalPort))
+		response = binary.BigEndian.AppendUint16(response, uint16(externalPort))
+		return binary.BigEndian.AppendUint32(response, lifetime)
+	case opcode == pcpOpAnnounce:
+		response := make([]byte, 24)
+		response[0], response[1] = pcpVersion, 0x80
+		return response
+	case opcode == pcpOpMap:
+		lifetime := min(binary.BigEndian.Uint32(request[4:8]), g.lifetime)
+		payload := request[24:60]
+		key := fmt.Sprintf("%d/%d", payload[12], binary.BigEndian.Uint16(payload[16:18]))
+		if lifetime == 0 {
+			delete(g.mappings, key)
+		} else {
+			g.mappings[key] = int(binary.BigEndian.Uint16(payload[18:20]))
+		}
+
+		response := make([]byte, 24, 60)
+		response[0], response[1] = pcpVersion, 0x80|pcpOpMap
+		binary.BigEndian.PutUint32(response[4:8], lifetime)
+		response = append(response, payload[:20]...)
+		ip := externalIp.As16()
+		return append(response, ip[:]...)
+	}
+	return nil
+}
+
+func TestNatPmpPortMapping(t *testing.T) {
+	tests := []struct {
+		name     string
+		pcp      bool
+		expected netip.AddrPort
+		gateway  string
+		mappings []string
+	}{
+		{
+			name:     "PCP",
+			pcp:      true,
+			expected: netip.MustParseAddrPort("198.51.100.4:6881"),
+			gateway:  "PCP gateway",
+			mappings: []string{"6/6881", "17/6881"},
+		},
+		{
+			name:     "NAT-PMP",
+			pcp:      false,
+			expected: netip.MustParseAddrPort("198.51.100.4:7881"),
+			gateway:  "NAT-PMP gateway",
+			mappings: []string{"2/6881", "1/6881"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeNatPmpGateway(t, tt.pcp, 3600)
+
+			gateway, err := discoverNatPmp(fake.address())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gateway.String() != tt.gateway+" "+fake.address().String() {
+				t.Errorf("String() = %s", gateway)
+			}
+
+			mapping, err := newPortMapping(gateway, 6881)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if external := mapping.externalAddress(); external != tt.expected {
+				t.Errorf("externalAddress() = %s, expected %s", external, tt.expected)
+			}
+
+			fake.mu.Lock()
+			if len(fake.mappings) != len(tt.mappings) {
+				t.Errorf("mappings = %v, expected %v", fake.mappings, tt.mappings)
+			}
+			for _, key := range tt.mappings {
+				if _, ok := fake.mappings[key]; !ok {
+					t.Errorf("missing mapping %s in %v", key, fake.mappings)
+				}
+			}
+			fake.mu.Unlock()
+
+			if err := mapping.Close(); err != nil {
+				t.Fatal(err)
+			}
+			fake.mu.Lock()
+			if len(fake.mappings) != 0 {
+				t.Errorf("mappings left after close: %v", fake.mappings)
+			}
+			fake.mu.Unlock()
+		})
+	}
+}
+
+func TestPortMappingRenewal(t *testing.T) {
+	// the gateway grants a second, so the mapping is renewed twice a second
+	fake := newFakeNatPmpGateway(t, true, 1)
+
+	gateway, err := discoverNatPmp(fake.address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapping, err := newPortMapping(gateway, 6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mapping.Close()
+
+	fake.mu.Lock()
+	requests := fake.requests
+	fake.mu.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fake.mu.Lock()
+		renewed := fake.requests >= requests+2
+		fake.mu.Unlock()
+		if renewed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("mapping was not renewed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestDiscoverNatPmpWithoutGateway(t *testing.T) {
+	silent, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	timeout := natPmpTimeout
+	natPmpTimeout = 10 * time.Millisecond
+	defer func() { natPmpTimeout = timeout }()
+
+	if _, err := discoverNatPmp(silent.LocalAddr().(*net.UDPAddr).AddrPort()); err == nil {
+		t.Error("expected an error without a gateway")
+	}
+}
+
+func TestTrackerRequestWithPortMapping(t *testing.T) {
+	fake := newFakeNatPmpGateway(t, false, 3600)
+	gateway, err := discoverNatPmp(fake.address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	network := newTestNetwork()
+	mapping, err := newPortMapping(gateway, network.port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mapping.Close()
+	network.mapping = mapping
+
+	request := newTrackerRequest(network, TorrentMeta{})
+	if request.Ip != "198.51.100.4" || request.Port != network.port+1000 {
+		t.Errorf("tracker request has ip %s and port %d, expected the external address", request.Ip, request.Port)
+	}
+}
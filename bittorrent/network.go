@@ -0,0 +1,56 @@
+package bittorrent
+
+import (
+	"sync"
+)
+
+// DefaultListenPort is the port a client tells trackers and LAN peers to
+// connect to unless it's given another one.
+const DefaultListenPort = 6881
+
+// PeerNetwork is what the peer connections of a client share: its peer ID,
+// the port it is reachable on and the settings of its connections. Every
+// Client has its own, so clients in the same process don't affect each
+// other.
+type PeerNetwork struct {
+	peerId     []byte
+	port       int
+	encryption EncryptionPolicy
+	transport  PeerTransport
+	bandwidth  *BandwidthLimits
+	// discovery and mapping are nil unless they are enabled
+	discovery *LocalDiscovery
+	mapping   *PortMapping
+	// server is nil for networks that don't accept peers
+	server *PeerServer
+
+	mu               sync.Mutex
+	torrentBandwidth map[string]*BandwidthLimits
+}
+
+// newPeerNetwork returns a network with unlimited bandwidth that dials
+// plaintext TCP connections.
+func newPeerNetwork(peerId []byte) *PeerNetwork {
+	return &PeerNetwork{
+		peerId:           peerId,
+		port:             DefaultListenPort,
+		encryption:       ENCRYPTION_DISABLE,
+		transport:        TRANSPORT_TCP,
+		bandwidth:        newBandwidthLimits(0, 0),
+		torrentBandwidth: make(map[string]*BandwidthLimits),
+	}
+}
+
+// bandwidthForTorrent returns the limits for the torrent with the given info
+// hash, creating unlimited ones the first time the torrent is seen.
+func (n *PeerNetwork) bandwidthForTorrent(infoHash string) *BandwidthLimits {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	limits, ok := n.torrentBandwidth[infoHash]
+	if !ok {
+		limits = newBandwidthLimits(0, 0)
+		n.torrentBandwidth[infoHash] = limits
+	}
+	return limits
+}
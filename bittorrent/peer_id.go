@@ -0,0 +1,134 @@
+package bittorrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// peerIdPrefix identifies this client in Azureus style: a dash, two letters
+// for the client, four characters of version and another dash.
+const peerIdPrefix = "-GB0001-"
+
+const peerIdCharacters = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// azureusClients maps the client codes of Azureus style peer IDs to names.
+var azureusClients = map[string]string{
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"GB": "bittorrent-client-go",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "libtorrent (Rasterbar)",
+	"qB": "qBittorrent",
+	"TR": "Transmission",
+	"UT": "µTorrent",
+	"UM": "µTorrent Mac",
+	"WW": "WebTorrent",
+}
+
+// shadowClients maps the first character of Shad0w style peer IDs to names.
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// shadowVersionCharacters are the digits of Shad0w style versions, every
+// character is one version component from 0 to 63.
+const shadowVersionCharacters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz.-"
+
+// newPeerId returns the prefix followed by random alphanumeric characters,
+// which some trackers require to be printable.
+func newPeerId() ([]byte, error) {
+	peerId := make([]byte, 20)
+	copy(peerId, peerIdPrefix)
+
+	random := make([]byte, len(peerId)-len(peerIdPrefix))
+	if _, err := rand.Read(random); err != nil {
+		return nil, fmt.Errorf("failed to generate peer id: %w", err)
+	}
+	for i, b := range random {
+		peerId[len(peerIdPrefix)+i] = peerIdCharacters[int(b)%len(peerIdCharacters)]
+	}
+	return peerId, nil
+}
+
+// loadPeerId returns the peer ID stored in the file at path. If there is
+// none yet, or the file holds an ID of another client, a new one is
+// generated and stored for the next run.
+func loadPeerId(path string) ([]byte, error) {
+	peerId, err := os.ReadFile(path)
+	if err == nil && len(peerId) == 20 && bytes.HasPrefix(peerId, []byte(peerIdPrefix)) {
+		return peerId, nil
+	}
+
+	peerId, err = newPeerId()
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err == nil {
+		err = os.WriteFile(path, peerId, 0o600)
+	}
+	if err != nil {
+		return peerId, fmt.Errorf("failed to store peer id: %w", err)
+	}
+	return peerId, nil
+}
+
+// parsePeerClient returns the client name and version encoded in a remote
+// peer ID. Azureus and Shad0w style IDs are recognized, IDs that follow
+// any other convention are reported as "unknown".
+func parsePeerClient(peerId []byte) string {
+	if len(peerId) != 20 {
+		return "unknown"
+	}
+	if peerId[0] != '-' || peerId[7] != '-' {
+		return parseShadowPeerClient(peerId)
+	}
+
+	code := string(peerId[1:3])
+	name, ok := azureusClients[code]
+	if !ok {
+		name = fmt.Sprintf("unknown client %q", code)
+	}
+
+	// every character is one version component, trailing zeros are dropped
+	components := strings.Split(string(peerId[3:7]), "")
+	for len(components) > 2 && components[len(components)-1] == "0" {
+		components = components[:len(components)-1]
+	}
+	return name + " " + strings.Join(components, ".")
+}
+
+// parseShadowPeerClient reads IDs that start with a client character and up
+// to five version characters, padded with dashes to six characters and
+// followed by "---".
+func parseShadowPeerClient(peerId []byte) string {
+	name, ok := shadowClients[peerId[0]]
+	if !ok || string(peerId[6:9]) != "---" {
+		return "unknown"
+	}
+
+	var components []string
+	for _, c := range bytes.TrimRight(peerId[1:6], "-") {
+		component := strings.IndexByte(shadowVersionCharacters, c)
+		if component < 0 {
+			return "unknown"
+		}
+		components = append(components, fmt.Sprint(component))
+	}
+	return name + " " + strings.Join(components, ".")
+}
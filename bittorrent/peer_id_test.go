@@ -0,0 +1,97 @@
+package bittorrent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testPeerId is the peer ID of the networks created by newTestNetwork.
+var testPeerId = []byte("-GB0001-testpeer0001")
+
+func newTestNetwork() *PeerNetwork {
+	return newPeerNetwork(testPeerId)
+}
+
+func TestNewPeerId(t *testing.T) {
+	peerId, err := newPeerId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(peerId) != 20 {
+		t.Fatalf("newPeerId() has length %d, expected 20", len(peerId))
+	}
+	if !bytes.HasPrefix(peerId, []byte(peerIdPrefix)) {
+		t.Errorf("newPeerId() = %s, expected prefix %s", peerId, peerIdPrefix)
+	}
+	for _, c := range peerId[len(peerIdPrefix):] {
+		if !strings.ContainsRune(peerIdCharacters, rune(c)) {
+			t.Errorf("newPeerId() = %s contains unexpected character %q", peerId, c)
+		}
+	}
+	if other, _ := newPeerId(); bytes.Equal(peerId, other) {
+		t.Errorf("newPeerId() returned the same id twice")
+	}
+}
+
+func TestPeerIdIsSharedByAnnounceAndHandshake(t *testing.T) {
+	network := newTestNetwork()
+	handshake := createHandshakeMessage([]byte("12345678901234567890"), network.peerId)
+	request := newTrackerRequest(network, TorrentMeta{})
+
+	if string(handshake[48:68]) != request.PeerId {
+		t.Errorf("handshake peer id %s differs from announce peer id %s", handshake[48:68], request.PeerId)
+	}
+}
+
+func TestLoadPeerId(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config", "peer_id")
+
+	peerId, err := loadPeerId(path)
+	if err != nil {
+		t.Fatalf("loadPeerId() unexpected error %v", err)
+	}
+	stored, err := loadPeerId(path)
+	if err != nil {
+		t.Fatalf("loadPeerId() unexpected error %v", err)
+	}
+	if !bytes.Equal(peerId, stored) {
+		t.Errorf("loadPeerId() = %s, expected the stored id %s", stored, peerId)
+	}
+
+	// an id of another client is replaced
+	os.WriteFile(path, []byte("-qB4520-abcdefghijkl"), 0o600)
+	replaced, err := loadPeerId(path)
+	if err != nil || !bytes.HasPrefix(replaced, []byte(peerIdPrefix)) {
+		t.Errorf("loadPeerId() = %s, %v, expected a new id", replaced, err)
+	}
+}
+
+func TestParsePeerClient(t *testing.T) {
+	tests := []struct {
+		peerId   string
+		expected string
+	}{
+		{peerId: "-qB4520-abcdefghijkl", expected: "qBittorrent 4.5.2"},
+		{peerId: "-TR3000-abcdefghijkl", expected: "Transmission 3.0"},
+		{peerId: "-GB0001-abcdefghijkl", expected: "bittorrent-client-go 0.0.0.1"},
+		{peerId: "-XX1200-abcdefghijkl", expected: `unknown client "XX" 1.2`},
+		{peerId: "T03I-----abcdefghijk", expected: "BitTornado 0.3.18"},
+		{peerId: "S58B-----abcdefghijk", expected: "Shadow 5.8.11"},
+		{peerId: "T0!------abcdefghijk", expected: "unknown"},
+		{peerId: "M7-2-2--abcdefghijkl", expected: "unknown"},
+		{peerId: "-qB4520-", expected: "unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.peerId, func(t *testing.T) {
+			result := parsePeerClient([]byte(tt.peerId))
+			if result != tt.expected {
+				t.Errorf("parsePeerClient(%s) = %s, expected %s", tt.peerId, result, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package bittorrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// peerHandshakeTimeout limits how long connecting and the handshakes take.
+var peerHandshakeTimeout = 5 * time.Second
+
+// peerMessageTimeout is how long a peer may take to send the next message.
+// It's long enough for a whole block over a rate limited connection and for
+// the keep alives peers send every two minutes.
+var peerMessageTimeout = 2 * time.Minute
+
+const (
+	cancel        = 8
+	piece         = 7
+	request       = 6
+	bitfield      = 5
+	have          = 4
+	notInterested = 3
+	interested    = 2
+	unchoke       = 1
+	choke         = 0
+)
+
+const (
+	protocolString  = "BitTorrent protocol"
+	handshakeLength = 49 + len(protocolString)
+)
+
+// Handshake is what the remote peer sent in its handshake.
+type Handshake struct {
+	reserved [8]byte
+	infoHash []byte
+	peerId   []byte
+}
+
+type PieceMessage struct {
+	index int
+	begin int
+	data  []byte
+}
+
+type Bitfield []byte
+
+func (bf Bitfield) hasPiece(index int) bool {
+	byteIndex := index / 8
+	offset := index % 8
+	return bf[byteIndex]>>(7-offset)&1 != 0
+}
+
+func getPeers(network *PeerNetwork, torrentMeta TorrentMeta, stop <-chan struct{}) ([]netip.AddrPort, error) {
+	tracker, err := fromTorrentMeta(network, torrentMeta, stop)
+	return tracker.Peers, err
+}
+
+func peerHandshake(network *PeerNetwork, peer netip.AddrPort, infoHash []byte) (net.Conn, Handshake, error) {
+	conn, err := dialPeer(network, peer, infoHash, network.encryption)
+	if err != nil {
+		return nil, Handshake{}, err
+	}
+
+	handshakeMsg := createHandshakeMessage(infoHash, network.peerId)
+
+	_, err = conn.Write(handshakeMsg)
+	if err != nil {
+		conn.Close()
+		return nil, Handshake{}, errors.New("error sending handshake to peer")
+	}
+
+	handshake, err := readHandshake(conn, infoHash, network.peerId)
+	if err != nil {
+		conn.Close()
+		return nil, Handshake{}, err
+	}
+
+	log.Debug().Msg(fmt.Sprintf("[Peer] %s is running %s", peer, parsePeerClient(handshake.peerId)))
+
+	return conn, handshake, nil
+}
+
+// dialPeer connects to the peer and runs the encrypted handshake if the
+// policy asks for it. With the prefer policy a peer that fails the encrypted
+// handshake is dialed again in plaintext.
+func dialPeer(network *PeerNetwork, peer netip.AddrPort, infoHash []byte, policy EncryptionPolicy) (net.Conn, error) {
+	conn, err := dialPeerTransport(peer, network.transport)
+	if err != nil {
+		return nil, errors.New("error establishing connection to peer")
+	}
+	conn = newRateLimitedConn(conn, network.bandwidth, network.bandwidthForTorrent(hex.EncodeToString(infoHash)))
+	err = conn.SetReadDeadline(time.Now().Add(peerHandshakeTimeout))
+	if err != nil {
+		conn.Close()
+		return nil, errors.New("set deadline failed")
+	}
+
+	if policy == ENCRYPTION_DISABLE {
+		return conn, nil
+	}
+
+	encrypted, err := mseInitiate(conn, infoHash, policy)
+	if err == nil {
+		return encrypted, nil
+	}
+	conn.Close()
+
+	if policy == ENCRYPTION_REQUIRE {
+		return nil, fmt.Errorf("encrypted handshake with peer failed: %w", err)
+	}
+
+	log.Debug().Msg(fmt.Sprintf("[Peer] encrypted handshake with %s failed, falling back to plaintext: %s", peer, err))
+	return dialPeer(network, peer, infoHash, ENCRYPTION_DISABLE)
+}
+
+// readHandshake reads the handshake of the remote peer and checks that it
+// speaks the BitTorrent protocol for the same torrent and is not ourselves,
+// the peer with our peerId.
+func readHandshake(conn io.Reader, infoHash []byte, peerId []byte) (Handshake, error) {
+	handshake, err := readHandshakeMessage(conn)
+	if err != nil {
+		return Handshake{}, err
+	}
+
+	if !bytes.Equal(handshake.infoHash, infoHash) {
+		return Handshake{}, fmt.Errorf("peer sent info hash %x, expected %x", handshake.infoHash, infoHash)
+	}
+	if bytes.Equal(handshake.peerId, peerId) {
+		return Handshake{}, errors.New("connected to ourselves")
+	}
+
+	return handshake, nil
+}
+
+// readHandshakeMessage reads a handshake for any torrent.
+func readHandshakeMessage(conn io.Reader) (Handshake, error) {
+	buf := make([]byte, handshakeLength)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return Handshake{}, fmt.Errorf("error reading handshake from peer: %w", err)
+	}
+
+	if buf[0] != byte(len(protocolString)) || string(buf[1:20]) != protocolString {
+		return Handshake{}, fmt.Errorf("peer does not speak the BitTorrent protocol, got %q", buf[1:min(1+int(buf[0]), len(buf))])
+	}
+
+	handshake := Handshake{infoHash: buf[28:48], peerId: buf[48:68]}
+	copy(handshake.reserved[:], buf[20:28])
+	return handshake, nil
+}
+
+// exchangePeerMessages reads the peer's messages until the piece can be
+// requested, which is after an unchoke or right away when the peer allowed
+// the piece with the Fast extension.
+func exchangePeerMessages(conn net.Conn, state *PeerState, piece int) error {
+	// the first message tells which pieces the peer has
+	payload, err := readMessage(conn, maxMessageLength(state.pieces))
+	if err != nil {
+		return errors.New("error receiving bitfield message")
+	}
+	if payload[0] != bitfield && !(state.fast && (payload[0] == haveAll || payload[0] == haveNone)) {
+		return errors.New("expected bitfield message")
+	}
+
+	for {
+		err = state.handleMessage(payload)
+		if err != nil {
+			return err
+		}
+
+		if !state.hasPiece(piece) {
+			return errors.New("peer doesn't have requested piece")
+		}
+
+		if !state.interested {
+			// send interested message
+			err = sendMessageToPeer(conn, []byte{0, 0, 0, 1, interested})
+			if err != nil {
+				return errors.New("error sending interested message to peer")
+			}
+			state.interested = true
+		}
+
+		if state.canRequest(piece) {
+			return nil
+		}
+
+		payload, err = readMessage(conn, maxMessageLength(state.pieces))
+		if err != nil {
+			return errors.New("error receiving peer unchoke message")
+		}
+	}
+}
+
+func createHandshakeMessage(infoHash []byte, peerId []byte) []byte {
+	pstrlen := byte(len(protocolString))
+	pstr := []byte(protocolString)
+	reserved := make([]byte, 8)
+	reserved[7] |= fastExtensionBit
+	handshake := append([]byte{pstrlen}, pstr...)
+	handshake = append(handshake, reserved...)
+	handshake = append(handshake, infoHash...)
+	handshake = append(handshake, peerId...)
+	return handshake
+}
+
+func sendMessageToPeer(conn net.Conn, message []byte) error {
+	_, err := conn.Write(message)
+	if err != nil {
+		return fmt.Errorf("error sending message to peer: %w", err)
+	}
+
+	return nil
+}
+
+// parsePieceMessage splits a piece message into the position of the block
+// and its data.
+func parsePieceMessage(payload []byte) (PieceMessage, error) {
+	if len(payload) < 9 {
+		return PieceMessage{}, fmt.Errorf("piece message has length %d, expected at least 9", len(payload))
+	}
+
+	return PieceMessage{
+		index: int(binary.BigEndian.Uint32(payload[1:5])),
+		begin: int(binary.BigEndian.Uint32(payload[5:9])),
+		data:  payload[9:],
+	}, nil
+}
+
+// maxMessageLength is the longest message a peer may send for a torrent
+// with the given number of pieces, a block with its header or the
+// bitfield, whichever is longer.
+func maxMessageLength(pieces int) int {
+	return max(9+defaultBlockSize, 1+(pieces+7)/8)
+}
+
+// readMessage reads the next message that isn't a keep alive. Longer
+// messages than maxLength are refused before anything is allocated for
+// them, since anyone can connect and send a length prefix.
+func readMessage(conn net.Conn, maxLength int) ([]byte, error) {
+	buf := make([]byte, 4)
+
+	// keep alive messages have no payload and are skipped
+	lengthPrefix := uint32(0)
+	for lengthPrefix == 0 {
+		// every message gets its own deadline, the connection lives as long
+		// as the peer keeps sending
+		err := conn.SetReadDeadline(time.Now().Add(peerMessageTimeout))
+		if err != nil {
+			return nil, errors.New("set deadline failed")
+		}
+
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			return nil, errors.New("failed to read length prefix")
+		}
+		lengthPrefix = binary.BigEndian.Uint32(buf)
+	}
+	if lengthPrefix > uint32(maxLength) {
+		return nil, fmt.Errorf("peer sent a message of %d bytes, at most %d are accepted", lengthPrefix, maxLength)
+	}
+
+	payloadBuf := make([]byte, lengthPrefix)
+	_, err := io.ReadFull(conn, payloadBuf)
+	if err != nil {
+		return nil, errors.New("failed to read payload")
+	}
+
+	return payloadBuf, nil
+}
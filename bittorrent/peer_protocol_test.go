@@ -0,0 +1,139 @@
+package bittorrent
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestHasPiece(t *testing.T) {
+	tests := []struct {
+		name     string
+		bitfield Bitfield
+		index    int
+		expected bool
+	}{
+		{
+			name:     "First bit set",
+			bitfield: Bitfield{0b10000000}, // binary: 10000000
+			index:    0,
+			expected: true,
+		},
+		{
+			name:     "First bit not set",
+			bitfield: Bitfield{0b01000000}, // binary: 01000000
+			index:    0,
+			expected: false,
+		},
+		{
+			name:     "Middle bit set",
+			bitfield: Bitfield{0b00100000}, // binary: 00100000
+			index:    2,
+			expected: true,
+		},
+		{
+			name:     "Last bit set",
+			bitfield: Bitfield{0b00000001}, // binary: 00000001
+			index:    7,
+			expected: true,
+		},
+		{
+			name:     "Bit in second byte set",
+			bitfield: Bitfield{0b00000000, 0b10000000}, // binary: 00000000 10000000
+			index:    8,
+			expected: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := tt.bitfield.hasPiece(tt.index)
+			if result != tt.expected {
+				t.Errorf("hasPiece(%d) = %v, expected %v", tt.index, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestReadHandshake(t *testing.T) {
+	infoHash := []byte("12345678901234567890")
+	remotePeerId := []byte("-qB4520-abcdefghijkl")
+
+	handshakeFrom := func(infoHash []byte, peerId []byte) []byte {
+		message := createHandshakeMessage(infoHash, testPeerId)
+		message[25] = 0x10
+		return append(message[:48], peerId...)
+	}
+
+	tests := []struct {
+		name    string
+		message []byte
+		wantErr string
+	}{
+		{name: "Valid handshake", message: handshakeFrom(infoHash, remotePeerId)},
+		{name: "Short handshake", message: handshakeFrom(infoHash, remotePeerId)[:60], wantErr: "error reading handshake from peer"},
+		{name: "Wrong protocol", message: append([]byte("\x13Bittorrent Protocol"), handshakeFrom(infoHash, remotePeerId)[20:]...), wantErr: "does not speak the BitTorrent protocol"},
+		{name: "Wrong info hash", message: handshakeFrom([]byte("09876543210987654321"), remotePeerId), wantErr: "peer sent info hash"},
+		{name: "Connected to ourselves", message: handshakeFrom(infoHash, testPeerId), wantErr: "connected to ourselves"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handshake, err := readHandshake(bytes.NewReader(tt.message), infoHash, testPeerId)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("readHandshake() error = %v, expected %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readHandshake() unexpected error %v", err)
+			}
+			if !bytes.Equal(handshake.peerId, remotePeerId) || handshake.reserved[5] != 0x10 {
+				t.Errorf("readHandshake() = %+v", handshake)
+			}
+		})
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	block := append([]byte{0, 0, 0x40, 0x09, piece}, make([]byte, 8+defaultBlockSize)...)
+
+	tests := []struct {
+		name    string
+		message []byte
+		pieces  int
+		want    []byte
+		wantErr string
+	}{
+		{name: "Keep alive is skipped", message: []byte{0, 0, 0, 0, 0, 0, 0, 1, unchoke}, pieces: 8, want: []byte{unchoke}},
+		{name: "Full block", message: block, pieces: 8, want: block[4:]},
+		{name: "Bitfield of many pieces", message: append([]byte{0, 0, 0x4e, 0x21, bitfield}, make([]byte, 20000)...), pieces: 160000, want: append([]byte{bitfield}, make([]byte, 20000)...)},
+		{name: "Longer than a block", message: []byte{0, 0, 0x40, 0x0a, piece}, pieces: 8, wantErr: "peer sent a message of 16394 bytes"},
+		{name: "Huge length prefix", message: []byte{0xff, 0xff, 0xff, 0xff}, pieces: 8, wantErr: "peer sent a message of 4294967295 bytes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local, remote := net.Pipe()
+			defer local.Close()
+			defer remote.Close()
+			go remote.Write(tt.message)
+
+			payload, err := readMessage(local, maxMessageLength(tt.pieces))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("readMessage() error = %v, expected %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readMessage() unexpected error %v", err)
+			}
+			if !bytes.Equal(payload, tt.want) {
+				t.Errorf("readMessage() returned %d bytes, expected %d", len(payload), len(tt.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,497 @@
+package bittorrent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// PeerServer accepts the connections of other peers and uploads the pieces
+// the session's torrents have to them.
+type PeerServer struct {
+	session     *Session
+	listener    *PeerListener
+	connections chan struct{}
+	mu          sync.Mutex
+	open        map[net.Conn]bool
+	served      map[string]*servedTorrent
+	closed      bool
+	handlers    sync.WaitGroup
+}
+
+// servedTorrent holds the peers that download a torrent from us and the
+// choker that decides which of them get an upload slot. It lives while
+// peers are connected.
+type servedTorrent struct {
+	choker *Choker
+	peers  map[string]*peerUpload
+	done   chan struct{}
+}
+
+// peerUpload is an incoming connection of a peer that downloads from us.
+type peerUpload struct {
+	conn    net.Conn
+	address string
+	peerId  string
+	torrent *SessionTorrent
+	choker  *Choker
+	fast    bool
+	// extensions is set for peers that support the extension protocol,
+	// metadataId is the id they receive metadata messages with
+	extensions bool
+	metadataId int
+	// allowed are the pieces the peer may download while choked
+	allowed map[int]bool
+	// mu orders the writes to the connection
+	mu     sync.Mutex
+	choked bool
+}
+
+func newPeerServer(session *Session, listener *PeerListener, maxConnections int) *PeerServer {
+	if maxConnections < 1 {
+		maxConnections = DefaultMaxConnections
+	}
+
+	return &PeerServer{
+		session:     session,
+		listener:    listener,
+		connections: make(chan struct{}, maxConnections),
+		open:        make(map[net.Conn]bool),
+		served:      make(map[string]*servedTorrent),
+	}
+}
+
+// run accepts peers until the server is closed.
+func (s *PeerServer) run() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		// peers beyond the limit are turned away right away
+		select {
+		case s.connections <- struct{}{}:
+		default:
+			conn.Close()
+			continue
+		}
+
+		if !s.track(conn) {
+			conn.Close()
+			return
+		}
+		go func() {
+			defer s.handlers.Done()
+			defer s.untrack(conn)
+
+			err := s.servePeer(conn)
+			log.Debug().Msg(fmt.Sprintf("[PeerServer] connection from %s closed: %s", conn.RemoteAddr(), err))
+		}()
+	}
+}
+
+func (s *PeerServer) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		<-s.connections
+		return false
+	}
+	s.open[conn] = true
+	s.handlers.Add(1)
+	return true
+}
+
+func (s *PeerServer) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.open, conn)
+	s.mu.Unlock()
+
+	conn.Close()
+	<-s.connections
+}
+
+// Close stops accepting peers and closes the connections of the peers
+// that are connected.
+func (s *PeerServer) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.open {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	err := s.listener.Close()
+	s.handlers.Wait()
+	return err
+}
+
+// servePeer runs the handshakes with the peer and uploads to it until one
+// side closes the connection.
+func (s *PeerServer) servePeer(conn net.Conn) error {
+	network := s.session.network
+
+	err := conn.SetReadDeadline(time.Now().Add(peerHandshakeTimeout))
+	if err != nil {
+		return errors.New("set deadline failed")
+	}
+
+	conn, encryptedHash, err := s.acceptEncryption(conn)
+	if err != nil {
+		return err
+	}
+
+	handshake, err := readHandshakeMessage(conn)
+	if err != nil {
+		return err
+	}
+	if encryptedHash != nil && !bytes.Equal(handshake.infoHash, encryptedHash) {
+		return fmt.Errorf("peer sent info hash %x, expected %x", handshake.infoHash, encryptedHash)
+	}
+	if bytes.Equal(handshake.peerId, network.peerId) {
+		return errors.New("connected to ourselves")
+	}
+
+	torrent, err := s.session.getTorrent(hex.EncodeToString(handshake.infoHash))
+	if err != nil || !torrent.serving() {
+		return fmt.Errorf("peer asked for torrent %x that isn't running", handshake.infoHash)
+	}
+
+	log.Debug().Msg(fmt.Sprintf("[PeerServer] %s running %s connected for %s", conn.RemoteAddr(), parsePeerClient(handshake.peerId), torrent.meta.Name))
+
+	conn = newRateLimitedConn(conn, network.bandwidth, network.bandwidthForTorrent(torrent.meta.InfoHash))
+	extensions := handshake.reserved[5]&extensionProtocolBit != 0
+	reply := createHandshakeMessage(handshake.infoHash, network.peerId)
+	if extensions {
+		reply[25] |= extensionProtocolBit
+	}
+	_, err = conn.Write(reply)
+	if err != nil {
+		return fmt.Errorf("error sending handshake to peer: %w", err)
+	}
+
+	upload := &peerUpload{
+		conn:    conn,
+		address: conn.RemoteAddr().String(),
+		peerId:  string(handshake.peerId),
+		torrent: torrent,
+		fast:    handshake.reserved[7]&fastExtensionBit != 0,
+		choked:  true,
+		// peers that only have the info hash get the metadata from us
+		extensions: extensions,
+	}
+	s.register(upload)
+	defer s.unregister(upload)
+
+	return upload.run()
+}
+
+// register adds the peer to the choker of its torrent and starts the
+// choker for the first peer.
+func (s *PeerServer) register(upload *peerUpload) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infoHash := upload.torrent.meta.InfoHash
+	served, ok := s.served[infoHash]
+	if !ok {
+		served = &servedTorrent{
+			choker: newChoker(defaultUploadSlots, time.Now()),
+			peers:  make(map[string]*peerUpload),
+			done:   make(chan struct{}),
+		}
+		s.served[infoHash] = served
+
+		go served.choker.run(served.done, upload.torrent.seeding, func(decision ChokeDecision) {
+			s.applyChoke(served, decision)
+		})
+	}
+
+	served.peers[upload.address] = upload
+	served.choker.addPeer(upload.address, time.Now())
+	upload.choker = served.choker
+}
+
+// unregister frees the peer's upload slot and stops the choker of the
+// torrent once its last peer is gone.
+func (s *PeerServer) unregister(upload *peerUpload) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infoHash := upload.torrent.meta.InfoHash
+	served := s.served[infoHash]
+	delete(served.peers, upload.address)
+	served.choker.removePeer(upload.address)
+
+	if len(served.peers) == 0 {
+		close(served.done)
+		delete(s.served, infoHash)
+	}
+}
+
+// recordDownload tells the choker of the torrent that n bytes of verified
+// piece data came from the peer. Our downloads use their own connections,
+// so the peer is found by its peer ID instead of its address.
+func (s *PeerServer) recordDownload(infoHash string, peerId []byte, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	served, ok := s.served[infoHash]
+	if !ok {
+		return
+	}
+	for address, upload := range served.peers {
+		if upload.peerId == string(peerId) {
+			served.choker.recordDownload(address, n, time.Now())
+		}
+	}
+}
+
+func (s *PeerServer) applyChoke(served *servedTorrent, decision ChokeDecision) {
+	s.mu.Lock()
+	upload, ok := served.peers[decision.address]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	// a failed write ends the peer's read loop as well
+	if err := upload.setChoked(decision.choke); err != nil {
+		log.Debug().Msg(fmt.Sprintf("[PeerServer] failed to choke %s: %s", decision.address, err))
+	}
+}
+
+// acceptEncryption tells plaintext handshakes from encrypted ones by their
+// first bytes and runs the encrypted handshake for the latter. It returns
+// the info hash the peer picked during the encrypted handshake, or nil for
+// a plaintext connection.
+func (s *PeerServer) acceptEncryption(conn net.Conn) (net.Conn, []byte, error) {
+	policy := s.session.network.encryption
+
+	// the bytes peeked at are still read by whoever uses the connection next
+	reader := bufio.NewReader(conn)
+	prefix, err := reader.Peek(1 + len(protocolString))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading handshake from peer: %w", err)
+	}
+	buffered := &mseConn{Conn: conn, reader: reader, writer: conn}
+
+	plaintext := prefix[0] == byte(len(protocolString)) && string(prefix[1:]) == protocolString
+	switch {
+	case plaintext && policy == ENCRYPTION_REQUIRE:
+		return nil, nil, errors.New("peer connected in plaintext but encryption is required")
+	case plaintext:
+		return buffered, nil, nil
+	case policy == ENCRYPTION_DISABLE:
+		return nil, nil, errors.New("peer connected with encryption but encryption is disabled")
+	}
+
+	return mseAccept(buffered, s.session.infoHashes(), policy)
+}
+
+// run tells the peer which pieces we have and serves its requests.
+func (u *peerUpload) run() error {
+	err := u.send(u.createPiecesMessage())
+	if err != nil {
+		return err
+	}
+	if u.fast {
+		err = u.sendAllowedFast()
+		if err != nil {
+			return err
+		}
+	}
+	if u.extensions {
+		err = u.send(createExtendedHandshake(len(u.torrent.meta.Info)))
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		payload, err := readMessage(u.conn, maxMessageLength(len(u.torrent.meta.Pieces)))
+		if err != nil {
+			return err
+		}
+
+		switch payload[0] {
+		case interested:
+			u.choker.setInterested(u.address, true)
+			if u.choker.fillSlot(u.address) {
+				err = u.setChoked(false)
+			}
+		case notInterested:
+			// the next rechoke gives the slot to someone else
+			u.choker.setInterested(u.address, false)
+		case request:
+			err = u.handleRequest(payload)
+		case hashRequest:
+			var response []byte
+			response, err = createHashResponse(u.torrent.meta, payload)
+			if err == nil {
+				err = u.send(response)
+			}
+		case extended:
+			if u.extensions {
+				err = u.handleExtended(payload)
+			}
+		}
+		// blocks are sent right away, so there is nothing to cancel and
+		// what the peer has doesn't matter while it only downloads
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// createPiecesMessage returns the bitfield of the pieces we have, fast
+// peers get have all or have none instead if that says the same.
+func (u *peerUpload) createPiecesMessage() []byte {
+	u.torrent.mu.Lock()
+	defer u.torrent.mu.Unlock()
+
+	count := len(u.torrent.meta.Pieces)
+	switch {
+	case u.fast && len(u.torrent.pieces) == count:
+		return []byte{0, 0, 0, 1, haveAll}
+	case u.fast && len(u.torrent.pieces) == 0:
+		return []byte{0, 0, 0, 1, haveNone}
+	}
+
+	pieces := make(Bitfield, (count+7)/8)
+	for index := range u.torrent.pieces {
+		pieces.setPiece(index)
+	}
+	message := binary.BigEndian.AppendUint32(nil, uint32(1+len(pieces)))
+	message = append(message, bitfield)
+	return append(message, pieces...)
+}
+
+// sendAllowedFast lets the peer download the pieces of its allowed fast set
+// that we have while it is choked, so a new peer gets its first pieces
+// without waiting for an upload slot.
+func (u *peerUpload) sendAllowedFast() error {
+	// the set is only defined for IP addresses
+	address, err := netip.ParseAddrPort(u.address)
+	if err != nil {
+		return nil
+	}
+
+	meta := u.torrent.meta
+	u.allowed = make(map[int]bool)
+	for _, index := range generateAllowedFastSet(allowedFastSetSize, len(meta.Pieces), meta.InfoHashBytes, address.Addr()) {
+		u.torrent.mu.Lock()
+		_, ok := u.torrent.pieces[index]
+		u.torrent.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		u.allowed[index] = true
+		message := binary.BigEndian.AppendUint32([]byte{0, 0, 0, 5, allowedFast}, uint32(index))
+		if err := u.send(message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleRequest sends the requested block. Requests that can't be served
+// are rejected for fast peers and dropped for the others, who know that a
+// choke drops their requests.
+func (u *peerUpload) handleRequest(payload []byte) error {
+	if len(payload) != 13 {
+		return fmt.Errorf("request message has length %d, expected 13", len(payload))
+	}
+	index := int(binary.BigEndian.Uint32(payload[1:5]))
+	begin := int(binary.BigEndian.Uint32(payload[5:9]))
+	length := int(binary.BigEndian.Uint32(payload[9:13]))
+	if length == 0 || length > defaultBlockSize {
+		return fmt.Errorf("peer requested a block of %d bytes, at most %d are served", length, defaultBlockSize)
+	}
+
+	u.torrent.mu.Lock()
+	data, ok := u.torrent.pieces[index]
+	u.torrent.mu.Unlock()
+
+	u.mu.Lock()
+	choked := u.choked && !u.allowed[index]
+	u.mu.Unlock()
+
+	if choked || !ok || begin+length > len(data) {
+		if u.fast {
+			return u.send(append([]byte{0, 0, 0, 13, rejectRequest}, payload[1:]...))
+		}
+		if choked {
+			return nil
+		}
+		return fmt.Errorf("peer requested piece %d that we don't have", index)
+	}
+
+	message := binary.BigEndian.AppendUint32(nil, uint32(9+length))
+	message = append(message, piece)
+	message = append(message, payload[1:9]...)
+	err := u.send(append(message, data[begin:begin+length]...))
+	if err != nil {
+		return err
+	}
+
+	u.choker.recordUpload(u.address, length)
+	return nil
+}
+
+// handleExtended remembers the id the peer receives metadata messages with
+// and answers its metadata requests. Other extensions are ignored.
+func (u *peerUpload) handleExtended(payload []byte) error {
+	id, dict, _, err := parseExtendedMessage(payload)
+	if err != nil {
+		return err
+	}
+
+	switch id {
+	case extendedHandshake:
+		u.metadataId = getMetadataId(dict)
+	case utMetadataId:
+		piece, _ := dict["piece"].(int)
+		if dict["msg_type"] != metadataRequest || u.metadataId == 0 {
+			return nil
+		}
+		return u.send(createMetadataResponse(u.torrent.meta.Info, piece, byte(u.metadataId)))
+	}
+	return nil
+}
+
+// setChoked sends a choke or unchoke message if the state changes.
+func (u *peerUpload) setChoked(choked bool) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.choked == choked {
+		return nil
+	}
+	u.choked = choked
+
+	id := byte(unchoke)
+	if choked {
+		id = choke
+	}
+	return sendMessageToPeer(u.conn, []byte{0, 0, 0, 1, id})
+}
+
+func (u *peerUpload) send(message []byte) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return sendMessageToPeer(u.conn, message)
+}
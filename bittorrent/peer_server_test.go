@@ -0,0 +1,229 @@
+package bittorrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestUploader returns a client that downloaded the torrent of the swarm
+// and now uploads it.
+func newTestUploader(t *testing.T, swarm *testSwarm, options ...Option) *Client {
+	uploader, err := NewClient(append(options, WithListenPort(0))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { uploader.Close() })
+
+	torrent, err := uploader.AddTorrent([]byte(swarm.torrent), filepath.Join(t.TempDir(), "swarm.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := torrent.Wait(); err != nil {
+		t.Fatalf("Wait() unexpected error %v", err)
+	}
+	return uploader
+}
+
+// connectTestPeer connects to the client that has all pieces of the
+// torrent and returns the pieces it allows the peer to download while
+// choked.
+func connectTestPeer(t *testing.T, client *Client, meta TorrentMeta, peerId string) (net.Conn, map[int]bool) {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", client.network.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write(createHandshakeMessage(meta.InfoHashBytes, []byte(peerId))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readHandshakeMessage(conn); err != nil {
+		t.Fatal(err)
+	}
+	// the handshake announces the Fast extension
+	if payload, err := readMessage(conn, maxMessageLength(len(meta.Pieces))); err != nil || payload[0] != haveAll {
+		t.Fatalf("expected have all, got %v %v", payload, err)
+	}
+
+	allowed := make(map[int]bool)
+	for range min(allowedFastSetSize, len(meta.Pieces)) {
+		payload, err := readMessage(conn, maxMessageLength(len(meta.Pieces)))
+		if err != nil || payload[0] != allowedFast {
+			t.Fatalf("expected allowed fast, got %v %v", payload, err)
+		}
+		allowed[int(binary.BigEndian.Uint32(payload[1:5]))] = true
+	}
+	return conn, allowed
+}
+
+func TestPeerServerUpload(t *testing.T) {
+	tests := []struct {
+		name     string
+		uploader EncryptionPolicy
+		leecher  EncryptionPolicy
+	}{
+		{
+			name:     "plaintext",
+			uploader: ENCRYPTION_DISABLE,
+			leecher:  ENCRYPTION_DISABLE,
+		},
+		{
+			name:     "encrypted",
+			uploader: ENCRYPTION_PREFER,
+			leecher:  ENCRYPTION_REQUIRE,
+		},
+		{
+			name:     "plaintext accepted when encryption is preferred",
+			uploader: ENCRYPTION_PREFER,
+			leecher:  ENCRYPTION_DISABLE,
+		},
+	}
+
+	data := make([]byte, 5*defaultBlockSize+100)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			swarm := newTestSwarm(t, data, 2*defaultBlockSize)
+			seeder := swarm.addSeeder(SeederFaults{})
+			uploader := newTestUploader(t, swarm, WithEncryption(test.uploader))
+
+			// the seeder leaves, so the uploader is the only peer left
+			infoHash := string(swarm.meta.InfoHashBytes)
+			_, err := swarm.tracker.announce(AnnounceRequest{infoHash: infoHash, peerId: seeder.peerId, address: seeder.address, event: "stopped"}, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			address := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(uploader.network.port))
+			_, err = swarm.tracker.announce(AnnounceRequest{infoHash: infoHash, peerId: string(uploader.network.peerId), address: address}, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			connections := seeder.connections.Load()
+
+			got := swarm.download(WithEncryption(test.leecher), WithListenPort(0))
+			if !bytes.Equal(got, data) {
+				t.Errorf("downloaded data differs from the uploader's")
+			}
+			if seeder.connections.Load() != connections {
+				t.Errorf("leecher connected to the seeder that left the swarm")
+			}
+		})
+	}
+}
+
+func TestPeerServerUploadSlots(t *testing.T) {
+	data := make([]byte, 3*defaultBlockSize)
+	swarm := newTestSwarm(t, data, defaultBlockSize)
+	swarm.addSeeder(SeederFaults{})
+	uploader := newTestUploader(t, swarm)
+
+	unchoked := 0
+	for i := range defaultUploadSlots + 1 {
+		conn, _ := connectTestPeer(t, uploader, swarm.meta, fmt.Sprintf("-qB4520-leecher%05d", i))
+		if err := sendMessageToPeer(conn, []byte{0, 0, 0, 1, interested}); err != nil {
+			t.Fatal(err)
+		}
+
+		// readMessage would replace the deadline with its own
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		message := make([]byte, 5)
+		_, err := io.ReadFull(conn, message)
+		switch {
+		case err == nil && bytes.Equal(message, []byte{0, 0, 0, 1, unchoke}):
+			unchoked++
+		case errors.Is(err, os.ErrDeadlineExceeded):
+		default:
+			t.Fatalf("expected unchoke or nothing, got %v %v", message, err)
+		}
+	}
+
+	// the optimistic slot is only given away by the rechoke
+	if unchoked != defaultUploadSlots-1 {
+		t.Errorf("expected %d unchoked peers, got %d", defaultUploadSlots-1, unchoked)
+	}
+}
+
+func TestPeerServerAllowedFast(t *testing.T) {
+	data := make([]byte, 12*defaultBlockSize)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	swarm := newTestSwarm(t, data, defaultBlockSize)
+	swarm.addSeeder(SeederFaults{})
+	uploader := newTestUploader(t, swarm)
+
+	conn, allowed := connectTestPeer(t, uploader, swarm.meta, "-qB4520-leecher00001")
+	want := generateAllowedFastSet(allowedFastSetSize, len(swarm.meta.Pieces), swarm.meta.InfoHashBytes, netip.MustParseAddr("127.0.0.1"))
+	if len(allowed) != len(want) {
+		t.Fatalf("got allowed fast set %v, want %v", allowed, want)
+	}
+
+	for index := range swarm.meta.Pieces {
+		// the peer stays choked since it never says it is interested
+		request := binary.BigEndian.AppendUint32([]byte{0, 0, 0, 13, request}, uint32(index))
+		request = binary.BigEndian.AppendUint32(request, 0)
+		request = binary.BigEndian.AppendUint32(request, uint32(defaultBlockSize))
+		if err := sendMessageToPeer(conn, request); err != nil {
+			t.Fatal(err)
+		}
+
+		payload, err := readMessage(conn, maxMessageLength(len(swarm.meta.Pieces)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case allowed[index] && payload[0] != piece:
+			t.Errorf("piece %d is allowed fast, got message %d instead of the block", index, payload[0])
+		case allowed[index] && !bytes.Equal(payload[9:], data[index*defaultBlockSize:(index+1)*defaultBlockSize]):
+			t.Errorf("piece %d has the wrong data", index)
+		case !allowed[index] && payload[0] != rejectRequest:
+			t.Errorf("piece %d isn't allowed fast, got message %d instead of a reject", index, payload[0])
+		}
+	}
+}
+
+func TestPeerServerRecordDownload(t *testing.T) {
+	data := make([]byte, 3*defaultBlockSize)
+	swarm := newTestSwarm(t, data, defaultBlockSize)
+	swarm.addSeeder(SeederFaults{})
+	uploader := newTestUploader(t, swarm)
+
+	torrent, err := uploader.session.getTorrent(swarm.meta.InfoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !torrent.seeding() {
+		t.Errorf("expected the downloaded torrent to be seeding")
+	}
+
+	uploading, _ := connectTestPeer(t, uploader, swarm.meta, "-qB4520-leecher00001")
+	idle, _ := connectTestPeer(t, uploader, swarm.meta, "-qB4520-leecher00002")
+
+	// pieces we download from a peer are credited to its upload connection
+	uploader.server.recordDownload(swarm.meta.InfoHash, []byte("-qB4520-leecher00001"), 5000)
+
+	uploader.server.mu.Lock()
+	choker := uploader.server.served[swarm.meta.InfoHash].choker
+	uploader.server.mu.Unlock()
+	choker.mu.Lock()
+	defer choker.mu.Unlock()
+	if downloaded := choker.peers[uploading.LocalAddr().String()].downloaded; downloaded != 5000 {
+		t.Errorf("peer that uploaded to us has %d bytes downloaded, expected 5000", downloaded)
+	}
+	if downloaded := choker.peers[idle.LocalAddr().String()].downloaded; downloaded != 0 {
+		t.Errorf("idle peer has %d bytes downloaded, expected 0", downloaded)
+	}
+}
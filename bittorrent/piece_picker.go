@@ -0,0 +1,178 @@
+package bittorrent
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// PiecePicker hands out the pieces that still have to be downloaded.
+// Pieces are picked in queue order, in sequential mode the lowest piece
+// goes first and while a stream is reading, the pieces from the read
+// position onwards take precedence over everything else.
+type PiecePicker struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	queue      []Piece
+	sequential bool
+	position   int
+	closed     bool
+	// workers is the number of peers taking pieces, waiting the number of
+	// them blocked in next
+	workers int
+	waiting int
+}
+
+func newPiecePicker(pieces []Piece, sequential bool) *PiecePicker {
+	picker := &PiecePicker{
+		queue:      append([]Piece{}, pieces...),
+		sequential: sequential,
+		position:   -1,
+	}
+	picker.cond = sync.NewCond(&picker.mu)
+	return picker
+}
+
+// next blocks until a piece is available and returns false once the picker
+// is closed.
+func (p *PiecePicker) next() (Piece, bool) {
+	return p.nextExcept(nil)
+}
+
+// nextExcept is next for a peer that must not get the excluded pieces,
+// e.g. because it sent corrupt data for them before. It also returns false
+// once every worker is waiting for pieces that only they have excluded,
+// since none of them would ever get one.
+func (p *PiecePicker) nextExcept(excluded map[int]bool) (Piece, bool) {
+	return p.nextFor(excluded, nil)
+}
+
+// nextFor is nextExcept for a peer that prefers some of the pieces, e.g.
+// the ones it suggested or allows us to download while it chokes us. The
+// preference is ignored while a stream reads and in sequential mode.
+func (p *PiecePicker) nextFor(excluded map[int]bool, preferred map[int]bool) (Piece, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	index := p.pick(excluded, preferred)
+	p.waiting++
+	for index < 0 && !p.closed && !p.stalled() {
+		p.cond.Wait()
+		index = p.pick(excluded, preferred)
+	}
+	p.waiting--
+	if index < 0 || p.closed {
+		// the other waiters have to see the stall as well
+		p.cond.Broadcast()
+		return Piece{}, false
+	}
+
+	piece := p.queue[index]
+	p.queue = append(p.queue[:index], p.queue[index+1:]...)
+
+	return piece, true
+}
+
+// pick returns the index in the queue of the piece to download next, or -1
+// if there is none that isn't excluded.
+func (p *PiecePicker) pick(excluded map[int]bool, preferred map[int]bool) int {
+	if p.position < 0 && !p.sequential {
+		// pieces the peer prefers go first, otherwise the queue order holds
+		first := -1
+		for i, piece := range p.queue {
+			if excluded[piece.number] {
+				continue
+			}
+			if preferred[piece.number] {
+				return i
+			}
+			if first < 0 {
+				first = i
+			}
+		}
+		return first
+	}
+
+	// the closest piece at or after the read position, otherwise the lowest one
+	best := -1
+	for i, piece := range p.queue {
+		if excluded[piece.number] {
+			continue
+		}
+
+		ahead := piece.number >= p.position
+		if best == -1 {
+			best = i
+			continue
+		}
+
+		bestAhead := p.queue[best].number >= p.position
+		if ahead != bestAhead {
+			if ahead {
+				best = i
+			}
+		} else if piece.number < p.queue[best].number {
+			best = i
+		}
+	}
+	return best
+}
+
+// stalled reports whether all workers wait while pieces are left, which
+// means each of them excluded the pieces that are left.
+func (p *PiecePicker) stalled() bool {
+	return p.workers > 0 && p.waiting >= p.workers && len(p.queue) > 0
+}
+
+// addWorker registers a peer that takes pieces from the picker until it
+// calls removeWorker.
+func (p *PiecePicker) addWorker() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.workers++
+}
+
+func (p *PiecePicker) removeWorker() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.workers--
+	// the workers left might all be waiting now
+	p.cond.Broadcast()
+}
+
+func (p *PiecePicker) remaining() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.queue)
+}
+
+// requeue puts back a piece that failed to download.
+func (p *PiecePicker) requeue(piece Piece) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.queue = append(p.queue, piece)
+	// the first waiter might have excluded the piece
+	p.cond.Broadcast()
+	log.Debug().Msg(fmt.Sprintf("added piece %d back to job queue", piece.number))
+}
+
+// setPosition moves the read position to the given piece, -1 clears it.
+func (p *PiecePicker) setPosition(piece int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.position = piece
+}
+
+func (p *PiecePicker) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	p.cond.Broadcast()
+}
@@ -0,0 +1,172 @@
+package bittorrent
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func pickAll(picker *PiecePicker, preferred map[int]bool) []int {
+	var picked []int
+	for picker.remaining() > 0 {
+		piece, _ := picker.nextFor(nil, preferred)
+		picked = append(picked, piece.number)
+	}
+	return picked
+}
+
+func TestPiecePickerOrder(t *testing.T) {
+	pieces := []Piece{{3, WAITING}, {1, WAITING}, {2, WAITING}, {0, WAITING}}
+
+	tests := []struct {
+		name       string
+		sequential bool
+		position   int
+		preferred  map[int]bool
+		expected   []int
+	}{
+		{
+			name:     "Queue order",
+			position: -1,
+			expected: []int{3, 1, 2, 0},
+		},
+		{
+			name:       "Sequential",
+			sequential: true,
+			position:   -1,
+			expected:   []int{0, 1, 2, 3},
+		},
+		{
+			name:     "Read position first",
+			position: 2,
+			expected: []int{2, 3, 0, 1},
+		},
+		{
+			name:      "Preferred first",
+			position:  -1,
+			preferred: map[int]bool{2: true, 0: true},
+			expected:  []int{2, 0, 3, 1},
+		},
+		{
+			name:       "Sequential ignores preferred",
+			sequential: true,
+			position:   -1,
+			preferred:  map[int]bool{2: true},
+			expected:   []int{0, 1, 2, 3},
+		},
+		{
+			name:      "Read position ignores preferred",
+			position:  2,
+			preferred: map[int]bool{0: true},
+			expected:  []int{2, 3, 0, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			picker := newPiecePicker(pieces, tt.sequential)
+			picker.setPosition(tt.position)
+
+			if picked := pickAll(picker, tt.preferred); !reflect.DeepEqual(picked, tt.expected) {
+				t.Errorf("picked %v, expected %v", picked, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPiecePickerRequeue(t *testing.T) {
+	picker := newPiecePicker([]Piece{{0, WAITING}, {1, WAITING}}, false)
+
+	first, _ := picker.next()
+	picker.requeue(first)
+
+	if picked := pickAll(picker, nil); !reflect.DeepEqual(picked, []int{1, 0}) {
+		t.Errorf("picked %v, expected requeued piece last", picked)
+	}
+}
+
+func TestPiecePickerExcluded(t *testing.T) {
+	picker := newPiecePicker([]Piece{{0, WAITING}, {1, WAITING}}, false)
+
+	piece, _ := picker.nextExcept(map[int]bool{0: true})
+	if piece.number != 1 {
+		t.Fatalf("picked %d, expected the piece that isn't excluded", piece.number)
+	}
+
+	// a peer that excluded every piece left waits for one it may have
+	picked := make(chan int)
+	go func() {
+		piece, _ := picker.nextExcept(map[int]bool{0: true})
+		picked <- piece.number
+	}()
+
+	select {
+	case number := <-picked:
+		t.Fatalf("picked excluded piece %d", number)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	picker.requeue(piece)
+	select {
+	case number := <-picked:
+		if number != 1 {
+			t.Errorf("picked %d, expected the requeued piece", number)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the requeued piece to be picked")
+	}
+}
+
+func TestPiecePickerClose(t *testing.T) {
+	picker := newPiecePicker(nil, false)
+
+	picked := make(chan bool)
+	go func() {
+		_, ok := picker.next()
+		picked <- ok
+	}()
+
+	select {
+	case <-picked:
+		t.Fatalf("expected next to block on an empty picker")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	picker.close()
+	if ok := <-picked; ok {
+		t.Errorf("expected next to fail once the picker is closed")
+	}
+}
+
+func TestPiecePickerStalled(t *testing.T) {
+	picker := newPiecePicker([]Piece{{0, WAITING}, {1, WAITING}}, false)
+	picker.addWorker()
+	picker.addWorker()
+
+	// both workers sent corrupt data for piece 1
+	excluded := map[int]bool{1: true}
+	if piece, _ := picker.nextExcept(excluded); piece.number != 0 {
+		t.Fatalf("picked %d, expected piece 0", piece.number)
+	}
+
+	// the second worker waits while the first one might still fail piece 0
+	picked := make(chan bool)
+	go func() {
+		_, ok := picker.nextExcept(excluded)
+		picked <- ok
+	}()
+	select {
+	case <-picked:
+		t.Fatalf("expected nextExcept to wait while a worker has a piece")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// once the first worker finished piece 0, no one may take piece 1
+	if _, ok := picker.nextExcept(excluded); ok {
+		t.Errorf("expected nextExcept to fail once every worker excluded the pieces left")
+	}
+	picker.removeWorker()
+	if ok := <-picked; ok {
+		t.Errorf("expected the waiting worker to give up as well")
+	}
+}
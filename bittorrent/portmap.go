@@ -0,0 +1,204 @@
+package bittorrent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	PROTOCOL_TCP = "TCP"
+	PROTOCOL_UDP = "UDP"
+)
+
+// portMappingLifetime is asked for with every mapping, mappings are renewed
+// when half of the granted lifetime is over.
+const portMappingLifetime = time.Hour
+
+// portMappingRetry is the delay before a failed renewal is tried again.
+var portMappingRetry = time.Minute
+
+// PortMapper opens ports on a NAT gateway.
+type PortMapper interface {
+	// addMapping maps the external port to the internal port and returns the
+	// external address and the granted lifetime, zero for a permanent mapping.
+	// The gateway may assign a different external port.
+	addMapping(protocol string, internalPort int, externalPort int, lifetime time.Duration) (netip.AddrPort, time.Duration, error)
+	deleteMapping(protocol string, internalPort int, externalPort int) error
+	String() string
+}
+
+// PortMapping keeps the TCP and UDP mappings of a port alive until it is
+// closed. Both protocols get the same external port, so peers reach us
+// over TCP and uTP at the same address.
+type PortMapping struct {
+	mapper       PortMapper
+	internalPort int
+	mu           sync.Mutex
+	external     netip.AddrPort
+	closing      chan struct{}
+	done         chan struct{}
+	once         sync.Once
+}
+
+// discoverPortMapper finds a gateway that speaks UPnP IGD, PCP or NAT-PMP.
+// PCP and NAT-PMP need the default gateway, which is only known on Linux,
+// so other systems only try UPnP.
+func discoverPortMapper() (PortMapper, error) {
+	upnp, upnpErr := discoverUpnp(ssdpAddress)
+	if upnpErr == nil {
+		return upnp, nil
+	}
+
+	gateway, err := getDefaultGateway()
+	if err != nil {
+		return nil, errors.Join(upnpErr, err)
+	}
+	natPmp, natPmpErr := discoverNatPmp(netip.AddrPortFrom(gateway, natPmpPort))
+	if natPmpErr == nil {
+		return natPmp, nil
+	}
+	return nil, errors.Join(upnpErr, natPmpErr)
+}
+
+// newPortMapping maps the port and renews the mappings in the background.
+func newPortMapping(mapper PortMapper, internalPort int) (*PortMapping, error) {
+	m := &PortMapping{
+		mapper:       mapper,
+		internalPort: internalPort,
+		external:     netip.AddrPortFrom(netip.Addr{}, uint16(internalPort)),
+		closing:      make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+
+	lifetime, err := m.renew()
+	if err != nil {
+		return nil, err
+	}
+	log.Info().Msg(fmt.Sprintf("[PortMapping] mapped port %d to %s with %s", internalPort, m.externalAddress(), mapper))
+
+	go m.renewLoop(lifetime)
+	return m, nil
+}
+
+func (m *PortMapping) renew() (time.Duration, error) {
+	externalPort := int(m.externalAddress().Port())
+
+	external, lifetime, err := m.mapper.addMapping(PROTOCOL_TCP, m.internalPort, externalPort, portMappingLifetime)
+	if err != nil {
+		return 0, fmt.Errorf("failed to map TCP port %d: %w", m.internalPort, err)
+	}
+	_, udpLifetime, err := m.mapper.addMapping(PROTOCOL_UDP, m.internalPort, int(external.Port()), portMappingLifetime)
+	if err != nil {
+		return 0, fmt.Errorf("failed to map UDP port %d: %w", m.internalPort, err)
+	}
+
+	m.mu.Lock()
+	m.external = external
+	m.mu.Unlock()
+
+	if lifetime == 0 || udpLifetime != 0 && udpLifetime < lifetime {
+		lifetime = udpLifetime
+	}
+	return lifetime, nil
+}
+
+func (m *PortMapping) renewLoop(lifetime time.Duration) {
+	defer close(m.done)
+
+	wait := lifetime / 2
+	for {
+		// permanent mappings only need to be removed again
+		var renew <-chan time.Time
+		var timer *time.Timer
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			renew = timer.C
+		}
+
+		select {
+		case <-renew:
+		case <-m.closing:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+
+		granted, err := m.renew()
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("[PortMapping] %s", err))
+			wait = portMappingRetry
+		} else {
+			wait = granted / 2
+		}
+	}
+}
+
+// externalAddress is the address peers outside the NAT connect to. The
+// address is invalid if the gateway didn't tell it.
+func (m *PortMapping) externalAddress() netip.AddrPort {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.external
+}
+
+// Close stops renewing and removes the mappings from the gateway.
+func (m *PortMapping) Close() error {
+	m.once.Do(func() { close(m.closing) })
+	<-m.done
+
+	externalPort := int(m.externalAddress().Port())
+	return errors.Join(
+		m.mapper.deleteMapping(PROTOCOL_TCP, m.internalPort, externalPort),
+		m.mapper.deleteMapping(PROTOCOL_UDP, m.internalPort, externalPort),
+	)
+}
+
+// getLocalAddress returns the address of the interface that reaches the
+// gateway, which is what the gateway has to forward to.
+func getLocalAddress(gateway netip.Addr) (netip.Addr, error) {
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(gateway, 9)))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap(), nil
+}
+
+// getDefaultGateway reads the gateway of the default IPv4 route from the
+// Linux routing table in /proc/net/route. It fails on every other system.
+func getDefaultGateway() (netip.Addr, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to find the default gateway, which is only supported on Linux: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// columns are interface, destination and gateway in little endian hex
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		gateway, err := hex.DecodeString(fields[2])
+		if err != nil || len(gateway) != 4 {
+			continue
+		}
+		var ip [4]byte
+		binary.BigEndian.PutUint32(ip[:], binary.LittleEndian.Uint32(gateway))
+		return netip.AddrFrom4(ip), nil
+	}
+	return netip.Addr{}, errors.New("failed to find the default gateway")
+}
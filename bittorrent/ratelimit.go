@@ -0,0 +1,164 @@
+package bittorrent
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const rateMeterWindow = 5
+
+// RateLimiter is a token bucket holding at most one second worth of bytes.
+// A rate of 0 disables the limit.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   int
+	tokens float64
+	last   time.Time
+	meter  rateMeter
+}
+
+// rateMeter measures the transfer rate over the last few seconds.
+type rateMeter struct {
+	buckets [rateMeterWindow]int
+	second  int64
+}
+
+type BandwidthLimits struct {
+	download *RateLimiter
+	upload   *RateLimiter
+}
+
+func newRateLimiter(rate int) *RateLimiter {
+	return &RateLimiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+func newBandwidthLimits(download int, upload int) *BandwidthLimits {
+	return &BandwidthLimits{download: newRateLimiter(download), upload: newRateLimiter(upload)}
+}
+
+func (r *RateLimiter) setRate(rate int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.refill(time.Now())
+	r.rate = rate
+	if r.tokens > float64(rate) {
+		r.tokens = float64(rate)
+	}
+}
+
+func (r *RateLimiter) getRate() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.rate
+}
+
+func (r *RateLimiter) refill(now time.Time) {
+	r.tokens += now.Sub(r.last).Seconds() * float64(r.rate)
+	if r.tokens > float64(r.rate) {
+		r.tokens = float64(r.rate)
+	}
+	r.last = now
+}
+
+// transferRate returns how many bytes per second went through the limiter
+// recently, whether or not a limit is set.
+func (r *RateLimiter) transferRate() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.meter.rate(time.Now())
+}
+
+// wait blocks until n bytes may be transferred. Large requests are taken
+// from the bucket in chunks so a rate change applies to the remaining bytes.
+func (r *RateLimiter) wait(n int) {
+	r.mu.Lock()
+	r.meter.add(n, time.Now())
+	r.mu.Unlock()
+
+	for n > 0 {
+		r.mu.Lock()
+		if r.rate <= 0 {
+			r.mu.Unlock()
+			return
+		}
+
+		now := time.Now()
+		r.refill(now)
+
+		chunk := min(n, r.rate)
+		if r.tokens >= float64(chunk) {
+			r.tokens -= float64(chunk)
+			n -= chunk
+			r.mu.Unlock()
+			continue
+		}
+
+		missing := float64(chunk) - r.tokens
+		delay := time.Duration(missing / float64(r.rate) * float64(time.Second))
+		r.mu.Unlock()
+
+		time.Sleep(delay)
+	}
+}
+
+func (m *rateMeter) add(n int, now time.Time) {
+	m.advance(now)
+	m.buckets[m.second%rateMeterWindow] += n
+}
+
+func (m *rateMeter) rate(now time.Time) int {
+	m.advance(now)
+
+	// the current second is still filling up so it is left out
+	sum := 0
+	for i, bytes := range m.buckets {
+		if int64(i) != m.second%rateMeterWindow {
+			sum += bytes
+		}
+	}
+	return sum / (rateMeterWindow - 1)
+}
+
+// advance clears the buckets of the seconds that passed since the last call.
+func (m *rateMeter) advance(now time.Time) {
+	second := now.Unix()
+	for m.second < second {
+		m.second++
+		m.buckets[m.second%rateMeterWindow] = 0
+
+		if second-m.second >= rateMeterWindow {
+			m.buckets = [rateMeterWindow]int{}
+			m.second = second
+		}
+	}
+}
+
+// rateLimitedConn throttles a peer connection against every limit it
+// belongs to, e.g. the global limit and the limit of its torrent.
+type rateLimitedConn struct {
+	net.Conn
+	limits []*BandwidthLimits
+}
+
+func newRateLimitedConn(conn net.Conn, limits ...*BandwidthLimits) net.Conn {
+	return &rateLimitedConn{Conn: conn, limits: limits}
+}
+
+func (c *rateLimitedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	for _, limit := range c.limits {
+		limit.download.wait(n)
+	}
+	return n, err
+}
+
+func (c *rateLimitedConn) Write(p []byte) (int, error) {
+	for _, limit := range c.limits {
+		limit.upload.wait(len(p))
+	}
+	return c.Conn.Write(p)
+}
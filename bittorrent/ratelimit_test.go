@@ -0,0 +1,101 @@
+package bittorrent
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	limiter := newRateLimiter(0)
+
+	start := time.Now()
+	limiter.wait(10 * 1024 * 1024)
+
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("unlimited wait took %v", elapsed)
+	}
+}
+
+func TestRateLimiterThrottles(t *testing.T) {
+	limiter := newRateLimiter(10000)
+
+	start := time.Now()
+	// the first 10000 bytes come from the full bucket, the rest has to wait
+	limiter.wait(12000)
+
+	elapsed := time.Since(start)
+	if elapsed < 150*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("wait(12000) at 10000 B/s took %v, expected about 200ms", elapsed)
+	}
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	limiter := newRateLimiter(10)
+
+	done := make(chan struct{})
+	go func() {
+		limiter.wait(1000)
+		close(done)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	limiter.setRate(0)
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("wait did not return after the limit was removed")
+	}
+
+	if limiter.getRate() != 0 {
+		t.Errorf("getRate() = %d, expected 0", limiter.getRate())
+	}
+}
+
+func TestRateLimitedConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	limits := newBandwidthLimits(10000, 0)
+	conn := newRateLimitedConn(client, limits)
+
+	go func() {
+		server.Write(make([]byte, 12000))
+	}()
+
+	start := time.Now()
+	buf := make([]byte, 12000)
+	read := 0
+	for read < len(buf) {
+		n, err := conn.Read(buf[read:])
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		read += n
+	}
+
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("reading 12000 bytes at 10000 B/s took %v, expected about 200ms", elapsed)
+	}
+}
+
+func TestRateMeter(t *testing.T) {
+	meter := rateMeter{}
+	start := time.Unix(1000, 0)
+
+	meter.add(1000, start)
+	meter.add(3000, start.Add(time.Second))
+	meter.add(5000, start.Add(2*time.Second))
+
+	if rate := meter.rate(start.Add(2 * time.Second)); rate != 1000 {
+		t.Errorf("rate() = %d, expected 1000", rate)
+	}
+	if rate := meter.rate(start.Add(3 * time.Second)); rate != 2250 {
+		t.Errorf("rate() = %d, expected 2250", rate)
+	}
+	if rate := meter.rate(start.Add(time.Hour)); rate != 0 {
+		t.Errorf("rate() = %d, expected 0 after an idle hour", rate)
+	}
+}
@@ -0,0 +1,232 @@
+package bittorrent
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	udpProtocolId  = 0x41727101980
+	udpConnect     = 0
+	udpScrape      = 2
+	udpError       = 3
+	udpMaxAttempts = 3
+)
+
+// udpTrackerTimeout is the time to wait for the first response, it doubles with every retry
+var udpTrackerTimeout = 5 * time.Second
+
+type ScrapeResult struct {
+	Complete   int
+	Incomplete int
+	Downloaded int
+}
+
+// TrackerScrape is the result of scraping one of the trackers of a torrent.
+type TrackerScrape struct {
+	Tracker string
+	Result  ScrapeResult
+	Err     error
+}
+
+// ScrapeTorrent asks every tracker of the torrent in data for the swarm
+// statistics. Trackers that fail are reported with their error.
+func ScrapeTorrent(data []byte) ([]TrackerScrape, error) {
+	torrentMeta, err := ParseTorrent(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var scrapes []TrackerScrape
+	for _, tracker := range torrentMeta.getTrackers() {
+		result, err := scrapeTracker(tracker, torrentMeta.InfoHashBytes)
+		scrapes = append(scrapes, TrackerScrape{Tracker: tracker, Result: result, Err: err})
+	}
+	return scrapes, nil
+}
+
+// scrapeTracker asks the tracker for the swarm statistics of the torrent.
+func scrapeTracker(trackerUrl string, infoHash []byte) (ScrapeResult, error) {
+	parsed, err := url.Parse(trackerUrl)
+	if err != nil {
+		return ScrapeResult{}, fmt.Errorf("invalid tracker url %s", trackerUrl)
+	}
+
+	switch parsed.Scheme {
+	case "http", "https":
+		return scrapeHttpTracker(parsed, infoHash)
+	case "udp":
+		return scrapeUdpTracker(parsed.Host, infoHash)
+	default:
+		return ScrapeResult{}, fmt.Errorf("unsupported tracker scheme %s", parsed.Scheme)
+	}
+}
+
+// getScrapeUrl derives the scrape url from the announce url, which is only
+// possible if the last path segment starts with announce.
+func getScrapeUrl(announceUrl *url.URL) (*url.URL, error) {
+	dir, last := path.Split(announceUrl.Path)
+	if !strings.HasPrefix(last, "announce") {
+		return nil, errors.New("tracker does not support scrape")
+	}
+
+	scrapeUrl := *announceUrl
+	scrapeUrl.Path = dir + "scrape" + strings.TrimPrefix(last, "announce")
+	return &scrapeUrl, nil
+}
+
+func scrapeHttpTracker(announceUrl *url.URL, infoHash []byte) (ScrapeResult, error) {
+	scrapeUrl, err := getScrapeUrl(announceUrl)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+
+	query := scrapeUrl.Query()
+	query.Add("info_hash", string(infoHash))
+	scrapeUrl.RawQuery = query.Encode()
+
+	client := http.Client{Timeout: 30 * time.Second}
+	response, err := client.Get(scrapeUrl.String())
+	if err != nil {
+		return ScrapeResult{}, fmt.Errorf("failed to get scrape response from tracker: %w", err)
+	}
+
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return ScrapeResult{}, fmt.Errorf("failed to read scrape response from tracker: %w", err)
+	}
+
+	return parseScrapeResponse(string(body), infoHash)
+}
+
+func parseScrapeResponse(body string, infoHash []byte) (ScrapeResult, error) {
+	decodedBody, err := decodeBencode(body)
+	if err != nil {
+		return ScrapeResult{}, fmt.Errorf("failed to decode scrape response from tracker: %w", err)
+	}
+
+	response, ok := decodedBody.(map[string]interface{})
+	if !ok {
+		return ScrapeResult{}, errors.New("scrape response is not a dictionary")
+	}
+
+	if reason, ok := response["failure reason"]; ok {
+		return ScrapeResult{}, &TrackerFailureError{Reason: fmt.Sprint(reason)}
+	}
+
+	files, _ := response["files"].(map[string]interface{})
+	stats, ok := files[string(infoHash)].(map[string]interface{})
+	if !ok {
+		return ScrapeResult{}, errors.New("tracker does not know the torrent")
+	}
+
+	result := ScrapeResult{}
+	result.Complete, _ = stats["complete"].(int)
+	result.Incomplete, _ = stats["incomplete"].(int)
+	result.Downloaded, _ = stats["downloaded"].(int)
+	return result, nil
+}
+
+// scrapeUdpTracker scrapes a BEP 15 UDP tracker.
+func scrapeUdpTracker(address string, infoHash []byte) (ScrapeResult, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return ScrapeResult{}, fmt.Errorf("error connecting to tracker: %w", err)
+	}
+	defer conn.Close()
+
+	connectionId, err := udpConnectToTracker(conn)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+
+	request := binary.BigEndian.AppendUint64(nil, connectionId)
+	request = binary.BigEndian.AppendUint32(request, udpScrape)
+	request = binary.BigEndian.AppendUint32(request, 0)
+	request = append(request, infoHash...)
+
+	response, err := udpTrackerRoundTrip(conn, request, udpScrape, 20)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+
+	return ScrapeResult{
+		Complete:   int(binary.BigEndian.Uint32(response[8:12])),
+		Downloaded: int(binary.BigEndian.Uint32(response[12:16])),
+		Incomplete: int(binary.BigEndian.Uint32(response[16:20])),
+	}, nil
+}
+
+func udpConnectToTracker(conn net.Conn) (uint64, error) {
+	request := binary.BigEndian.AppendUint64(nil, udpProtocolId)
+	request = binary.BigEndian.AppendUint32(request, udpConnect)
+	request = binary.BigEndian.AppendUint32(request, 0)
+
+	response, err := udpTrackerRoundTrip(conn, request, udpConnect, 16)
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint64(response[8:16]), nil
+}
+
+// udpTrackerRoundTrip sends the request with a fresh transaction id, which
+// goes into bytes 12 to 16, and waits for the matching response. Lost
+// packets are resent with a doubling timeout.
+func udpTrackerRoundTrip(conn net.Conn, request []byte, action uint32, minLength int) ([]byte, error) {
+	transactionId := make([]byte, 4)
+	if _, err := rand.Read(transactionId); err != nil {
+		return nil, err
+	}
+	copy(request[12:16], transactionId)
+
+	timeout := udpTrackerTimeout
+	buf := make([]byte, 2048)
+
+	for attempt := 0; attempt < udpMaxAttempts; attempt++ {
+		if _, err := conn.Write(request); err != nil {
+			return nil, fmt.Errorf("error sending request to tracker: %w", err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		timeout *= 2
+
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return nil, fmt.Errorf("error reading response from tracker: %w", err)
+			}
+
+			// responses to earlier attempts or other requests are ignored
+			if n < 8 || string(buf[4:8]) != string(transactionId) {
+				continue
+			}
+
+			responseAction := binary.BigEndian.Uint32(buf[0:4])
+			if responseAction == udpError {
+				return nil, &TrackerFailureError{Reason: string(buf[8:n])}
+			}
+			if responseAction != action || n < minLength {
+				return nil, errors.New("invalid response from tracker")
+			}
+
+			return append([]byte{}, buf[:n]...), nil
+		}
+	}
+
+	return nil, errors.New("tracker did not respond")
+}
@@ -0,0 +1,143 @@
+package bittorrent
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestGetScrapeUrl(t *testing.T) {
+	tests := []struct {
+		announce string
+		want     string
+		wantErr  bool
+	}{
+		{announce: "http://example.com/announce", want: "http://example.com/scrape"},
+		{announce: "http://example.com/x/announce", want: "http://example.com/x/scrape"},
+		{announce: "http://example.com/announce.php?passkey=1", want: "http://example.com/scrape.php?passkey=1"},
+		{announce: "http://example.com/a", wantErr: true},
+		{announce: "http://example.com/announce?x=2/4", want: "http://example.com/scrape?x=2/4"},
+		{announce: "http://example.com/announce/x", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.announce, func(t *testing.T) {
+			announceUrl, _ := url.Parse(tt.announce)
+			got, err := getScrapeUrl(announceUrl)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getScrapeUrl() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.String() != tt.want {
+				t.Errorf("getScrapeUrl() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScrapeHttpTracker(t *testing.T) {
+	infoHash := []byte("12345678901234567890")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" || r.URL.Query().Get("info_hash") != string(infoHash) {
+			w.Write([]byte("d14:failure reason13:wrong requeste"))
+			return
+		}
+		w.Write([]byte("d5:filesd20:" + string(infoHash) + "d8:completei5e10:downloadedi50e10:incompletei10eeee"))
+	}))
+	defer server.Close()
+
+	result, err := scrapeTracker(server.URL+"/announce", infoHash)
+	if err != nil {
+		t.Fatalf("scrapeTracker() unexpected error %v", err)
+	}
+	if result != (ScrapeResult{Complete: 5, Incomplete: 10, Downloaded: 50}) {
+		t.Errorf("scrapeTracker() = %+v", result)
+	}
+
+	_, err = scrapeTracker(server.URL+"/announce", []byte("09876543210987654321"))
+	var failure *TrackerFailureError
+	if !errors.As(err, &failure) {
+		t.Errorf("scrapeTracker() error = %v, expected tracker failure", err)
+	}
+}
+
+// runFakeUdpTracker answers connect and scrape requests like a BEP 15
+// tracker. The first packet is dropped to exercise the retry.
+func runFakeUdpTracker(t *testing.T, scrapeResponse func(transactionId []byte) []byte) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 2048)
+		dropped := false
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if !dropped {
+				dropped = true
+				continue
+			}
+
+			transactionId := buf[12:16]
+			var response []byte
+			if n == 16 && binary.BigEndian.Uint64(buf[0:8]) == udpProtocolId {
+				response = binary.BigEndian.AppendUint32(nil, udpConnect)
+				response = append(response, transactionId...)
+				response = binary.BigEndian.AppendUint64(response, 0xC0FFEE)
+			} else if binary.BigEndian.Uint64(buf[0:8]) == 0xC0FFEE {
+				response = scrapeResponse(transactionId)
+			}
+			conn.WriteTo(response, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestScrapeUdpTracker(t *testing.T) {
+	defer func(timeout time.Duration) { udpTrackerTimeout = timeout }(udpTrackerTimeout)
+	udpTrackerTimeout = 50 * time.Millisecond
+
+	address := runFakeUdpTracker(t, func(transactionId []byte) []byte {
+		response := binary.BigEndian.AppendUint32(nil, udpScrape)
+		response = append(response, transactionId...)
+		response = binary.BigEndian.AppendUint32(response, 7)
+		response = binary.BigEndian.AppendUint32(response, 70)
+		return binary.BigEndian.AppendUint32(response, 3)
+	})
+
+	result, err := scrapeTracker("udp://"+address+"/announce", []byte("12345678901234567890"))
+	if err != nil {
+		t.Fatalf("scrapeTracker() unexpected error %v", err)
+	}
+	if result != (ScrapeResult{Complete: 7, Downloaded: 70, Incomplete: 3}) {
+		t.Errorf("scrapeTracker() = %+v", result)
+	}
+}
+
+func TestScrapeUdpTrackerError(t *testing.T) {
+	defer func(timeout time.Duration) { udpTrackerTimeout = timeout }(udpTrackerTimeout)
+	udpTrackerTimeout = 50 * time.Millisecond
+
+	address := runFakeUdpTracker(t, func(transactionId []byte) []byte {
+		response := binary.BigEndian.AppendUint32(nil, udpError)
+		response = append(response, transactionId...)
+		return append(response, []byte("unknown torrent")...)
+	})
+
+	_, err := scrapeTracker("udp://"+address, []byte("12345678901234567890"))
+	var failure *TrackerFailureError
+	if !errors.As(err, &failure) || failure.Reason != "unknown torrent" {
+		t.Errorf("scrapeTracker() error = %v, expected tracker failure", err)
+	}
+}
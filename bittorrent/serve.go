@@ -0,0 +1,158 @@
+package bittorrent
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const DefaultServeAddress = ":8080"
+
+type IndexEntry struct {
+	Name   string
+	Href   string
+	Length int
+	IsDir  bool
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<ul>
+{{if .Parent}}<li><a href="{{.Parent}}">..</a></li>
+{{end}}{{range .Entries}}<li><a href="{{.Href}}">{{.Name}}{{if .IsDir}}/{{end}}</a>{{if not .IsDir}} ({{.Length}} bytes){{end}}</li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+// newServeHandler serves the files of the stream with Range support and a
+// directory index for every directory of the torrent's file tree. Reading
+// a file moves the download to the requested range.
+func newServeHandler(stream *TorrentStream) http.Handler {
+	files := make(map[string]int)
+	for i, file := range stream.meta.getFiles() {
+		if !file.padding {
+			files[strings.Join(file.path, "/")] = i
+		}
+	}
+
+	// modification time for conditional requests, the content never changes
+	started := time.Now()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestPath := strings.Trim(path.Clean(r.URL.Path), "/")
+
+		if index, ok := files[requestPath]; ok {
+			reader, err := stream.openFile(index)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			log.Debug().Msg(fmt.Sprintf("[Serve] serving %s %s", requestPath, r.Header.Get("Range")))
+			http.ServeContent(w, r, path.Base(requestPath), started, reader)
+			return
+		}
+
+		entries := getIndexEntries(stream.meta, requestPath)
+		if len(entries) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		data := struct {
+			Title   string
+			Parent  string
+			Entries []IndexEntry
+		}{Title: "/" + requestPath, Entries: entries}
+		if requestPath != "" {
+			data.Parent = "/"
+			if parent := path.Dir(requestPath); parent != "." {
+				data.Parent += parent + "/"
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := indexTemplate.Execute(w, data); err != nil {
+			log.Debug().Msg(fmt.Sprintf("[Serve] failed to write index: %s", err))
+		}
+	})
+}
+
+// getIndexEntries returns the files and directories directly below dir.
+func getIndexEntries(torrentMeta TorrentMeta, dir string) []IndexEntry {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+
+	seen := make(map[string]bool)
+	var entries []IndexEntry
+
+	for _, file := range torrentMeta.getFiles() {
+		if file.padding {
+			continue
+		}
+		filePath := strings.Join(file.path, "/")
+		rest, ok := strings.CutPrefix(filePath, prefix)
+		if !ok {
+			continue
+		}
+
+		name, _, isDir := strings.Cut(rest, "/")
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		entry := IndexEntry{Name: name, Href: "/" + prefix + name, IsDir: isDir}
+		if isDir {
+			entry.Href += "/"
+		} else {
+			entry.Length = file.length
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+// Serve downloads the torrent in data into the directory output and serves
+// its files on address while it runs.
+func (c *Client) Serve(address string, data []byte, output string) error {
+	torrentMeta, err := ParseTorrent(data)
+	if err != nil {
+		return err
+	}
+	if err := checkFilePaths(torrentMeta); err != nil {
+		return err
+	}
+
+	stream := newTorrentStream(c.network, torrentMeta, filepath.Join(output, torrentMeta.Name))
+	peers, err := getTorrentPeers(c.network, torrentMeta, stream.control.stopped)
+	if err != nil {
+		return err
+	}
+	stream.start(peers)
+	defer stream.stop()
+
+	return runServe(address, stream)
+}
+
+func runServe(address string, stream *TorrentStream) error {
+	log.Info().Msg(fmt.Sprintf("[Serve] serving %s on %s", stream.meta.Name, address))
+	return http.ListenAndServe(address, newServeHandler(stream))
+}
@@ -0,0 +1,86 @@
+package bittorrent
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	stream, data := newTestStream(t)
+	for piece := range stream.meta.Pieces {
+		verifyPiece(stream, data, piece)
+	}
+
+	server := httptest.NewServer(newServeHandler(stream))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestServeRange(t *testing.T) {
+	server := newTestServer(t)
+
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"/docs/c.nfo", nil)
+	request.Header.Set("Range", "bytes=2-5")
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer response.Body.Close()
+
+	body, _ := io.ReadAll(response.Body)
+	if response.StatusCode != http.StatusPartialContent || string(body) != "cccc" {
+		t.Errorf("got %d %q, expected 206 %q", response.StatusCode, body, "cccc")
+	}
+	if contentRange := response.Header.Get("Content-Range"); contentRange != "bytes 2-5/13" {
+		t.Errorf("Content-Range = %q, expected %q", contentRange, "bytes 2-5/13")
+	}
+}
+
+func TestServeIndex(t *testing.T) {
+	server := newTestServer(t)
+
+	tests := []struct {
+		path     string
+		status   int
+		contains []string
+	}{
+		{
+			path:     "/",
+			status:   http.StatusOK,
+			contains: []string{`href="/a.mkv"`, `href="/docs/"`, "15 bytes"},
+		},
+		{
+			path:     "/docs/",
+			status:   http.StatusOK,
+			contains: []string{`href="/docs/c.nfo"`, `href="/"`},
+		},
+		{
+			path:   "/missing",
+			status: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			response, err := http.Get(server.URL + tt.path)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			defer response.Body.Close()
+
+			body, _ := io.ReadAll(response.Body)
+			if response.StatusCode != tt.status {
+				t.Errorf("status = %d, expected %d", response.StatusCode, tt.status)
+			}
+			for _, expected := range tt.contains {
+				if !strings.Contains(string(body), expected) {
+					t.Errorf("expected index to contain %q, got %s", expected, body)
+				}
+			}
+		})
+	}
+}
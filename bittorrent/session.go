@@ -0,0 +1,451 @@
+package bittorrent
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+const DefaultMaxConnections = 50
+
+// Session downloads several torrents at once. All torrents share the
+// session wide connection limit and the peer network with its global
+// bandwidth limits.
+type Session struct {
+	mu          sync.Mutex
+	network     *PeerNetwork
+	torrents    map[string]*SessionTorrent
+	connections *ConnectionLimiter
+	// progress and events are called from the download goroutines without
+	// any lock held, either may be nil
+	progress func(torrent *SessionTorrent, finished int, total int)
+	events   func(torrent *SessionTorrent, event Event)
+}
+
+type SessionTorrent struct {
+	mu       sync.Mutex
+	meta     TorrentMeta
+	output   string
+	files    []int
+	selected int
+	// sequential downloads the pieces in order
+	sequential bool
+	status     string
+	err        error
+	pieces     map[int][]byte
+	finished   int
+	peers      int
+	control    *downloadControl
+	done       chan struct{}
+	session    *Session
+	// magnet is set for torrents added from a magnet link until their
+	// metadata is fetched, fileSelection is applied to the files then
+	magnet        *Magnet
+	fileSelection string
+}
+
+func newSession(maxConnections int, network *PeerNetwork) *Session {
+	if maxConnections < 1 {
+		maxConnections = DefaultMaxConnections
+	}
+
+	return &Session{
+		network:     network,
+		torrents:    make(map[string]*SessionTorrent),
+		connections: newConnectionLimiter(maxConnections),
+	}
+}
+
+// addTorrent registers the torrent without starting it, filePriorities holds
+// the priority of every file or is nil to download all of them. Adding a
+// torrent that is already part of the session returns the existing one.
+func (s *Session) addTorrent(torrentMeta TorrentMeta, output string, filePriorities []int) (*SessionTorrent, error) {
+	if err := checkFilePaths(torrentMeta); err != nil {
+		return nil, err
+	}
+	if filePriorities == nil {
+		filePriorities, _ = parseFileSelection("", torrentMeta.getFiles())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if torrent, ok := s.torrents[torrentMeta.InfoHash]; ok {
+		return torrent, nil
+	}
+
+	torrent := &SessionTorrent{
+		meta:     torrentMeta,
+		output:   output,
+		files:    filePriorities,
+		selected: len(getSelectedPieces(torrentMeta, filePriorities)),
+		status:   WAITING,
+		pieces:   make(map[int][]byte),
+		session:  s,
+	}
+	s.torrents[torrentMeta.InfoHash] = torrent
+	log.Debug().Msg(fmt.Sprintf("[Session] added torrent %s", torrentMeta.Name))
+
+	return torrent, nil
+}
+
+// addMagnet registers the torrent of the magnet link without starting it.
+// Its metadata is fetched from peers once it starts, so its files aren't
+// known until then.
+func (s *Session) addMagnet(magnet Magnet, output string, fileSelection string) (*SessionTorrent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if torrent, ok := s.torrents[magnet.InfoHash]; ok {
+		return torrent, nil
+	}
+
+	torrent := &SessionTorrent{
+		meta:          magnet.torrentMeta(),
+		output:        output,
+		status:        WAITING,
+		pieces:        make(map[int][]byte),
+		session:       s,
+		magnet:        &magnet,
+		fileSelection: fileSelection,
+	}
+	s.torrents[magnet.InfoHash] = torrent
+	log.Debug().Msg(fmt.Sprintf("[Session] added magnet %s", torrent.meta.Name))
+
+	return torrent, nil
+}
+
+func (s *Session) getTorrent(infoHash string) (*SessionTorrent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	torrent, ok := s.torrents[infoHash]
+	if !ok {
+		return nil, fmt.Errorf("torrent %s not found", infoHash)
+	}
+	return torrent, nil
+}
+
+// infoHashes returns the info hashes of all torrents of the session.
+func (s *Session) infoHashes() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infoHashes := make([][]byte, 0, len(s.torrents))
+	for _, torrent := range s.torrents {
+		infoHashes = append(infoHashes, torrent.metadata().InfoHashBytes)
+	}
+	return infoHashes
+}
+
+// listTorrents returns all torrents of the session sorted by name.
+func (s *Session) listTorrents() []*SessionTorrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	torrents := make([]*SessionTorrent, 0, len(s.torrents))
+	names := make(map[*SessionTorrent]string, len(s.torrents))
+	for _, torrent := range s.torrents {
+		torrents = append(torrents, torrent)
+		names[torrent] = torrent.metadata().Name
+	}
+
+	sort.Slice(torrents, func(i, j int) bool {
+		return names[torrents[i]] < names[torrents[j]]
+	})
+	return torrents
+}
+
+// removeTorrent stops the torrent and removes it from the session, already
+// written output is kept.
+func (s *Session) removeTorrent(infoHash string) error {
+	torrent, err := s.getTorrent(infoHash)
+	if err != nil {
+		return err
+	}
+
+	torrent.stop()
+
+	s.mu.Lock()
+	delete(s.torrents, infoHash)
+	s.mu.Unlock()
+
+	log.Debug().Msg(fmt.Sprintf("[Session] removed torrent %s", torrent.metadata().Name))
+	return nil
+}
+
+// setTorrentLimits changes the bandwidth limits of a single torrent in
+// bytes per second, 0 removes the limit.
+func (s *Session) setTorrentLimits(infoHash string, download int, upload int) error {
+	if _, err := s.getTorrent(infoHash); err != nil {
+		return err
+	}
+
+	limits := s.network.bandwidthForTorrent(infoHash)
+	limits.download.setRate(download)
+	limits.upload.setRate(upload)
+	return nil
+}
+
+// wait blocks until none of the torrents in the session are downloading.
+func (s *Session) wait() {
+	for _, torrent := range s.listTorrents() {
+		torrent.wait()
+	}
+}
+
+func (s *Session) reportProgress(torrent *SessionTorrent, finished int, total int) {
+	if s.progress != nil {
+		s.progress(torrent, finished, total)
+	}
+}
+
+func (s *Session) emit(torrent *SessionTorrent, event Event) {
+	if s.events != nil {
+		s.events(torrent, event)
+	}
+}
+
+// start starts a waiting or stopped torrent and resumes a paused one. Pieces
+// finished before the torrent was stopped are not downloaded again.
+func (t *SessionTorrent) start() {
+	t.mu.Lock()
+
+	switch t.status {
+	case PAUSED:
+		t.control.resume()
+		t.status = IN_PROGRESS
+		t.mu.Unlock()
+		t.session.emit(t, Event{Type: EVENT_RESUMED})
+		return
+	case IN_PROGRESS, COMPLETE:
+		t.mu.Unlock()
+		return
+	}
+
+	t.status = IN_PROGRESS
+	t.err = nil
+	t.control = newDownloadControl(t.session.connections)
+	t.done = make(chan struct{})
+
+	// the pieces of magnet torrents are known once their metadata is there
+	var pieces []Piece
+	if t.magnet == nil {
+		for _, piece := range getSelectedPieces(t.meta, t.files) {
+			if _, ok := t.pieces[piece.number]; !ok {
+				pieces = append(pieces, piece)
+			}
+		}
+	}
+
+	go t.download(t.control, pieces, t.done)
+	t.mu.Unlock()
+
+	t.session.emit(t, Event{Type: EVENT_STARTED})
+}
+
+func (t *SessionTorrent) download(control *downloadControl, pieces []Piece, done chan struct{}) {
+	defer close(done)
+
+	// a torrent stopped while the tracker is retried ends up stopped as well
+	peers, err := getTorrentPeers(t.session.network, t.metadata(), control.stopped)
+	if err != nil {
+		t.session.emit(t, t.finish(nil, err))
+		return
+	}
+
+	t.mu.Lock()
+	t.peers = len(peers)
+	fetch := t.magnet != nil
+	t.mu.Unlock()
+
+	if fetch {
+		pieces, err = t.fetchMetadata(peers, control)
+		if err != nil {
+			t.session.emit(t, t.finish(nil, err))
+			return
+		}
+	}
+
+	finishedBefore := t.selected - len(pieces)
+	control.progress = func(finishedPieces int) {
+		t.mu.Lock()
+		changed := t.finished != finishedBefore+finishedPieces
+		t.finished = finishedBefore + finishedPieces
+		t.mu.Unlock()
+
+		if changed {
+			t.session.reportProgress(t, finishedBefore+finishedPieces, t.selected)
+		}
+	}
+	control.verified = func(result Result) {
+		// verified pieces are uploaded to other peers right away
+		t.mu.Lock()
+		t.pieces[result.piece] = result.result
+		t.mu.Unlock()
+
+		t.session.emit(t, Event{Type: EVENT_PIECE_VERIFIED, Piece: result.piece})
+	}
+
+	results, err := downloadTorrentPieces(t.session.network, t.meta, newPiecePicker(pieces, t.sequential), peers, control)
+	event := t.finish(results, err)
+	t.session.emit(t, event)
+}
+
+// fetchMetadata gets the info dictionary of a magnet torrent from its peers
+// and returns the pieces of the selected files.
+func (t *SessionTorrent) fetchMetadata(peers []Peer, control *downloadControl) ([]Piece, error) {
+	t.mu.Lock()
+	magnet, torrentMeta, fileSelection := *t.magnet, t.meta, t.fileSelection
+	t.mu.Unlock()
+
+	info, err := fetchMetadata(t.session.network, torrentMeta, peers, control)
+	if err != nil {
+		return nil, err
+	}
+	torrentMeta, err = magnet.parseMetadata(info)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkFilePaths(torrentMeta); err != nil {
+		return nil, err
+	}
+	filePriorities, err := parseFileSelection(fileSelection, torrentMeta.getFiles())
+	if err != nil {
+		return nil, err
+	}
+	pieces := getSelectedPieces(torrentMeta, filePriorities)
+
+	t.mu.Lock()
+	t.meta = torrentMeta
+	t.files = filePriorities
+	t.selected = len(pieces)
+	t.magnet = nil
+	t.mu.Unlock()
+
+	log.Debug().Msg(fmt.Sprintf("[Session] fetched metadata of %s", torrentMeta.Name))
+	// the number of pieces to download is only known now
+	t.session.reportProgress(t, 0, len(pieces))
+	return pieces, nil
+}
+
+// finish stores the results of the download and writes them out once all
+// pieces are there, it returns the event that ended the download.
+func (t *SessionTorrent) finish(results []Result, err error) Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, result := range results {
+		t.pieces[result.piece] = result.result
+	}
+	t.finished = len(t.pieces)
+	t.peers = 0
+
+	if errors.Is(err, ErrDownloadStopped) {
+		t.status = STOPPED
+		return Event{Type: EVENT_STOPPED}
+	}
+	if err != nil {
+		t.status = FAILED
+		t.err = err
+		log.Error().Msg(fmt.Sprintf("[Session] failed to download %s: %s", t.meta.Name, err))
+		return Event{Type: EVENT_FAILED, Err: err}
+	}
+
+	if err = t.writeOutput(); err != nil {
+		t.status = FAILED
+		t.err = err
+		log.Error().Msg(fmt.Sprintf("[Session] failed to write %s: %s", t.output, err))
+		return Event{Type: EVENT_FAILED, Err: err}
+	}
+
+	t.status = COMPLETE
+	log.Debug().Msg(fmt.Sprintf("[Session] finished torrent %s", t.meta.Name))
+	return Event{Type: EVENT_COMPLETED}
+}
+
+func (t *SessionTorrent) writeOutput() error {
+	results := make([]Result, 0, len(t.pieces))
+	for number, data := range t.pieces {
+		results = append(results, Result{piece: number, result: data})
+	}
+
+	storage := newStorage(t.meta, t.output, t.files)
+	err := storage.writePieces(results)
+	return errors.Join(err, storage.Close())
+}
+
+// serving reports whether peers may download the torrent from us.
+func (t *SessionTorrent) serving() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// without metadata there is nothing to serve
+	return t.magnet == nil && (t.status == IN_PROGRESS || t.status == COMPLETE)
+}
+
+// metadata returns the torrent's metainfo, which changes once the metadata
+// of a magnet torrent is fetched.
+func (t *SessionTorrent) metadata() TorrentMeta {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.meta
+}
+
+// seeding reports whether all selected pieces are downloaded, so the
+// choker ranks peers by how fast they download from us.
+func (t *SessionTorrent) seeding() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.status == COMPLETE
+}
+
+func (t *SessionTorrent) pause() {
+	t.mu.Lock()
+	paused := t.status == IN_PROGRESS
+	if paused {
+		t.control.pause()
+		t.status = PAUSED
+	}
+	t.mu.Unlock()
+
+	if paused {
+		t.session.emit(t, Event{Type: EVENT_PAUSED})
+	}
+}
+
+func (t *SessionTorrent) stop() {
+	t.mu.Lock()
+	control := t.control
+	running := t.status == IN_PROGRESS || t.status == PAUSED
+	t.mu.Unlock()
+
+	if running {
+		control.stop()
+		t.wait()
+	}
+}
+
+func (t *SessionTorrent) wait() {
+	t.mu.Lock()
+	done := t.done
+	t.mu.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+// progress returns the status of the torrent and the number of finished
+// pieces out of the pieces needed for the selected files.
+func (t *SessionTorrent) progress() (string, int, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.status, t.finished, t.selected
+}
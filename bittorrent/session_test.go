@@ -0,0 +1,206 @@
+package bittorrent
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSessionAddTorrent(t *testing.T) {
+	session := newSession(0, newTestNetwork())
+
+	first, _ := session.addTorrent(TorrentMeta{InfoHash: "bb", Name: "second"}, "second.out", nil)
+	session.addTorrent(TorrentMeta{InfoHash: "aa", Name: "first"}, "first.out", nil)
+	duplicate, _ := session.addTorrent(TorrentMeta{InfoHash: "bb", Name: "second"}, "other.out", nil)
+
+	if duplicate != first {
+		t.Errorf("expected adding the same info hash twice to return the existing torrent")
+	}
+
+	torrents := session.listTorrents()
+	if len(torrents) != 2 || torrents[0].meta.Name != "first" || torrents[1].meta.Name != "second" {
+		t.Errorf("listTorrents() returned unexpected torrents %v", torrents)
+	}
+
+	status, finished, total := first.progress()
+	if status != WAITING || finished != 0 || total != 0 {
+		t.Errorf("progress() = %s, %d, %d, expected waiting torrent", status, finished, total)
+	}
+}
+
+func TestSessionRemoveTorrent(t *testing.T) {
+	session := newSession(0, newTestNetwork())
+	session.addTorrent(TorrentMeta{InfoHash: "aa", Name: "first"}, "first.out", nil)
+
+	if err := session.removeTorrent("aa"); err != nil {
+		t.Errorf("removeTorrent() unexpected error %v", err)
+	}
+	if _, err := session.getTorrent("aa"); err == nil {
+		t.Errorf("expected removed torrent to be gone")
+	}
+	if err := session.removeTorrent("aa"); err == nil {
+		t.Errorf("expected error removing unknown torrent")
+	}
+}
+
+func TestSessionSetTorrentLimits(t *testing.T) {
+	session := newSession(0, newTestNetwork())
+	session.addTorrent(TorrentMeta{InfoHash: "session-limits", Name: "first"}, "first.out", nil)
+
+	if err := session.setTorrentLimits("session-limits", 1024, 2048); err != nil {
+		t.Fatalf("setTorrentLimits() unexpected error %v", err)
+	}
+
+	limits := session.network.bandwidthForTorrent("session-limits")
+	if limits.download.getRate() != 1024 || limits.upload.getRate() != 2048 {
+		t.Errorf("unexpected limits %d/%d", limits.download.getRate(), limits.upload.getRate())
+	}
+
+	if err := session.setTorrentLimits("unknown", 1, 1); err == nil {
+		t.Errorf("expected error for unknown torrent")
+	}
+}
+
+func TestDownloadControlPause(t *testing.T) {
+	control := newDownloadControl(nil)
+	control.pause()
+
+	resumed := make(chan bool)
+	go func() {
+		resumed <- control.waitWhilePaused()
+	}()
+
+	select {
+	case <-resumed:
+		t.Fatalf("expected waitWhilePaused to block while paused")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	control.resume()
+	if running := <-resumed; !running {
+		t.Errorf("expected waitWhilePaused to report a running download after resume")
+	}
+
+	control.pause()
+	go func() {
+		resumed <- control.waitWhilePaused()
+	}()
+	control.stop()
+
+	if running := <-resumed; running {
+		t.Errorf("expected waitWhilePaused to report a stopped download")
+	}
+}
+
+func TestDownloadControlConnections(t *testing.T) {
+	control := newDownloadControl(newConnectionLimiter(1))
+
+	if !control.acquireConnection(false) {
+		t.Fatalf("expected a free connection slot")
+	}
+
+	acquired := make(chan bool)
+	go func() {
+		acquired <- control.acquireConnection(false)
+	}()
+
+	control.stop()
+	if <-acquired {
+		t.Errorf("expected acquireConnection to fail once stopped")
+	}
+}
+
+func TestDownloadTorrentPiecesStopped(t *testing.T) {
+	control := newDownloadControl(nil)
+	control.stop()
+
+	pieces := []Piece{{0, WAITING}, {1, WAITING}}
+	results, err := downloadTorrentPieces(newTestNetwork(), TorrentMeta{}, newPiecePicker(pieces, false), nil, control)
+
+	if !errors.Is(err, ErrDownloadStopped) {
+		t.Errorf("expected ErrDownloadStopped, got %v", err)
+	}
+	if len(results) != 0 {
+		t.Errorf("expected no results, got %v", results)
+	}
+}
+
+func TestDownloadTorrentPiecesNoPeers(t *testing.T) {
+	// nothing listens on the port, so the peer fails every piece
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := netip.MustParseAddrPort(listener.Addr().String())
+	listener.Close()
+
+	defer func(wait time.Duration) { lanPeerWait = wait }(lanPeerWait)
+	lanPeerWait = 50 * time.Millisecond
+
+	tests := []struct {
+		name      string
+		peers     []Peer
+		discovery bool
+		// private torrents don't wait for LAN peers
+		private bool
+	}{
+		{name: "No peers"},
+		{name: "Unreachable peer", peers: []Peer{{0, address, "idle", "", false}}},
+		{name: "Local discovery without LAN peers", peers: []Peer{{0, address, "idle", "", false}}, discovery: true},
+		{name: "Private torrent with local discovery", discovery: true, private: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pieces := []Piece{{0, WAITING}, {1, WAITING}}
+			torrentMeta := TorrentMeta{Pieces: make([]string, 2), PieceLength: 16, Length: 32, Private: tt.private}
+
+			network := newTestNetwork()
+			if tt.discovery {
+				conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				network.discovery, err = newLocalDiscovery(conn, conn.LocalAddr(), DefaultListenPort)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer network.discovery.Close()
+			}
+
+			results, err := downloadTorrentPieces(network, torrentMeta, newPiecePicker(pieces, false), tt.peers, newDownloadControl(nil))
+			if !errors.Is(err, ErrNoPeers) {
+				t.Errorf("expected ErrNoPeers, got %v", err)
+			}
+			if len(results) != 0 {
+				t.Errorf("expected no results, got %v", results)
+			}
+		})
+	}
+}
+
+func TestSessionStopWhileAnnouncing(t *testing.T) {
+	defer func(backoff time.Duration) { announceBackoff = backoff }(announceBackoff)
+	announceBackoff = time.Hour
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("garbage"))
+	}))
+	defer server.Close()
+
+	session := newSession(0, newTestNetwork())
+	torrent, err := session.addTorrent(TorrentMeta{InfoHash: "aa", Name: "first", Announce: server.URL}, t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	torrent.start()
+	torrent.stop()
+	if status, _, _ := torrent.progress(); status != STOPPED {
+		t.Errorf("torrent stopped while announcing has status %s, expected %s", status, STOPPED)
+	}
+}
@@ -0,0 +1,177 @@
+package bittorrent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type StorageFile struct {
+	path   string
+	offset int
+	length int
+	skip   bool
+}
+
+// Storage maps pieces onto the files of the torrent. A single file torrent
+// is written to the output path, the files of a multi file torrent are
+// written below the output directory. Files are opened on their first
+// write and stay open until Close.
+type Storage struct {
+	pieceLength int
+	files       []StorageFile
+	mu          sync.Mutex
+	handles     map[string]*os.File
+}
+
+func newStorage(torrentMeta TorrentMeta, output string, filePriorities []int) *Storage {
+	storage := &Storage{pieceLength: torrentMeta.PieceLength, handles: make(map[string]*os.File)}
+
+	offset := 0
+	for i, file := range torrentMeta.getFiles() {
+		storageFile := StorageFile{
+			path:   output,
+			offset: offset,
+			length: file.length,
+			skip:   file.padding || filePriorities != nil && filePriorities[i] == PRIORITY_SKIP,
+		}
+		if len(torrentMeta.Keys) > 0 {
+			storageFile.path = filepath.Join(append([]string{output}, file.path...)...)
+		}
+
+		storage.files = append(storage.files, storageFile)
+		offset += file.length
+	}
+
+	return storage
+}
+
+// checkFilePaths refuses torrents with files that would be written outside
+// of the output, before anything is written.
+func checkFilePaths(torrentMeta TorrentMeta) error {
+	if !isSafeFileName(torrentMeta.Name) {
+		return &MetainfoError{Path: "info.name", Reason: fmt.Sprintf("%q is not a safe file name", torrentMeta.Name)}
+	}
+	// v2 torrents have their files in the file tree, with padding files in between
+	v2Only := torrentMeta.MetaVersion == 2 && !torrentMeta.Hybrid
+	for i, file := range torrentMeta.Keys {
+		path := fmt.Sprintf("info.files[%d].path", i)
+		if len(file.path) == 0 {
+			return &MetainfoError{Path: path, Reason: "is empty"}
+		}
+		for j, name := range file.path {
+			if isSafeFileName(name) {
+				continue
+			}
+			if v2Only {
+				return &MetainfoError{Path: getFileTreePath(file.path[:j+1]), Reason: fmt.Sprintf("%q is not a safe file name", name)}
+			}
+			return &MetainfoError{Path: fmt.Sprintf("%s[%d]", path, j), Reason: fmt.Sprintf("%q is not a safe file name", name)}
+		}
+	}
+	return nil
+}
+
+// writePieces writes the downloaded pieces. Pieces at the boundary of a
+// skipped file are downloaded in full to verify them, but only the parts
+// belonging to selected files end up on disk.
+func (s *Storage) writePieces(results []Result) error {
+	for _, file := range s.files {
+		if !file.skip && file.length == 0 {
+			if err := s.writeAt(file, nil, 0); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, result := range results {
+		if err := s.writePiece(result.piece, result.result); err != nil {
+			return err
+		}
+	}
+
+	// leftovers of an earlier, longer file at the same path are cut off
+	for _, file := range s.files {
+		if file.skip {
+			continue
+		}
+		f, err := s.open(file)
+		if err != nil {
+			return err
+		}
+		if err := f.Truncate(int64(file.length)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Storage) writePiece(piece int, data []byte) error {
+	pieceStart := piece * s.pieceLength
+	pieceEnd := pieceStart + len(data)
+
+	for _, file := range s.files {
+		fileEnd := file.offset + file.length
+		if file.skip || fileEnd <= pieceStart || file.offset >= pieceEnd {
+			continue
+		}
+
+		start := max(pieceStart, file.offset)
+		end := min(pieceEnd, fileEnd)
+
+		err := s.writeAt(file, data[start-pieceStart:end-pieceStart], int64(start-file.offset))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Storage) writeAt(file StorageFile, data []byte, offset int64) error {
+	f, err := s.open(file)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteAt(data, offset)
+	return err
+}
+
+// open returns the handle of the file, opening it on first use.
+func (s *Storage) open(file StorageFile) (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f, ok := s.handles[file.path]; ok {
+		return f, nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(file.path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(file.path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.handles[file.path] = f
+	return f, nil
+}
+
+// Close closes the files that were written to.
+func (s *Storage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	for path, f := range s.handles {
+		err = errors.Join(err, f.Close())
+		delete(s.handles, path)
+	}
+	return err
+}
@@ -0,0 +1,78 @@
+package bittorrent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStorageWritePiecesMultiFile(t *testing.T) {
+	output := t.TempDir()
+	torrentMeta := multiFileTorrent()
+	data := []byte("aaaaaaaaaaaaaaabbbbbbbbbbccccccccccccc")
+
+	// b.srt is skipped, its boundary pieces are still downloaded
+	priorities := []int{PRIORITY_NORMAL, PRIORITY_SKIP, PRIORITY_NORMAL, PRIORITY_NORMAL}
+	storage := newStorage(torrentMeta, output, priorities)
+
+	var results []Result
+	for _, piece := range getSelectedPieces(torrentMeta, priorities) {
+		start := piece.number * torrentMeta.PieceLength
+		end := min(start+torrentMeta.PieceLength, len(data))
+		results = append(results, Result{piece: piece.number, result: data[start:end]})
+	}
+
+	if err := storage.writePieces(results); err != nil {
+		t.Fatalf("writePieces() unexpected error %v", err)
+	}
+	// every file is opened once, however many pieces it has
+	if len(storage.handles) != 3 {
+		t.Errorf("storage has %d open files, expected 3", len(storage.handles))
+	}
+	if err := storage.Close(); err != nil || len(storage.handles) != 0 {
+		t.Errorf("Close() = %v with %d files left open", err, len(storage.handles))
+	}
+
+	expected := map[string][]byte{
+		"a.mkv":      []byte("aaaaaaaaaaaaaaa"),
+		"empty":      {},
+		"docs/c.nfo": []byte("ccccccccccccc"),
+	}
+	for path, content := range expected {
+		written, err := os.ReadFile(filepath.Join(output, path))
+		if err != nil {
+			t.Errorf("failed to read %s: %v", path, err)
+			continue
+		}
+		if !bytes.Equal(written, content) {
+			t.Errorf("%s = %q, expected %q", path, written, content)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(output, "b.srt")); !os.IsNotExist(err) {
+		t.Errorf("expected skipped file b.srt not to be written")
+	}
+}
+
+func TestStorageWritePiecesSingleFile(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "single.txt")
+	torrentMeta := TorrentMeta{Name: "single.txt", PieceLength: 4, Pieces: []string{"p0", "p1"}, Length: 6}
+
+	// a longer file from an earlier download has to be cut off
+	if err := os.WriteFile(output, []byte("previous content"), 0644); err != nil {
+		t.Fatalf("failed to write previous content: %v", err)
+	}
+
+	storage := newStorage(torrentMeta, output, nil)
+	defer storage.Close()
+	err := storage.writePieces([]Result{{piece: 1, result: []byte("ef")}, {piece: 0, result: []byte("abcd")}})
+	if err != nil {
+		t.Fatalf("writePieces() unexpected error %v", err)
+	}
+
+	written, _ := os.ReadFile(output)
+	if string(written) != "abcdef" {
+		t.Errorf("written = %q, expected %q", written, "abcdef")
+	}
+}
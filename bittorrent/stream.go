@@ -0,0 +1,173 @@
+package bittorrent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// TorrentStream downloads a torrent in the background and lets readers
+// access its files while the download is still running. Every verified
+// piece is written to disk right away and reads block until the pieces
+// they need are there.
+type TorrentStream struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	network  *PeerNetwork
+	meta     TorrentMeta
+	storage  *Storage
+	picker   *PiecePicker
+	control  *downloadControl
+	complete []bool
+	finished bool
+	err      error
+}
+
+// TorrentFileReader is an io.ReadSeeker over a single file of a stream.
+type TorrentFileReader struct {
+	stream *TorrentStream
+	file   StorageFile
+	offset int64
+}
+
+func newTorrentStream(network *PeerNetwork, torrentMeta TorrentMeta, output string) *TorrentStream {
+	stream := &TorrentStream{
+		network:  network,
+		meta:     torrentMeta,
+		storage:  newStorage(torrentMeta, output, nil),
+		picker:   newPiecePicker(getTorrentPieces(torrentMeta), true),
+		control:  newDownloadControl(nil),
+		complete: make([]bool, len(torrentMeta.Pieces)),
+	}
+	stream.cond = sync.NewCond(&stream.mu)
+	stream.control.verified = stream.pieceVerified
+	return stream
+}
+
+// start downloads the torrent from the given peers until all pieces are
+// there or the stream is stopped.
+func (s *TorrentStream) start(peers []Peer) {
+	go func() {
+		_, err := downloadTorrentPieces(s.network, s.meta, s.picker, peers, s.control)
+		// no piece is written once the workers are gone
+		err = errors.Join(err, s.storage.Close())
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.finished = true
+		if s.err == nil {
+			s.err = err
+		}
+		s.cond.Broadcast()
+	}()
+}
+
+func (s *TorrentStream) stop() {
+	s.control.stop()
+}
+
+func (s *TorrentStream) pieceVerified(result Result) {
+	err := s.storage.writePiece(result.piece, result.result)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		log.Error().Msg(fmt.Sprintf("[Stream] failed to write piece %d: %s", result.piece, err))
+		s.err = err
+		s.control.stop()
+	} else {
+		s.complete[result.piece] = true
+	}
+	s.cond.Broadcast()
+}
+
+// waitForPiece moves the download towards the piece and blocks until it is
+// verified and written to disk.
+func (s *TorrentStream) waitForPiece(piece int) error {
+	s.picker.setPosition(piece)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for !s.complete[piece] {
+		if s.err != nil {
+			return s.err
+		}
+		if s.finished {
+			return ErrDownloadStopped
+		}
+		s.cond.Wait()
+	}
+	return nil
+}
+
+func (s *TorrentStream) openFile(index int) (*TorrentFileReader, error) {
+	if index < 0 || index >= len(s.storage.files) {
+		return nil, fmt.Errorf("file index %d out of range, torrent has %d files", index, len(s.storage.files))
+	}
+
+	return &TorrentFileReader{stream: s, file: s.storage.files[index]}, nil
+}
+
+// Read returns at most the rest of the piece under the read offset, so it
+// only waits for a single piece at a time.
+func (r *TorrentFileReader) Read(p []byte) (int, error) {
+	if r.offset >= int64(r.file.length) {
+		return 0, io.EOF
+	}
+
+	pieceLength := int64(r.stream.meta.PieceLength)
+	torrentOffset := int64(r.file.offset) + r.offset
+	piece := torrentOffset / pieceLength
+
+	err := r.stream.waitForPiece(int(piece))
+	if err != nil {
+		return 0, err
+	}
+
+	toRead := min(int64(len(p)), (piece+1)*pieceLength-torrentOffset, int64(r.file.length)-r.offset)
+
+	f, err := os.Open(r.file.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n, err := f.ReadAt(p[:toRead], r.offset)
+	r.offset += int64(n)
+	if errors.Is(err, io.EOF) && int64(n) == toRead {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek moves the read offset and lets the download jump ahead to it.
+func (r *TorrentFileReader) Seek(offset int64, whence int) (int64, error) {
+	var position int64
+	switch whence {
+	case io.SeekStart:
+		position = offset
+	case io.SeekCurrent:
+		position = r.offset + offset
+	case io.SeekEnd:
+		position = int64(r.file.length) + offset
+	default:
+		return r.offset, errors.New("invalid whence")
+	}
+
+	if position < 0 {
+		return r.offset, errors.New("negative position")
+	}
+
+	r.offset = position
+	if position < int64(r.file.length) {
+		r.stream.picker.setPosition(int((int64(r.file.offset) + position) / int64(r.stream.meta.PieceLength)))
+	}
+	return position, nil
+}
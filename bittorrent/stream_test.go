@@ -0,0 +1,91 @@
+package bittorrent
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestStream(t *testing.T) (*TorrentStream, []byte) {
+	torrentMeta := multiFileTorrent()
+	data := []byte("aaaaaaaaaaaaaaabbbbbbbbbbccccccccccccc")
+	return newTorrentStream(newTestNetwork(), torrentMeta, t.TempDir()), data
+}
+
+func verifyPiece(stream *TorrentStream, data []byte, piece int) {
+	start := piece * stream.meta.PieceLength
+	end := min(start+stream.meta.PieceLength, len(data))
+	stream.pieceVerified(Result{piece: piece, result: data[start:end]})
+}
+
+func TestTorrentFileReaderWaitsForPieces(t *testing.T) {
+	stream, data := newTestStream(t)
+
+	reader, err := stream.openFile(0)
+	if err != nil {
+		t.Fatalf("openFile() unexpected error %v", err)
+	}
+
+	read := make(chan []byte)
+	go func() {
+		content, _ := io.ReadAll(reader)
+		read <- content
+	}()
+
+	verifyPiece(stream, data, 0)
+	select {
+	case <-read:
+		t.Fatalf("expected read to block until piece 1 is verified")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	verifyPiece(stream, data, 1)
+	if content := <-read; string(content) != "aaaaaaaaaaaaaaa" {
+		t.Errorf("read %q, expected %q", content, "aaaaaaaaaaaaaaa")
+	}
+}
+
+func TestTorrentFileReaderSeek(t *testing.T) {
+	stream, data := newTestStream(t)
+	for piece := range stream.meta.Pieces {
+		verifyPiece(stream, data, piece)
+	}
+
+	reader, _ := stream.openFile(3)
+	position, err := reader.Seek(-5, io.SeekEnd)
+	if err != nil || position != 8 {
+		t.Fatalf("Seek() = %d, %v, expected 8", position, err)
+	}
+
+	if stream.picker.position != 3 {
+		t.Errorf("expected seek to move the read position to piece 3, got %d", stream.picker.position)
+	}
+
+	content, _ := io.ReadAll(reader)
+	if string(content) != "ccccc" {
+		t.Errorf("read %q, expected %q", content, "ccccc")
+	}
+
+	if _, err := reader.Seek(-1, io.SeekStart); err == nil {
+		t.Errorf("expected error seeking to a negative position")
+	}
+
+	expectedPath := filepath.Join("docs", "c.nfo")
+	if !strings.HasSuffix(reader.file.path, expectedPath) {
+		t.Errorf("reader path %s, expected it to end with %s", reader.file.path, expectedPath)
+	}
+}
+
+func TestTorrentFileReaderStopped(t *testing.T) {
+	stream, _ := newTestStream(t)
+	stream.control.stop()
+	stream.start(nil)
+
+	reader, _ := stream.openFile(0)
+	if _, err := reader.Read(make([]byte, 4)); !errors.Is(err, ErrDownloadStopped) {
+		t.Errorf("Read() error = %v, expected ErrDownloadStopped", err)
+	}
+}
@@ -0,0 +1,297 @@
+package bittorrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// SeederFaults describes how a seeder of the test swarm misbehaves. The
+// zero value is a well behaved seeder.
+type SeederFaults struct {
+	// fast makes the seeder support the Fast extension
+	fast bool
+	// corrupt pieces are served with a flipped byte in every block
+	corrupt map[int]bool
+	// disconnects is the number of connections that are closed after their
+	// first block
+	disconnects int
+	// chokes is the number of connections that are choked after their first
+	// block. Fast seeders reject the requests left, others drop them.
+	chokes int
+	// delay is added before every block
+	delay time.Duration
+}
+
+type testSeeder struct {
+	address     netip.AddrPort
+	peerId      string
+	faults      SeederFaults
+	connections atomic.Int32
+	blocks      atomic.Int32
+}
+
+// testSwarm is a tracker and seeders on localhost that serve real torrent
+// data, so downloads can be tested end to end without network access.
+type testSwarm struct {
+	t       *testing.T
+	data    []byte
+	meta    TorrentMeta
+	torrent string
+	tracker *TrackerServer
+	seeders int
+}
+
+func newTestSwarm(t *testing.T, data []byte, pieceLength int) *testSwarm {
+	tracker := NewTrackerServer(time.Minute, nil)
+	server := httptest.NewServer(NewTrackerHandler(tracker))
+	t.Cleanup(server.Close)
+
+	var pieces []byte
+	for start := 0; start < len(data); start += pieceLength {
+		hash := sha1.Sum(data[start:min(start+pieceLength, len(data))])
+		pieces = append(pieces, hash[:]...)
+	}
+
+	torrent := encodeTestTorrent(t, map[string]interface{}{
+		"announce": server.URL + "/announce",
+		"info": map[string]interface{}{
+			"name":         "swarm.bin",
+			"length":       len(data),
+			"piece length": pieceLength,
+			"pieces":       string(pieces),
+		},
+	})
+
+	meta, err := fromBencode(torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSwarm{t: t, data: data, meta: meta, torrent: torrent, tracker: tracker}
+}
+
+// addSeeder starts a seeder with the faults and announces it to the tracker.
+func (s *testSwarm) addSeeder(faults SeederFaults) *testSeeder {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		s.t.Fatalf("failed to listen: %v", err)
+	}
+	s.t.Cleanup(func() { listener.Close() })
+
+	s.seeders++
+	seeder := &testSeeder{
+		address: netip.MustParseAddrPort(listener.Addr().String()),
+		peerId:  fmt.Sprintf("-qB4520-seeder%06d", s.seeders),
+		faults:  faults,
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go seeder.serve(conn, s.meta, s.data)
+		}
+	}()
+
+	_, err = s.tracker.announce(AnnounceRequest{infoHash: string(s.meta.InfoHashBytes), peerId: seeder.peerId, address: seeder.address}, time.Now())
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return seeder
+}
+
+// download runs the whole download of the torrent with a client created
+// with the options and returns what was written to disk.
+func (s *testSwarm) download(options ...Option) []byte {
+	output := filepath.Join(s.t.TempDir(), "swarm.bin")
+
+	client, err := NewClient(options...)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer client.Close()
+
+	torrent, err := client.AddTorrent([]byte(s.torrent), output)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- torrent.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			s.t.Fatalf("Wait() unexpected error %v", err)
+		}
+	case <-time.After(30 * time.Second):
+		s.t.Fatal("download did not finish")
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return data
+}
+
+func (p *testSeeder) serve(conn net.Conn, torrentMeta TorrentMeta, data []byte) {
+	defer conn.Close()
+	connection := int(p.connections.Add(1))
+
+	handshake := make([]byte, handshakeLength)
+	if _, err := io.ReadFull(conn, handshake); err != nil {
+		return
+	}
+	if !bytes.Equal(handshake[28:48], torrentMeta.InfoHashBytes) {
+		return
+	}
+	clear(handshake[20:28])
+	if p.faults.fast {
+		handshake[27] |= fastExtensionBit
+	}
+	copy(handshake[48:], p.peerId)
+	conn.Write(handshake)
+
+	if p.faults.fast {
+		conn.Write([]byte{0, 0, 0, 1, haveAll})
+	} else {
+		have := make(Bitfield, (len(torrentMeta.Pieces)+7)/8)
+		for i := range torrentMeta.Pieces {
+			have.setPiece(i)
+		}
+		message := binary.BigEndian.AppendUint32(nil, uint32(1+len(have)))
+		message = append(message, bitfield)
+		conn.Write(append(message, have...))
+	}
+
+	served, choked := 0, false
+	for {
+		payload, err := readMessage(conn, maxMessageLength(len(torrentMeta.Pieces)))
+		if err != nil {
+			return
+		}
+
+		switch payload[0] {
+		case interested:
+			conn.Write([]byte{0, 0, 0, 1, unchoke})
+		case request:
+			if choked {
+				if p.faults.fast {
+					conn.Write(append([]byte{0, 0, 0, 13, rejectRequest}, payload[1:]...))
+				}
+				continue
+			}
+
+			index := int(binary.BigEndian.Uint32(payload[1:5]))
+			begin := int(binary.BigEndian.Uint32(payload[5:9]))
+			length := int(binary.BigEndian.Uint32(payload[9:13]))
+			start := index*torrentMeta.PieceLength + begin
+			block := bytes.Clone(data[start : start+length])
+			if p.faults.corrupt[index] {
+				block[0] ^= 0xff
+			}
+
+			time.Sleep(p.faults.delay)
+			message := binary.BigEndian.AppendUint32(nil, uint32(9+length))
+			message = append(message, piece)
+			message = append(message, payload[1:9]...)
+			conn.Write(append(message, block...))
+			p.blocks.Add(1)
+			served++
+
+			if served == 1 && connection <= p.faults.disconnects {
+				return
+			}
+			if served == 1 && connection <= p.faults.chokes {
+				choked = true
+				conn.Write([]byte{0, 0, 0, 1, choke})
+			}
+		}
+	}
+}
+
+func TestSwarmDownload(t *testing.T) {
+	allPieces := map[int]bool{0: true, 1: true, 2: true, 3: true, 4: true, 5: true}
+
+	tests := []struct {
+		name    string
+		seeders []SeederFaults
+	}{
+		{
+			name:    "Healthy seeders",
+			seeders: []SeederFaults{{}, {fast: true}, {}},
+		},
+		{
+			name:    "Corrupt pieces",
+			seeders: []SeederFaults{{corrupt: allPieces}, {corrupt: map[int]bool{1: true, 3: true}}, {fast: true}},
+		},
+		{
+			name:    "Disconnects",
+			seeders: []SeederFaults{{disconnects: 4}, {fast: true, disconnects: 4}},
+		},
+		{
+			name:    "Choke storm",
+			seeders: []SeederFaults{{chokes: 6}, {fast: true, chokes: 6}},
+		},
+		{
+			name:    "Slow peer",
+			seeders: []SeederFaults{{delay: 50 * time.Millisecond}, {}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := make([]byte, 5*2*defaultBlockSize+1000)
+			for i := range data {
+				data[i] = byte(i * 7 % 253)
+			}
+			swarm := newTestSwarm(t, data, 2*defaultBlockSize)
+
+			var seeders []*testSeeder
+			for _, faults := range tt.seeders {
+				seeders = append(seeders, swarm.addSeeder(faults))
+			}
+
+			if result := swarm.download(); !bytes.Equal(result, data) {
+				t.Errorf("downloaded %d bytes that differ from the %d bytes seeded", len(result), len(data))
+			}
+
+			served := 0
+			for _, seeder := range seeders {
+				served += int(seeder.blocks.Load())
+			}
+			if served < len(data)/defaultBlockSize {
+				t.Errorf("seeders served %d blocks, expected at least %d", served, len(data)/defaultBlockSize)
+			}
+		})
+	}
+}
+
+func TestSwarmDownloadRateLimited(t *testing.T) {
+	// every block takes longer than the handshake timeout at this limit
+	defer func(timeout time.Duration) { peerHandshakeTimeout = timeout }(peerHandshakeTimeout)
+	peerHandshakeTimeout = 200 * time.Millisecond
+
+	data := make([]byte, 3*4*defaultBlockSize)
+	for i := range data {
+		data[i] = byte(i * 7 % 253)
+	}
+	swarm := newTestSwarm(t, data, 4*defaultBlockSize)
+	swarm.addSeeder(SeederFaults{})
+
+	if result := swarm.download(WithBandwidthLimits(4*defaultBlockSize, 0)); !bytes.Equal(result, data) {
+		t.Errorf("downloaded %d bytes that differ from the %d bytes seeded", len(result), len(data))
+	}
+}
@@ -0,0 +1,372 @@
+package bittorrent
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+type TorrentMeta struct {
+	Announce      string
+	AnnounceList  [][]string
+	InfoHash      string
+	InfoHashBytes []byte
+	Pieces        []string
+	PieceLength   int
+	Length        int
+	Keys          []File
+	Name          string
+	CreatedBy     string
+	UrlList       []string
+	Private       bool
+	// Info is the bencoded info dictionary, which peers fetch from us when
+	// they only have the info hash
+	Info []byte
+	// MetaVersion is 2 for v2 and hybrid torrents, which also have the
+	// SHA-256 info hash and the merkle hashes of their pieces
+	MetaVersion int
+	Hybrid      bool
+	InfoHashV2  string
+	PiecesV2    []PieceV2
+	// PieceLayers are the piece hashes of every file larger than a piece
+	// by the file's pieces root
+	PieceLayers map[string][][]byte
+}
+
+type PeerSource string
+
+const (
+	PEER_SOURCE_TRACKER         PeerSource = "tracker"
+	PEER_SOURCE_WEB_SEED        PeerSource = "web seed"
+	PEER_SOURCE_LOCAL_DISCOVERY PeerSource = "local discovery"
+)
+
+type File struct {
+	length int
+	path   []string
+	// padding files only align the next file to a piece boundary and are not written
+	padding    bool
+	piecesRoot []byte
+}
+
+// MetainfoError is returned for torrent files that can't be used. Path is
+// where in the metainfo dictionary the problem is, e.g. info.piece length.
+type MetainfoError struct {
+	Path   string
+	Reason string
+}
+
+func (e *MetainfoError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("invalid metainfo: %s", e.Reason)
+	}
+	return fmt.Sprintf("invalid metainfo: %s %s", e.Path, e.Reason)
+}
+
+// ParseTorrent reads the metainfo of a torrent file. Problems with the
+// torrent are reported as *MetainfoErrors, joined if there are several.
+func ParseTorrent(data []byte) (TorrentMeta, error) {
+	return fromBencode(string(data))
+}
+
+func fromBencode(bencode string) (TorrentMeta, error) {
+	decoded, err := decodeBencode(bencode)
+	if err != nil {
+		return TorrentMeta{}, &MetainfoError{Reason: err.Error()}
+	}
+
+	decodedTorrent, ok := decoded.(map[string]interface{})
+	if !ok {
+		return TorrentMeta{}, &MetainfoError{Reason: "torrent is not a dictionary"}
+	}
+	if err := validateMetainfo(decodedTorrent); err != nil {
+		return TorrentMeta{}, err
+	}
+	decodedInfo, err := getMetainfoValue[map[string]interface{}](decodedTorrent, "", "info")
+	if err != nil {
+		return TorrentMeta{}, err
+	}
+
+	meta := TorrentMeta{}
+	meta.Announce, _ = decodedTorrent["announce"].(string)
+	meta.AnnounceList = getAnnounceList(decodedTorrent)
+	meta.CreatedBy, _ = decodedTorrent["created by"].(string)
+	meta.UrlList = getUrlList(decodedTorrent)
+	meta.Private = decodedInfo["private"] == 1
+
+	meta.Info, meta.InfoHashBytes, err = getInfoHash(decodedInfo)
+	if err != nil {
+		return TorrentMeta{}, err
+	}
+	meta.InfoHash = hex.EncodeToString(meta.InfoHashBytes)
+
+	if meta.PieceLength, err = getMetainfoValue[int](decodedInfo, "info", "piece length"); err != nil {
+		return TorrentMeta{}, err
+	}
+	if meta.Name, err = getMetainfoValue[string](decodedInfo, "info", "name"); err != nil {
+		return TorrentMeta{}, err
+	}
+
+	// v2 only torrents have no pieces, hybrid torrents have both layouts
+	if _, ok := decodedInfo["pieces"]; ok {
+		pieces, err := getMetainfoValue[string](decodedInfo, "info", "pieces")
+		if err != nil {
+			return TorrentMeta{}, err
+		}
+		meta.Pieces = getPieceHashes(pieces)
+		if meta.Keys, err = getKeys(decodedInfo); err != nil {
+			return TorrentMeta{}, err
+		}
+		if meta.Length, err = getLength(decodedInfo); err != nil {
+			return TorrentMeta{}, err
+		}
+	}
+
+	meta.MetaVersion = 1
+	if version, ok := decodedInfo["meta version"].(int); ok {
+		meta.MetaVersion = version
+	}
+	if meta.MetaVersion == 2 {
+		meta.Hybrid = meta.Pieces != nil
+		if err := parseV2Info(&meta, decodedTorrent, decodedInfo); err != nil {
+			return TorrentMeta{}, err
+		}
+	}
+
+	return meta, nil
+}
+
+// getMetainfoValue returns the value of key in the dictionary at path,
+// which has to be there and of type T.
+func getMetainfoValue[T any](dict map[string]interface{}, path string, key string) (T, error) {
+	var typed T
+	value, ok := dict[key]
+	if path != "" {
+		key = path + "." + key
+	}
+	if !ok {
+		return typed, &MetainfoError{Path: key, Reason: "is missing"}
+	}
+
+	typed, ok = value.(T)
+	if !ok {
+		var kind string
+		switch any(typed).(type) {
+		case int:
+			kind = "an integer"
+		case string:
+			kind = "a string"
+		case []interface{}:
+			kind = "a list"
+		default:
+			kind = "a dictionary"
+		}
+		return typed, &MetainfoError{Path: key, Reason: "is not " + kind}
+	}
+	return typed, nil
+}
+
+func getKeys(decodedInfo map[string]interface{}) ([]File, error) {
+	// if length is provided it's a single file torrent
+	// if not then it's a multi file torrent with file structure provided in files
+	_, ok := decodedInfo["length"]
+	if ok {
+		return nil, nil
+	}
+
+	entries, err := getMetainfoValue[[]interface{}](decodedInfo, "info", "files")
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []File
+	for i, entry := range entries {
+		path := fmt.Sprintf("info.files[%d]", i)
+		decodedFile, ok := entry.(map[string]interface{})
+		if !ok {
+			return nil, &MetainfoError{Path: path, Reason: "is not a dictionary"}
+		}
+
+		file := File{}
+		if file.length, err = getMetainfoValue[int](decodedFile, path, "length"); err != nil {
+			return nil, err
+		}
+		if attr, ok := decodedFile["attr"].(string); ok {
+			file.padding = strings.Contains(attr, "p")
+		}
+		parts, err := getMetainfoValue[[]interface{}](decodedFile, path, "path")
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range parts {
+			file.path = append(file.path, fmt.Sprint(part))
+		}
+		keys = append(keys, file)
+	}
+	return keys, nil
+}
+
+func getLength(decodedInfo map[string]interface{}) (int, error) {
+	_, ok := decodedInfo["length"]
+	if ok {
+		// if length is provided it's a single file torrent with that length
+		return getMetainfoValue[int](decodedInfo, "info", "length")
+	} else {
+		// if length is not provided it's a multi file torrent
+		// it's length is the sum of length of all individual files
+		keys, err := getKeys(decodedInfo)
+		if err != nil {
+			return 0, err
+		}
+		sumLength := 0
+		for _, file := range keys {
+			sumLength += file.length
+		}
+		return sumLength, nil
+	}
+}
+
+// getAnnounceList returns the tiers of trackers from announce-list (BEP 12).
+func getAnnounceList(decodedTorrent map[string]interface{}) [][]string {
+	tiers, ok := decodedTorrent["announce-list"].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	var announceList [][]string
+	for _, tier := range tiers {
+		urls, ok := tier.([]interface{})
+		if !ok {
+			continue
+		}
+
+		var trackers []string
+		for _, url := range urls {
+			trackers = append(trackers, fmt.Sprint(url))
+		}
+		announceList = append(announceList, trackers)
+	}
+	return announceList
+}
+
+// getTrackers returns every tracker of the torrent once, starting with announce.
+func (t TorrentMeta) getTrackers() []string {
+	seen := make(map[string]bool)
+	var trackers []string
+
+	for _, tier := range append([][]string{{t.Announce}}, t.AnnounceList...) {
+		for _, tracker := range tier {
+			if tracker != "" && !seen[tracker] {
+				seen[tracker] = true
+				trackers = append(trackers, tracker)
+			}
+		}
+	}
+	return trackers
+}
+
+// allowsPeerSource reports whether peers from the source may be used for
+// the torrent. Private torrents (BEP 27) only use their own trackers and
+// web seeds, which are part of the torrent itself.
+func (t TorrentMeta) allowsPeerSource(source PeerSource) bool {
+	if !t.Private {
+		return true
+	}
+	return source == PEER_SOURCE_TRACKER || source == PEER_SOURCE_WEB_SEED
+}
+
+// getUrlList returns the web seeds of the torrent, url-list is either a
+// single url or a list of them.
+func getUrlList(decodedTorrent map[string]interface{}) []string {
+	switch urlList := decodedTorrent["url-list"].(type) {
+	case string:
+		if urlList != "" {
+			return []string{urlList}
+		}
+	case []interface{}:
+		var urls []string
+		for _, url := range urlList {
+			urls = append(urls, fmt.Sprint(url))
+		}
+		return urls
+	}
+	return nil
+}
+
+// getInfoHash returns the bencoded info dictionary and its SHA-1 hash.
+func getInfoHash(infoDict map[string]interface{}) ([]byte, []byte, error) {
+	encoded, err := encodeBencode(infoDict)
+	if err != nil {
+		return nil, nil, &MetainfoError{Path: "info", Reason: fmt.Sprintf("can't be encoded: %s", err)}
+	}
+	hash := sha1.Sum(encoded)
+	return encoded, hash[:], nil
+}
+
+func convertToPieceHash(piece []byte) string {
+	hash := sha1.Sum(piece)
+	var result string
+	for _, number := range hash {
+		result += fmt.Sprintf("%02x", number)
+	}
+	return result
+}
+
+func getPieceHashes(pieces string) []string {
+	piecesAsBytes := []byte(pieces)
+	piecesAsHexStr := hex.EncodeToString(piecesAsBytes)
+	return splitString(piecesAsHexStr, 40)
+}
+
+func splitString(s string, chunkSize int) []string {
+	var chunks []string
+	for i := 0; i < len(s); i += chunkSize {
+		end := i + chunkSize
+		if end > len(s) {
+			end = len(s)
+		}
+		chunks = append(chunks, s[i:end])
+	}
+	return chunks
+}
+
+func getPieceLength(pieceNum int, torrentMeta TorrentMeta) int {
+	// pieces of v2 only torrents end with their file, v1 peers of hybrid
+	// torrents send the padding as well
+	if len(torrentMeta.PiecesV2) > 0 && !torrentMeta.Hybrid {
+		return torrentMeta.PiecesV2[pieceNum].length
+	}
+
+	numOfPieces := len(torrentMeta.Pieces)
+	if numOfPieces-1 != pieceNum {
+		return torrentMeta.PieceLength
+	}
+
+	// the last piece is only shorter if the length isn't a multiple of the piece length
+	lastPieceLength := torrentMeta.Length % torrentMeta.PieceLength
+	if lastPieceLength == 0 {
+		return torrentMeta.PieceLength
+	}
+	return lastPieceLength
+}
+
+// getFiles returns the files of the torrent in the order their data is laid
+// out in the pieces, a single file torrent consists of one file named after
+// the torrent.
+func (t TorrentMeta) getFiles() []File {
+	if len(t.Keys) == 0 {
+		return []File{{length: t.Length, path: []string{t.Name}}}
+	}
+	return t.Keys
+}
+
+// getFilePaths returns the path of every file of the torrent relative to
+// the output, which for single file torrents is just the name.
+func (t TorrentMeta) getFilePaths() []string {
+	var paths []string
+	for _, file := range t.getFiles() {
+		paths = append(paths, strings.Join(file.path, "/"))
+	}
+	return paths
+}
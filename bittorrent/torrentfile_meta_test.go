@@ -0,0 +1,321 @@
+package bittorrent
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestGetPieceLength(t *testing.T) {
+	tests := []struct {
+		pieceNum    int
+		torrentMeta TorrentMeta
+		want        int
+	}{
+		{
+			pieceNum: 0,
+			torrentMeta: TorrentMeta{
+				Pieces:      []string{"piece1", "piece2", "piece3"},
+				PieceLength: 256,
+				Length:      700,
+			},
+			want: 256,
+		},
+		{
+			pieceNum: 2,
+			torrentMeta: TorrentMeta{
+				Pieces:      []string{"piece1", "piece2", "piece3"},
+				PieceLength: 256,
+				Length:      700,
+			},
+			want: 188, // 700 % 256 = 188
+		},
+		{
+			pieceNum: 2,
+			torrentMeta: TorrentMeta{
+				Pieces:      []string{"piece1", "piece2", "piece3"},
+				PieceLength: 256,
+				Length:      768,
+			},
+			want: 256, // 768 is a multiple of 256 so the last piece is full
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			// Use piece number and length to make test name unique and descriptive
+			t.Name()+"/pieceNum="+strconv.Itoa(tt.pieceNum)+"/Length="+strconv.Itoa(tt.torrentMeta.Length),
+			func(t *testing.T) {
+				got := getPieceLength(tt.pieceNum, tt.torrentMeta)
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("getPieceLength() = %v, want %v", got, tt.want)
+				}
+			},
+		)
+	}
+}
+
+func TestGetFilePaths_SingleFile(t *testing.T) {
+	torrent := TorrentMeta{
+		Name: "singlefile.txt",
+		Keys: []File{},
+	}
+
+	expected := []string{"singlefile.txt"}
+	if paths := torrent.getFilePaths(); !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected %q but got %q", expected, paths)
+	}
+}
+
+func TestGetFilePaths_MultiFile(t *testing.T) {
+	torrent := TorrentMeta{
+		Name: "multifile",
+		Keys: []File{
+			{path: []string{"dir1", "file1.txt"}},
+			{path: []string{"dir2", "file2.txt"}},
+			{path: []string{"dir3", "file3.txt"}},
+		},
+	}
+
+	expected := []string{
+		"dir1/file1.txt",
+		"dir2/file2.txt",
+		"dir3/file3.txt",
+	}
+	if paths := torrent.getFilePaths(); !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected %q but got %q", expected, paths)
+	}
+}
+
+func TestConvertToPieceHash(t *testing.T) {
+	tests := []struct {
+		name     string
+		piece    []byte
+		expected string
+	}{
+		{
+			name:     "Empty slice",
+			piece:    []byte{},
+			expected: "da39a3ee5e6b4b0d3255bfef95601890afd80709", // SHA-1 hash of an empty string
+		},
+		{
+			name:     "Single byte slice",
+			piece:    []byte{0x61},                               // 'a'
+			expected: "86f7e437faa5a7fce15d1ddcb9eaeaea377667b8", // SHA-1 hash of "a"
+		},
+		{
+			name:     "String",
+			piece:    []byte("The quick brown fox jumps over the lazy dog"),
+			expected: "2fd4e1c67a2d28fced849ee1bb76e7391b93eb12", // SHA-1 hash of "The quick brown fox jumps over the lazy dog"
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := convertToPieceHash(tt.piece)
+			if result != tt.expected {
+				t.Errorf("convertToPieceHash(%v) = %v, expected %v", tt.piece, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestGetPieceHashes(t *testing.T) {
+	tests := []struct {
+		name     string
+		pieces   string
+		expected []string
+	}{
+		{
+			name:     "Empty string",
+			pieces:   "",
+			expected: []string{},
+		},
+		{
+			name:   "Hashes",
+			pieces: "abcdefghijabcdefghijabcdefghijabcdefghijabcdefghij", // 50 bytes -> 100 hex chars
+			expected: []string{
+				"6162636465666768696a6162636465666768696a", // hex encoding of "abcdefghijabcdefghij"
+				"6162636465666768696a6162636465666768696a", // hex encoding of "abcdefghijabcdefghij"
+				"6162636465666768696a",                     // hex encoding of "abcdefghij"
+			},
+		},
+		{
+			name:   "Exact multiple of hash length",
+			pieces: "01234567890123456789012345678901", // 32 bytes -> 64 hex chars
+			expected: []string{
+				"3031323334353637383930313233343536373839", // hex encoding of "01234567890123456789"
+				"303132333435363738393031",                 // hex encoding of "012345678901"
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := getPieceHashes(tt.pieces)
+			if len(result) != len(tt.expected) {
+				t.Errorf("getPieceHashes(%q) returned %v, expected %v", tt.pieces, result, tt.expected)
+				return
+			}
+			for i := range result {
+				if result[i] != tt.expected[i] {
+					t.Errorf("getPieceHashes(%q)[%d] = %v, expected %v", tt.pieces, i, result[i], tt.expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGetLength(t *testing.T) {
+	tests := []struct {
+		name        string
+		decodedInfo map[string]interface{}
+		expected    int
+	}{
+		{
+			name: "Single file torrent with length",
+			decodedInfo: map[string]interface{}{
+				"length": 1024,
+			},
+			expected: 1024,
+		},
+		{
+			name: "Multi file torrent",
+			decodedInfo: map[string]interface{}{
+				"files": []interface{}{
+					map[string]interface{}{"length": 1024, "path": []interface{}{"a"}},
+					map[string]interface{}{"length": 2048, "path": []interface{}{"b"}},
+					map[string]interface{}{"length": 4096, "path": []interface{}{"c"}},
+				},
+			},
+			expected: 7168, // sum of all file lengths
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := getLength(tt.decodedInfo)
+			if err != nil || result != tt.expected {
+				t.Errorf("getLength(%v) = %d, expected %d", tt.decodedInfo, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestGetKeys(t *testing.T) {
+	decodedInfo := map[string]interface{}{
+		"files": []interface{}{
+			map[string]interface{}{"length": 10, "path": []interface{}{"dir", "a.txt"}},
+			map[string]interface{}{"length": 20, "path": []interface{}{"b.txt"}},
+		},
+	}
+
+	expected := []File{
+		{length: 10, path: []string{"dir", "a.txt"}},
+		{length: 20, path: []string{"b.txt"}},
+	}
+
+	result, err := getKeys(decodedInfo)
+	if err != nil || !reflect.DeepEqual(result, expected) {
+		t.Errorf("getKeys() = %v, %v, expected %v", result, err, expected)
+	}
+
+	if keys, err := getKeys(map[string]interface{}{"length": 10}); keys != nil || err != nil {
+		t.Errorf("expected no keys for a single file torrent")
+	}
+}
+
+func TestGetUrlList(t *testing.T) {
+	tests := []struct {
+		name     string
+		decoded  map[string]interface{}
+		expected []string
+	}{
+		{
+			name:     "Single url",
+			decoded:  map[string]interface{}{"url-list": "http://mirror/file"},
+			expected: []string{"http://mirror/file"},
+		},
+		{
+			name:     "List of urls",
+			decoded:  map[string]interface{}{"url-list": []interface{}{"http://a/", "http://b/"}},
+			expected: []string{"http://a/", "http://b/"},
+		},
+		{
+			name:     "Missing",
+			decoded:  map[string]interface{}{},
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := getUrlList(tt.decoded); !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("getUrlList() = %v, expected %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestGetTrackers(t *testing.T) {
+	decodedTorrent := map[string]interface{}{
+		"announce-list": []interface{}{
+			[]interface{}{"http://a/announce", "http://b/announce"},
+			[]interface{}{"udp://c:80"},
+		},
+	}
+
+	torrentMeta := TorrentMeta{Announce: "http://b/announce", AnnounceList: getAnnounceList(decodedTorrent)}
+
+	expected := []string{"http://b/announce", "http://a/announce", "udp://c:80"}
+	if result := torrentMeta.getTrackers(); !reflect.DeepEqual(result, expected) {
+		t.Errorf("getTrackers() = %v, expected %v", result, expected)
+	}
+}
+
+func TestPrivateTorrent(t *testing.T) {
+	tests := []struct {
+		name     string
+		private  string
+		expected bool
+		sources  map[PeerSource]bool
+	}{
+		{
+			name:     "Private",
+			private:  "7:privatei1e",
+			expected: true,
+			sources: map[PeerSource]bool{
+				PEER_SOURCE_TRACKER:         true,
+				PEER_SOURCE_WEB_SEED:        true,
+				PEER_SOURCE_LOCAL_DISCOVERY: false,
+			},
+		},
+		{
+			name:    "Private set to zero",
+			private: "7:privatei0e",
+			sources: map[PeerSource]bool{PEER_SOURCE_TRACKER: true, PEER_SOURCE_WEB_SEED: true, PEER_SOURCE_LOCAL_DISCOVERY: true},
+		},
+		{
+			name:    "Public",
+			sources: map[PeerSource]bool{PEER_SOURCE_TRACKER: true, PEER_SOURCE_WEB_SEED: true, PEER_SOURCE_LOCAL_DISCOVERY: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bencode := "d8:announce13:http://a/anno4:infod6:lengthi3e4:name1:a12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaa" + tt.private + "ee"
+			torrentMeta, err := fromBencode(bencode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if torrentMeta.Private != tt.expected {
+				t.Errorf("Private = %v, expected %v", torrentMeta.Private, tt.expected)
+			}
+			for source, expected := range tt.sources {
+				if result := torrentMeta.allowsPeerSource(source); result != expected {
+					t.Errorf("allowsPeerSource(%s) = %v, expected %v", source, result, expected)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package bittorrent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// merkleBlockSize is the size of the leaves of the per file merkle trees of
+// BitTorrent v2 (BEP 52).
+const merkleBlockSize = 16 * 1024
+
+// PieceV2 is what a piece of a v2 or hybrid torrent is verified against.
+// Pieces are aligned to files, so a piece only has data of one file.
+type PieceV2 struct {
+	hash []byte
+	// length is the number of bytes of file data in the piece, the rest is padding
+	length int
+	// leaves is the number of 16 KiB blocks the hash is computed over,
+	// missing blocks are zero hashes
+	leaves int
+}
+
+// parseV2Info reads the file tree and piece layers of a v2 or hybrid
+// torrent into the metadata.
+func parseV2Info(meta *TorrentMeta, decodedTorrent map[string]interface{}, decodedInfo map[string]interface{}) error {
+	encodedInfo, err := encodeBencode(decodedInfo)
+	if err != nil {
+		return &MetainfoError{Path: "info", Reason: fmt.Sprintf("can't be encoded: %s", err)}
+	}
+	infoHash := sha256.Sum256(encodedInfo)
+	meta.InfoHashV2 = hex.EncodeToString(infoHash[:])
+
+	if meta.PieceLength < merkleBlockSize || meta.PieceLength&(meta.PieceLength-1) != 0 {
+		return &MetainfoError{Path: "info.piece length", Reason: fmt.Sprintf("%d of a v2 torrent is not a power of two of at least 16 KiB", meta.PieceLength)}
+	}
+
+	fileTree, err := getMetainfoValue[map[string]interface{}](decodedInfo, "info", "file tree")
+	if err != nil {
+		return err
+	}
+	files, err := getFileTree(fileTree, nil)
+	if err != nil {
+		return err
+	}
+	pieceLayers, _ := decodedTorrent["piece layers"].(map[string]interface{})
+	meta.PieceLayers = make(map[string][][]byte)
+
+	// v2 only torrents get the padding that hybrid torrents have in their
+	// v1 file list, so both lay out pieces the same way
+	var layout []File
+	for i, file := range files {
+		layout = append(layout, file)
+		if file.length == 0 {
+			continue
+		}
+
+		pieces, err := getV2Pieces(file, meta.PieceLength, pieceLayers)
+		if err != nil {
+			return err
+		}
+		meta.PiecesV2 = append(meta.PiecesV2, pieces...)
+		if len(pieces) > 1 {
+			layer := make([][]byte, len(pieces))
+			for i, piece := range pieces {
+				layer[i] = piece.hash
+			}
+			meta.PieceLayers[string(file.piecesRoot)] = layer
+		}
+
+		if padding := (meta.PieceLength - file.length%meta.PieceLength) % meta.PieceLength; padding > 0 && i < len(files)-1 {
+			layout = append(layout, File{length: padding, path: []string{".pad", strconv.Itoa(padding)}, padding: true})
+		}
+	}
+
+	if meta.Hybrid {
+		if len(meta.PiecesV2) != len(meta.Pieces) {
+			return &MetainfoError{Path: "info.pieces", Reason: fmt.Sprintf("has %d v1 pieces but the file tree has %d v2 pieces", len(meta.Pieces), len(meta.PiecesV2))}
+		}
+		return nil
+	}
+
+	// v2 only torrents have no SHA-1 hashes, peers and trackers know them by
+	// the truncated SHA-256 info hash
+	meta.InfoHashBytes = infoHash[:20]
+	meta.InfoHash = hex.EncodeToString(meta.InfoHashBytes)
+	meta.Pieces = nil
+	for _, piece := range meta.PiecesV2 {
+		meta.Pieces = append(meta.Pieces, hex.EncodeToString(piece.hash))
+	}
+
+	meta.Length = 0
+	for _, file := range layout {
+		meta.Length += file.length
+	}
+	if len(layout) == 1 && len(layout[0].path) == 1 && layout[0].path[0] == meta.Name {
+		meta.Keys = nil
+	} else {
+		meta.Keys = layout
+	}
+	return nil
+}
+
+// getFileTree flattens the file tree dictionary, files are the entries with
+// an empty key. Keys are sorted like in the bencoded dictionary.
+func getFileTree(tree map[string]interface{}, path []string) ([]File, error) {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var files []File
+	for _, name := range names {
+		node, ok := tree[name].(map[string]interface{})
+		if !ok {
+			return nil, &MetainfoError{Path: getFileTreePath(append(path, name)), Reason: "is not a dictionary"}
+		}
+		if name == "" {
+			length, err := getMetainfoValue[int](node, getFileTreePath(append(path, name)), "length")
+			if err != nil {
+				return nil, err
+			}
+			file := File{length: length, path: path}
+			if root, ok := node["pieces root"].(string); ok {
+				file.piecesRoot = []byte(root)
+			}
+			return []File{file}, nil
+		}
+
+		children, err := getFileTree(node, append(append([]string{}, path...), name))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, children...)
+	}
+	return files, nil
+}
+
+// getFileTreePath returns the dictionary path of a node of the file tree.
+func getFileTreePath(path []string) string {
+	return strings.Join(append([]string{"info", "file tree"}, path...), ".")
+}
+
+// getV2Pieces returns the pieces of a file. Files larger than a piece have a
+// piece layer which is checked against the pieces root, the pieces root of
+// smaller files is the hash of their only piece.
+func getV2Pieces(file File, pieceLength int, pieceLayers map[string]interface{}) ([]PieceV2, error) {
+	if len(file.piecesRoot) != sha256.Size {
+		return nil, &MetainfoError{Path: getFileTreePath(append(file.path, "", "pieces root")), Reason: "is not a SHA-256 hash"}
+	}
+
+	blocks := (file.length + merkleBlockSize - 1) / merkleBlockSize
+	if file.length <= pieceLength {
+		return []PieceV2{{hash: file.piecesRoot, length: file.length, leaves: nextPowerOfTwo(blocks)}}, nil
+	}
+
+	layer, ok := pieceLayers[string(file.piecesRoot)].(string)
+	count := (file.length + pieceLength - 1) / pieceLength
+	if !ok || len(layer) != count*sha256.Size {
+		return nil, &MetainfoError{Path: "piece layers", Reason: fmt.Sprintf("have no valid layer for %s", strings.Join(file.path, "/"))}
+	}
+
+	leaves := pieceLength / merkleBlockSize
+	hashes := splitHashes([]byte(layer))
+	padding := merkleRoot(nil, leaves, make([]byte, sha256.Size))
+	if !bytes.Equal(merkleRoot(hashes, nextPowerOfTwo(count), padding), file.piecesRoot) {
+		return nil, &MetainfoError{Path: "piece layers", Reason: fmt.Sprintf("of %s don't match its pieces root", strings.Join(file.path, "/"))}
+	}
+
+	pieces := make([]PieceV2, count)
+	for i := range pieces {
+		pieces[i] = PieceV2{hash: hashes[i], length: min(pieceLength, file.length-i*pieceLength), leaves: leaves}
+	}
+	return pieces, nil
+}
+
+// verifyPiece checks the piece against its SHA-1 hash and, for v2 and
+// hybrid torrents, against the merkle tree of its file.
+func (t TorrentMeta) verifyPiece(index int, data []byte) bool {
+	if len(t.PiecesV2) > 0 {
+		piece := t.PiecesV2[index]
+		if len(data) < piece.length {
+			return false
+		}
+
+		var hashes [][]byte
+		for start := 0; start < piece.length; start += merkleBlockSize {
+			hash := sha256.Sum256(data[start:min(start+merkleBlockSize, piece.length)])
+			hashes = append(hashes, hash[:])
+		}
+		if !bytes.Equal(merkleRoot(hashes, piece.leaves, make([]byte, sha256.Size)), piece.hash) {
+			return false
+		}
+
+		if !t.Hybrid {
+			return true
+		}
+	}
+
+	return convertToPieceHash(data) == t.Pieces[index]
+}
+
+// merkleRoot returns the root of the tree over the hashes, filled up to
+// width leaves with the padding hash.
+func merkleRoot(hashes [][]byte, width int, padding []byte) []byte {
+	layer := make([][]byte, width)
+	for i := range layer {
+		if i < len(hashes) {
+			layer[i] = hashes[i]
+		} else {
+			layer[i] = padding
+		}
+	}
+
+	for len(layer) > 1 {
+		layer = parentLayer(layer)
+	}
+	return layer[0]
+}
+
+// parentLayer returns the layer of the merkle tree above the given one.
+func parentLayer(layer [][]byte) [][]byte {
+	parents := make([][]byte, len(layer)/2)
+	for i := range parents {
+		hash := sha256.Sum256(append(append([]byte{}, layer[2*i]...), layer[2*i+1]...))
+		parents[i] = hash[:]
+	}
+	return parents
+}
+
+func splitHashes(data []byte) [][]byte {
+	var hashes [][]byte
+	for start := 0; start+sha256.Size <= len(data); start += sha256.Size {
+		hashes = append(hashes, data[start:start+sha256.Size])
+	}
+	return hashes
+}
+
+func nextPowerOfTwo(n int) int {
+	power := 1
+	for power < n {
+		power *= 2
+	}
+	return power
+}
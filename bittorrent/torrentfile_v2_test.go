@@ -0,0 +1,264 @@
+package bittorrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func sha256Of(parts ...[]byte) []byte {
+	hash := sha256.Sum256(bytes.Join(parts, nil))
+	return hash[:]
+}
+
+func encodeTestTorrent(t *testing.T, torrent map[string]interface{}) string {
+	encoded, err := encodeBencode(torrent)
+	if err != nil {
+		t.Fatalf("failed to encode torrent: %v", err)
+	}
+	return string(encoded)
+}
+
+// v2TestFiles returns a file of three blocks and a small file, with the
+// merkle hashes for a piece length of two blocks computed by hand.
+func v2TestFiles() (big []byte, small []byte, layer []byte, bigRoot []byte, smallRoot []byte) {
+	big = bytes.Repeat([]byte("abc"), merkleBlockSize)[:3*merkleBlockSize]
+	small = []byte("small file")
+
+	blocks := [][]byte{sha256Of(big[:merkleBlockSize]), sha256Of(big[merkleBlockSize : 2*merkleBlockSize]), sha256Of(big[2*merkleBlockSize:])}
+	piece0 := sha256Of(blocks[0], blocks[1])
+	piece1 := sha256Of(blocks[2], make([]byte, 32))
+
+	return big, small, append(piece0, piece1...), sha256Of(piece0, piece1), sha256Of(small)
+}
+
+func TestFromBencodeV2(t *testing.T) {
+	big, small, layer, bigRoot, smallRoot := v2TestFiles()
+
+	info := map[string]interface{}{
+		"name":         "v2",
+		"piece length": 2 * merkleBlockSize,
+		"meta version": 2,
+		"file tree": map[string]interface{}{
+			"big.bin": map[string]interface{}{"": map[string]interface{}{"length": len(big), "pieces root": string(bigRoot)}},
+			"dir": map[string]interface{}{
+				"small.txt": map[string]interface{}{"": map[string]interface{}{"length": len(small), "pieces root": string(smallRoot)}},
+			},
+		},
+	}
+	torrent := map[string]interface{}{
+		"announce":     "http://tracker/announce",
+		"info":         info,
+		"piece layers": map[string]interface{}{string(bigRoot): string(layer)},
+	}
+
+	meta, err := fromBencode(encodeTestTorrent(t, torrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encodedInfo, _ := encodeBencode(info)
+	infoHash := sha256Of(encodedInfo)
+	if meta.InfoHashV2 != hex.EncodeToString(infoHash) || !bytes.Equal(meta.InfoHashBytes, infoHash[:20]) {
+		t.Errorf("info hash = %s, %x, expected %x", meta.InfoHashV2, meta.InfoHashBytes, infoHash)
+	}
+
+	expectedKeys := []File{
+		{length: len(big), path: []string{"big.bin"}, piecesRoot: bigRoot},
+		{length: merkleBlockSize, path: []string{".pad", "16384"}, padding: true},
+		{length: len(small), path: []string{"dir", "small.txt"}, piecesRoot: smallRoot},
+	}
+	if !reflect.DeepEqual(meta.Keys, expectedKeys) {
+		t.Errorf("Keys = %+v, expected %+v", meta.Keys, expectedKeys)
+	}
+	if meta.Length != 4*merkleBlockSize+len(small) || len(meta.Pieces) != 3 {
+		t.Errorf("Length = %d with %d pieces", meta.Length, len(meta.Pieces))
+	}
+
+	pieces := [][]byte{big[:2*merkleBlockSize], big[2*merkleBlockSize:], small}
+	for i, piece := range pieces {
+		if length := getPieceLength(i, meta); length != len(piece) {
+			t.Errorf("getPieceLength(%d) = %d, expected %d", i, length, len(piece))
+		}
+		if !meta.verifyPiece(i, piece) {
+			t.Errorf("verifyPiece(%d) failed for valid data", i)
+		}
+		corrupted := bytes.Clone(piece)
+		corrupted[len(corrupted)-1] ^= 1
+		if meta.verifyPiece(i, corrupted) {
+			t.Errorf("verifyPiece(%d) passed for corrupted data", i)
+		}
+	}
+}
+
+func TestFromBencodeV2RejectsBadPieceLayer(t *testing.T) {
+	big, _, layer, bigRoot, _ := v2TestFiles()
+	layer[0] ^= 1
+
+	torrent := map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         "big.bin",
+			"piece length": 2 * merkleBlockSize,
+			"meta version": 2,
+			"file tree": map[string]interface{}{
+				"big.bin": map[string]interface{}{"": map[string]interface{}{"length": len(big), "pieces root": string(bigRoot)}},
+			},
+		},
+		"piece layers": map[string]interface{}{string(bigRoot): string(layer)},
+	}
+
+	_, err := fromBencode(encodeTestTorrent(t, torrent))
+	var metainfoErr *MetainfoError
+	if !errors.As(err, &metainfoErr) || metainfoErr.Path != "piece layers" {
+		t.Errorf("fromBencode() error = %v, expected the piece layer to be rejected", err)
+	}
+}
+
+func TestFromBencodeHybrid(t *testing.T) {
+	big, small, layer, bigRoot, smallRoot := v2TestFiles()
+	pieceLength := 2 * merkleBlockSize
+
+	// v1 peers see the padding as part of the data
+	data := append(append(bytes.Clone(big), make([]byte, merkleBlockSize)...), small...)
+	var pieces []byte
+	for start := 0; start < len(data); start += pieceLength {
+		hash := sha1.Sum(data[start:min(start+pieceLength, len(data))])
+		pieces = append(pieces, hash[:]...)
+	}
+
+	info := map[string]interface{}{
+		"name":         "hybrid",
+		"piece length": pieceLength,
+		"meta version": 2,
+		"pieces":       string(pieces),
+		"files": []interface{}{
+			map[string]interface{}{"length": len(big), "path": []interface{}{"big.bin"}},
+			map[string]interface{}{"length": merkleBlockSize, "path": []interface{}{".pad", "16384"}, "attr": "p"},
+			map[string]interface{}{"length": len(small), "path": []interface{}{"dir", "small.txt"}},
+		},
+		"file tree": map[string]interface{}{
+			"big.bin": map[string]interface{}{"": map[string]interface{}{"length": len(big), "pieces root": string(bigRoot)}},
+			"dir": map[string]interface{}{
+				"small.txt": map[string]interface{}{"": map[string]interface{}{"length": len(small), "pieces root": string(smallRoot)}},
+			},
+		},
+	}
+	torrent := map[string]interface{}{"info": info, "piece layers": map[string]interface{}{string(bigRoot): string(layer)}}
+
+	meta, err := fromBencode(encodeTestTorrent(t, torrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encodedInfo, _ := encodeBencode(info)
+	if !meta.Hybrid || meta.InfoHash != convertToPieceHash(encodedInfo) || meta.InfoHashV2 != hex.EncodeToString(sha256Of(encodedInfo)) {
+		t.Errorf("hybrid torrent has Hybrid %v, info hashes %s and %s", meta.Hybrid, meta.InfoHash, meta.InfoHashV2)
+	}
+	if !meta.Keys[1].padding || meta.Length != len(data) {
+		t.Errorf("padding file not recognized: %+v, Length %d", meta.Keys, meta.Length)
+	}
+
+	for i := range meta.Pieces {
+		start := i * pieceLength
+		piece := data[start:min(start+getPieceLength(i, meta), len(data))]
+		if !meta.verifyPiece(i, piece) {
+			t.Errorf("verifyPiece(%d) failed for valid data", i)
+		}
+	}
+
+	priorities, _ := parseFileSelection("", meta.getFiles())
+	if !reflect.DeepEqual(priorities, []int{PRIORITY_NORMAL, PRIORITY_SKIP, PRIORITY_NORMAL}) {
+		t.Errorf("parseFileSelection() = %v, expected the padding file to be skipped", priorities)
+	}
+}
+
+func TestCreateHashResponse(t *testing.T) {
+	big, _, _, bigRoot, smallRoot := v2TestFiles()
+	blocks := [][]byte{sha256Of(big[:merkleBlockSize]), sha256Of(big[merkleBlockSize : 2*merkleBlockSize]), sha256Of(big[2*merkleBlockSize:])}
+	padding := make([]byte, 32)
+
+	// with pieces of one block the piece layer is the block layer
+	torrent := map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         "big.bin",
+			"piece length": merkleBlockSize,
+			"meta version": 2,
+			"file tree": map[string]interface{}{
+				"big.bin": map[string]interface{}{"": map[string]interface{}{"length": len(big), "pieces root": string(bigRoot)}},
+			},
+		},
+		"piece layers": map[string]interface{}{string(bigRoot): string(bytes.Join(blocks, nil))},
+	}
+	meta, err := fromBencode(encodeTestTorrent(t, torrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		request  HashRequest
+		expected [][]byte
+	}{
+		{
+			name:     "Hashes with uncle",
+			request:  HashRequest{piecesRoot: bigRoot, baseLayer: 0, index: 2, length: 2, proofLayers: 1},
+			expected: [][]byte{blocks[2], padding, sha256Of(blocks[0], blocks[1])},
+		},
+		{
+			name:     "Hashes without proof",
+			request:  HashRequest{piecesRoot: bigRoot, baseLayer: 0, index: 0, length: 2, proofLayers: 0},
+			expected: [][]byte{blocks[0], blocks[1]},
+		},
+		{
+			name:     "Whole layer needs no uncles",
+			request:  HashRequest{piecesRoot: bigRoot, baseLayer: 0, index: 0, length: 4, proofLayers: 3},
+			expected: [][]byte{blocks[0], blocks[1], blocks[2], padding},
+		},
+		{
+			name:    "Layer other than the piece layer",
+			request: HashRequest{piecesRoot: bigRoot, baseLayer: 1, index: 0, length: 2},
+		},
+		{
+			name:    "Unaligned index",
+			request: HashRequest{piecesRoot: bigRoot, baseLayer: 0, index: 1, length: 2},
+		},
+		{
+			name:    "Length not a power of two",
+			request: HashRequest{piecesRoot: bigRoot, baseLayer: 0, index: 0, length: 3},
+		},
+		{
+			name:    "Beyond the layer",
+			request: HashRequest{piecesRoot: bigRoot, baseLayer: 0, index: 4, length: 2},
+		},
+		{
+			name:    "File without piece layer",
+			request: HashRequest{piecesRoot: smallRoot, baseLayer: 0, index: 0, length: 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := createHashResponse(meta, createHashMessage(hashRequest, tt.request, nil)[4:])
+			if err != nil {
+				t.Fatalf("createHashResponse() unexpected error %v", err)
+			}
+
+			request, hashList, err := parseHashMessage(response[4:])
+			if err != nil || !reflect.DeepEqual(request, tt.request) {
+				t.Fatalf("parseHashMessage() = %+v, %v", request, err)
+			}
+
+			id := byte(hashes)
+			if tt.expected == nil {
+				id = hashReject
+			}
+			if response[4] != id || !reflect.DeepEqual(hashList, tt.expected) {
+				t.Errorf("got message %d with %x, expected message %d with %x", response[4], hashList, id, tt.expected)
+			}
+		})
+	}
+}
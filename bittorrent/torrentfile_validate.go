@@ -0,0 +1,172 @@
+package bittorrent
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// validateMetainfo checks the decoded torrent before it's used and reports
+// every problem it finds, joined into one error of *MetainfoErrors.
+func validateMetainfo(decodedTorrent map[string]interface{}) error {
+	var problems []error
+	report := func(err error) {
+		problems = append(problems, err)
+	}
+
+	info, err := getMetainfoValue[map[string]interface{}](decodedTorrent, "", "info")
+	if err != nil {
+		return err
+	}
+
+	pieceLength, err := getMetainfoValue[int](info, "info", "piece length")
+	if err != nil {
+		report(err)
+	} else if pieceLength <= 0 {
+		report(&MetainfoError{Path: "info.piece length", Reason: fmt.Sprintf("is %d, it has to be positive", pieceLength)})
+	}
+
+	if name, err := getMetainfoValue[string](info, "info", "name"); err != nil {
+		report(err)
+	} else if !isSafeFileName(name) {
+		report(&MetainfoError{Path: "info.name", Reason: fmt.Sprintf("%q is not a safe file name", name)})
+	}
+
+	// v2 only torrents describe their files in the file tree instead
+	v2 := info["meta version"] == 2
+	if _, ok := info["pieces"]; !ok && v2 {
+		if tree, err := getMetainfoValue[map[string]interface{}](info, "info", "file tree"); err != nil {
+			report(err)
+		} else {
+			validateFileTree(tree, nil, report)
+		}
+		return errors.Join(problems...)
+	}
+	if tree, ok := info["file tree"].(map[string]interface{}); ok && v2 {
+		validateFileTree(tree, nil, report)
+	}
+
+	length, lengthValid := validateFileLengths(info, report)
+
+	pieces, err := getMetainfoValue[string](info, "info", "pieces")
+	if err != nil {
+		report(err)
+		return errors.Join(problems...)
+	}
+	if len(pieces)%20 != 0 {
+		report(&MetainfoError{Path: "info.pieces", Reason: fmt.Sprintf("has %d bytes, which is not a multiple of 20", len(pieces))})
+	} else if lengthValid && pieceLength > 0 {
+		if expected := (length + pieceLength - 1) / pieceLength; len(pieces)/20 != expected {
+			report(&MetainfoError{Path: "info.pieces", Reason: fmt.Sprintf("has %d hashes but %d bytes are %d pieces", len(pieces)/20, length, expected)})
+		}
+	}
+
+	return errors.Join(problems...)
+}
+
+// validateFileLengths checks the length of a single file torrent or the
+// files of a multi file torrent and returns the total length if it's valid.
+func validateFileLengths(info map[string]interface{}, report func(error)) (int, bool) {
+	if _, ok := info["length"]; ok {
+		length, err := getMetainfoValue[int](info, "info", "length")
+		if err != nil {
+			report(err)
+			return 0, false
+		}
+		if length < 0 {
+			report(&MetainfoError{Path: "info.length", Reason: fmt.Sprintf("is negative: %d", length)})
+			return 0, false
+		}
+		return length, true
+	}
+
+	if _, ok := info["files"]; !ok {
+		report(&MetainfoError{Path: "info", Reason: "has neither length nor files"})
+		return 0, false
+	}
+	files, err := getMetainfoValue[[]interface{}](info, "info", "files")
+	if err != nil {
+		report(err)
+		return 0, false
+	}
+
+	total, valid := 0, true
+	for i, entry := range files {
+		path := fmt.Sprintf("info.files[%d]", i)
+		file, ok := entry.(map[string]interface{})
+		if !ok {
+			report(&MetainfoError{Path: path, Reason: "is not a dictionary"})
+			valid = false
+			continue
+		}
+
+		if length, err := getMetainfoValue[int](file, path, "length"); err != nil {
+			report(err)
+			valid = false
+		} else if length < 0 {
+			report(&MetainfoError{Path: path + ".length", Reason: fmt.Sprintf("is negative: %d", length)})
+			valid = false
+		} else {
+			total += length
+		}
+
+		parts, err := getMetainfoValue[[]interface{}](file, path, "path")
+		if err != nil {
+			report(err)
+			continue
+		}
+		if len(parts) == 0 {
+			report(&MetainfoError{Path: path + ".path", Reason: "is empty"})
+		}
+		for j, part := range parts {
+			if name, ok := part.(string); !ok || !isSafeFileName(name) {
+				report(&MetainfoError{Path: fmt.Sprintf("%s.path[%d]", path, j), Reason: fmt.Sprintf("%q is not a safe file name", fmt.Sprint(part))})
+			}
+		}
+	}
+	return total, valid
+}
+
+// validateFileTree checks the names and lengths of a v2 file tree.
+func validateFileTree(tree map[string]interface{}, path []string, report func(error)) {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		nodePath := append(append([]string{}, path...), name)
+		node, ok := tree[name].(map[string]interface{})
+		if !ok {
+			report(&MetainfoError{Path: getFileTreePath(nodePath), Reason: "is not a dictionary"})
+			continue
+		}
+
+		if name == "" {
+			if len(path) == 0 {
+				report(&MetainfoError{Path: getFileTreePath(nodePath), Reason: "is a file without a name"})
+			}
+			if length, err := getMetainfoValue[int](node, getFileTreePath(nodePath), "length"); err != nil {
+				report(err)
+			} else if length < 0 {
+				report(&MetainfoError{Path: getFileTreePath(nodePath) + ".length", Reason: fmt.Sprintf("is negative: %d", length)})
+			}
+			continue
+		}
+
+		if !isSafeFileName(name) {
+			report(&MetainfoError{Path: getFileTreePath(nodePath), Reason: fmt.Sprintf("%q is not a safe file name", name)})
+			continue
+		}
+		validateFileTree(node, nodePath, report)
+	}
+}
+
+// isSafeFileName reports whether name can be used as one element of a path
+// below the output without leaving it.
+func isSafeFileName(name string) bool {
+	return name != "." && !strings.ContainsAny(name, "/\\\x00") && filepath.IsLocal(name)
+}
@@ -0,0 +1,136 @@
+package bittorrent
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestValidateMetainfo(t *testing.T) {
+	hashes := func(count int) string { return string(make([]byte, 20*count)) }
+
+	tests := []struct {
+		name     string
+		info     map[string]interface{}
+		expected []string
+	}{
+		{
+			name:     "Valid single file",
+			info:     map[string]interface{}{"name": "a.txt", "length": 40, "piece length": 16, "pieces": hashes(3)},
+			expected: nil,
+		},
+		{
+			name: "Valid multi file",
+			info: map[string]interface{}{"name": "dir", "piece length": 16, "pieces": hashes(2), "files": []interface{}{
+				map[string]interface{}{"length": 10, "path": []interface{}{"sub", "a.txt"}},
+				map[string]interface{}{"length": 10, "path": []interface{}{"b.txt"}},
+			}},
+			expected: nil,
+		},
+		{
+			name:     "Missing piece length and bad pieces",
+			info:     map[string]interface{}{"name": "a.txt", "length": 40, "pieces": "short"},
+			expected: []string{"info.piece length", "info.pieces"},
+		},
+		{
+			name:     "Piece count inconsistent with length",
+			info:     map[string]interface{}{"name": "a.txt", "length": 40, "piece length": 16, "pieces": hashes(2)},
+			expected: []string{"info.pieces"},
+		},
+		{
+			name:     "Negative lengths",
+			info:     map[string]interface{}{"name": "a.txt", "length": -1, "piece length": -16, "pieces": hashes(1)},
+			expected: []string{"info.piece length", "info.length"},
+		},
+		{
+			name: "Path traversal",
+			info: map[string]interface{}{"name": "..", "piece length": 16, "pieces": hashes(1), "files": []interface{}{
+				map[string]interface{}{"length": 5, "path": []interface{}{"..", "etc", "passwd"}},
+				map[string]interface{}{"length": 5, "path": []interface{}{"a/../../b"}},
+				map[string]interface{}{"length": -5, "path": []interface{}{}},
+			}},
+			expected: []string{"info.name", "info.files[0].path[0]", "info.files[1].path[0]", "info.files[2].length", "info.files[2].path"},
+		},
+		{
+			name: "Unsafe v2 file tree",
+			info: map[string]interface{}{"name": "v2", "piece length": 16384, "meta version": 2, "file tree": map[string]interface{}{
+				"..":  map[string]interface{}{"": map[string]interface{}{"length": 1}},
+				"a":   map[string]interface{}{"": map[string]interface{}{"length": -1}},
+				"dir": "not a dictionary",
+			}},
+			expected: []string{"info.file tree...", "info.file tree.a..length", "info.file tree.dir"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateMetainfo(map[string]interface{}{"info": tt.info})
+
+			var paths []string
+			if joined, ok := err.(interface{ Unwrap() []error }); ok {
+				for _, problem := range joined.Unwrap() {
+					var metainfoErr *MetainfoError
+					if !errors.As(problem, &metainfoErr) {
+						t.Fatalf("problem %v is not a MetainfoError", problem)
+					}
+					paths = append(paths, metainfoErr.Path)
+				}
+			} else if err != nil {
+				t.Fatalf("validateMetainfo() unexpected error %v", err)
+			}
+
+			if !reflect.DeepEqual(paths, tt.expected) {
+				t.Errorf("validateMetainfo() reported %q, expected %q: %v", paths, tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestCheckFilePaths(t *testing.T) {
+	tests := []struct {
+		name   string
+		meta   TorrentMeta
+		path   string
+		reason string
+	}{
+		{name: "Single file", meta: TorrentMeta{Name: "a.txt"}},
+		{name: "Nested files", meta: TorrentMeta{Name: "dir", Keys: []File{{path: []string{"sub", "a.txt"}}}}},
+		{name: "Absolute name", meta: TorrentMeta{Name: "/etc/passwd"}, path: "info.name", reason: `"/etc/passwd" is not a safe file name`},
+		{
+			name:   "Parent directory",
+			meta:   TorrentMeta{Name: "dir", Keys: []File{{path: []string{"a.txt"}}, {path: []string{"sub", ".."}}}},
+			path:   "info.files[1].path[1]",
+			reason: `".." is not a safe file name`,
+		},
+		{
+			name:   "Separator in a name",
+			meta:   TorrentMeta{Name: "dir", Keys: []File{{path: []string{"../a.txt"}}}},
+			path:   "info.files[0].path[0]",
+			reason: `"../a.txt" is not a safe file name`,
+		},
+		{name: "Empty path", meta: TorrentMeta{Name: "dir", Keys: []File{{path: nil}}}, path: "info.files[0].path", reason: "is empty"},
+		{
+			name:   "File tree of a v2 torrent",
+			meta:   TorrentMeta{Name: "dir", MetaVersion: 2, Keys: []File{{path: []string{"sub", ".."}}}},
+			path:   "info.file tree.sub...",
+			reason: `".." is not a safe file name`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkFilePaths(tt.meta)
+			if tt.path == "" {
+				if err != nil {
+					t.Errorf("checkFilePaths() unexpected error %v", err)
+				}
+				return
+			}
+
+			var metainfoErr *MetainfoError
+			if !errors.As(err, &metainfoErr) || metainfoErr.Path != tt.path || metainfoErr.Reason != tt.reason {
+				t.Errorf("checkFilePaths() = %v, expected %s %s", err, tt.path, tt.reason)
+			}
+		})
+	}
+}
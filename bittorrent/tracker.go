@@ -0,0 +1,353 @@
+package bittorrent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type TrackerRequest struct {
+	InfoHash   []byte
+	PeerId     string
+	Ip         string
+	Port       int
+	Uploaded   int
+	Downloaded int
+	Left       int
+	Compact    int
+}
+
+type Tracker struct {
+	Complete       int
+	Incomplete     int
+	Interval       int
+	MinInterval    int
+	TrackerId      string
+	Warning        *TrackerWarningError
+	Peers          []netip.AddrPort
+	TrackerRequest TrackerRequest
+}
+
+type TrackerResponse struct {
+	Complete    int
+	Incomplete  int
+	Interval    int
+	MinInterval int
+	TrackerId   string
+	Warning     *TrackerWarningError
+	Peers       []netip.AddrPort
+}
+
+// TrackerFailureError is returned when the tracker refuses the announce
+// with a failure reason. It is not retried.
+type TrackerFailureError struct {
+	Reason string
+}
+
+// TrackerWarningError carries the warning message of an announce that
+// otherwise succeeded.
+type TrackerWarningError struct {
+	Message string
+}
+
+// TrackerError is returned when the announce to a tracker failed, Err is
+// the failure reason or why the tracker couldn't be reached.
+type TrackerError struct {
+	Url string
+	Err error
+}
+
+func (e *TrackerError) Error() string {
+	return fmt.Sprintf("announce to %s failed: %s", e.Url, e.Err)
+}
+
+func (e *TrackerError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TrackerFailureError) Error() string {
+	return fmt.Sprintf("tracker failure: %s", e.Reason)
+}
+
+func (e *TrackerWarningError) Error() string {
+	return fmt.Sprintf("tracker warning: %s", e.Message)
+}
+
+const maxAnnounceAttempts = 5
+
+// announceBackoff is the delay before the first retry, it doubles with every attempt
+var announceBackoff = time.Second
+
+// fromTorrentMeta announces to the tracker of the torrent, closing stop
+// cancels the retries.
+func fromTorrentMeta(network *PeerNetwork, torrentMeta TorrentMeta, stop <-chan struct{}) (Tracker, error) {
+	tracker := Tracker{}
+	tracker.TrackerRequest = newTrackerRequest(network, torrentMeta)
+	err := tracker.announce(torrentMeta.Announce, stop)
+
+	return tracker, err
+}
+
+func newTrackerRequest(network *PeerNetwork, torrentMeta TorrentMeta) TrackerRequest {
+	request := TrackerRequest{}
+	request.InfoHash = torrentMeta.InfoHashBytes
+	request.PeerId = string(network.peerId)
+	request.Port = network.port
+	// peers outside the NAT have to use the address mapped on the gateway
+	if network.mapping != nil {
+		external := network.mapping.externalAddress()
+		request.Port = int(external.Port())
+		if external.Addr().IsValid() {
+			request.Ip = external.Addr().String()
+		}
+	}
+	request.Uploaded = 0
+	request.Downloaded = 0
+	request.Left = torrentMeta.Length
+	request.Compact = 1
+	return request
+}
+
+// announce retries failed requests with exponential backoff, unless the
+// tracker refused the announce with a failure reason. It returns
+// ErrDownloadStopped if stop is closed while it waits for a retry.
+func (t *Tracker) announce(trackerUrl string, stop <-chan struct{}) error {
+	backoff := announceBackoff
+
+	var err error
+	for attempt := 1; attempt <= maxAnnounceAttempts; attempt++ {
+		var response TrackerResponse
+		response, err = getTrackerData(*t, trackerUrl)
+		if err == nil {
+			t.update(response)
+			return nil
+		}
+
+		var failure *TrackerFailureError
+		if errors.As(err, &failure) {
+			return &TrackerError{Url: trackerUrl, Err: err}
+		}
+
+		log.Debug().Msg(fmt.Sprintf("announce attempt %d to %s failed: %s", attempt, trackerUrl, err))
+		if attempt < maxAnnounceAttempts {
+			select {
+			case <-time.After(backoff):
+			case <-stop:
+				return ErrDownloadStopped
+			}
+			backoff *= 2
+		}
+	}
+
+	return &TrackerError{Url: trackerUrl, Err: fmt.Errorf("tracker not reachable after %d attempts: %w", maxAnnounceAttempts, err)}
+}
+
+func (t *Tracker) update(response TrackerResponse) {
+	t.Complete = response.Complete
+	t.Incomplete = response.Incomplete
+	t.Interval = response.Interval
+	t.MinInterval = response.MinInterval
+	t.Warning = response.Warning
+	t.Peers = response.Peers
+
+	// the tracker id is only sent when it changes, it has to be kept otherwise
+	if response.TrackerId != "" {
+		t.TrackerId = response.TrackerId
+	}
+
+	if t.Warning != nil {
+		log.Warn().Msg(t.Warning.Error())
+	}
+}
+
+func getTrackerData(tracker Tracker, trackerUrl string) (TrackerResponse, error) {
+	announceUrl, err := tracker.getAnnounceUrl(trackerUrl)
+	if err != nil {
+		return TrackerResponse{}, err
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	response, err := client.Get(announceUrl)
+	if err != nil {
+		return TrackerResponse{}, fmt.Errorf("failed to get response from tracker: %w", err)
+	}
+
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return TrackerResponse{}, fmt.Errorf("failed to read response from tracker: %w", err)
+	}
+
+	return parseTrackerResponse(string(body))
+}
+
+func parseTrackerResponse(body string) (TrackerResponse, error) {
+	trackerResponse := TrackerResponse{}
+
+	decodedBody, err := decodeBencode(body)
+	if err != nil {
+		return trackerResponse, fmt.Errorf("failed to decode response from tracker: %w", err)
+	}
+
+	response, ok := decodedBody.(map[string]interface{})
+	if !ok {
+		return trackerResponse, errors.New("tracker response is not a dictionary")
+	}
+
+	if reason, ok := response["failure reason"]; ok {
+		return trackerResponse, &TrackerFailureError{Reason: fmt.Sprint(reason)}
+	}
+
+	if message, ok := response["warning message"]; ok {
+		trackerResponse.Warning = &TrackerWarningError{Message: fmt.Sprint(message)}
+	}
+
+	interval, ok := response["interval"].(int)
+	if !ok {
+		return trackerResponse, errors.New("tracker response has no interval")
+	}
+	trackerResponse.Interval = interval
+
+	// the remaining fields are optional
+	trackerResponse.MinInterval, _ = response["min interval"].(int)
+	trackerResponse.Complete, _ = response["complete"].(int)
+	trackerResponse.Incomplete, _ = response["incomplete"].(int)
+	trackerResponse.TrackerId, _ = response["tracker id"].(string)
+
+	trackerResponse.Peers, err = getPeersFromResponse(response)
+	if err != nil {
+		return trackerResponse, fmt.Errorf("failed to parse peers from tracker: %w", err)
+	}
+
+	return trackerResponse, nil
+}
+
+// getPeersFromResponse reads the peers of an announce response, which come
+// either as a compact string or as a list of dictionaries, together with
+// the compact IPv6 peers in peers6.
+func getPeersFromResponse(response map[string]interface{}) ([]netip.AddrPort, error) {
+	var peers []netip.AddrPort
+	var err error
+
+	switch peersField := response["peers"].(type) {
+	case string:
+		peers, err = peersStringToIpList(peersField)
+	case []interface{}:
+		peers, err = peersListToIpList(peersField)
+	case nil:
+		peers = []netip.AddrPort{}
+	default:
+		err = fmt.Errorf("unexpected peers field %v", peersField)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if peers6Field, ok := response["peers6"].(string); ok {
+		peers6, err := peers6StringToIpList(peers6Field)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, peers6...)
+	}
+
+	return peers, nil
+}
+
+// getAnnounceUrl adds the announce parameters to the query the tracker URL
+// already has, private trackers put the passkey there.
+func (t Tracker) getAnnounceUrl(trackerUrl string) (string, error) {
+	announceUrl, err := url.Parse(trackerUrl)
+	if err != nil {
+		return "", fmt.Errorf("invalid tracker url: %w", err)
+	}
+
+	query := announceUrl.Query()
+	for key, values := range t.getTrackerRequestQueryParams() {
+		for _, value := range values {
+			query.Add(key, value)
+		}
+	}
+	announceUrl.RawQuery = query.Encode()
+	return announceUrl.String(), nil
+}
+
+func (t Tracker) getTrackerRequestQueryParams() url.Values {
+	params := url.Values{}
+	params.Add("info_hash", string(t.TrackerRequest.InfoHash))
+	params.Add("peer_id", t.TrackerRequest.PeerId)
+	params.Add("port", fmt.Sprint(t.TrackerRequest.Port))
+	if t.TrackerRequest.Ip != "" {
+		params.Add("ip", t.TrackerRequest.Ip)
+	}
+	params.Add("uploaded", fmt.Sprint(t.TrackerRequest.Uploaded))
+	params.Add("downloaded", fmt.Sprint(t.TrackerRequest.Downloaded))
+	params.Add("left", fmt.Sprint(t.TrackerRequest.Left))
+	params.Add("compact", fmt.Sprint(t.TrackerRequest.Compact))
+	if t.TrackerId != "" {
+		params.Add("trackerid", t.TrackerId)
+	}
+
+	return params
+}
+
+// peersStringToIpList parses compact IPv4 peers, 4 bytes of address
+// followed by 2 bytes of port each.
+func peersStringToIpList(peersString string) ([]netip.AddrPort, error) {
+	return compactPeersToIpList(peersString, net.IPv4len)
+}
+
+// peers6StringToIpList parses compact IPv6 peers, 16 bytes of address
+// followed by 2 bytes of port each.
+func peers6StringToIpList(peersString string) ([]netip.AddrPort, error) {
+	return compactPeersToIpList(peersString, net.IPv6len)
+}
+
+func compactPeersToIpList(peersString string, addressLength int) ([]netip.AddrPort, error) {
+	entryLength := addressLength + 2
+	if len(peersString)%entryLength != 0 {
+		return nil, fmt.Errorf("compact peers length %d is not a multiple of %d", len(peersString), entryLength)
+	}
+
+	peers := make([]netip.AddrPort, 0)
+	for k := 0; k < len(peersString); k += entryLength {
+		address, _ := netip.AddrFromSlice([]byte(peersString[k : k+addressLength]))
+		port := binary.BigEndian.Uint16([]byte(peersString[k+addressLength : k+entryLength]))
+		peers = append(peers, netip.AddrPortFrom(address, port))
+	}
+	return peers, nil
+}
+
+// peersListToIpList parses the dictionary model of the peers list. Peers
+// announced with a hostname instead of an address are skipped.
+func peersListToIpList(peersList []interface{}) ([]netip.AddrPort, error) {
+	peers := make([]netip.AddrPort, 0)
+	for _, entry := range peersList {
+		peer, ok := entry.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unexpected peer entry %v", entry)
+		}
+
+		ip, ipOk := peer["ip"].(string)
+		port, portOk := peer["port"].(int)
+		if !ipOk || !portOk || port < 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid peer entry %v", peer)
+		}
+
+		address, err := netip.ParseAddr(ip)
+		if err != nil {
+			log.Debug().Msg(fmt.Sprintf("skipping peer with hostname %s", ip))
+			continue
+		}
+		peers = append(peers, netip.AddrPortFrom(address.Unmap(), uint16(port)))
+	}
+	return peers, nil
+}
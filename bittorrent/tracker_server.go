@@ -0,0 +1,306 @@
+package bittorrent
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultTrackerAddress  = ":6969"
+	DefaultTrackerInterval = 30 * time.Minute
+	defaultNumWant         = 50
+	maxNumWant             = 200
+)
+
+// TrackerServer is an HTTP tracker that keeps its swarms in memory. Peers
+// that don't announce again within the interval are dropped.
+type TrackerServer struct {
+	interval time.Duration
+	// whitelist holds the raw info hashes that may be tracked, nil allows any
+	whitelist map[string]bool
+	mu        sync.Mutex
+	torrents  map[string]*TrackerSwarm
+}
+
+type TrackerSwarm struct {
+	peers      map[string]*TrackerPeer
+	downloaded int
+}
+
+type TrackerPeer struct {
+	peerId   string
+	address  netip.AddrPort
+	left     int
+	lastSeen time.Time
+}
+
+type AnnounceRequest struct {
+	infoHash string
+	peerId   string
+	address  netip.AddrPort
+	left     int
+	event    string
+	numWant  int
+	compact  bool
+	noPeerId bool
+}
+
+func NewTrackerServer(interval time.Duration, whitelist map[string]bool) *TrackerServer {
+	return &TrackerServer{interval: interval, whitelist: whitelist, torrents: make(map[string]*TrackerSwarm)}
+}
+
+// ParseTrackerWhitelist reads hex info hashes, one per line. Empty lines
+// and lines starting with # are skipped.
+func ParseTrackerWhitelist(content string) (map[string]bool, error) {
+	whitelist := make(map[string]bool)
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		infoHash, err := hex.DecodeString(line)
+		if err != nil || len(infoHash) != 20 {
+			return nil, fmt.Errorf("line %d is not a hex info hash: %s", i+1, line)
+		}
+		whitelist[string(infoHash)] = true
+	}
+	return whitelist, nil
+}
+
+// NewTrackerHandler serves announce and scrape requests. Errors are
+// reported in a bencoded failure reason like any other tracker does.
+func NewTrackerHandler(server *TrackerServer) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /announce", func(w http.ResponseWriter, r *http.Request) {
+		request, err := parseAnnounceRequest(r)
+		if err != nil {
+			writeBencode(w, map[string]interface{}{"failure reason": err.Error()})
+			return
+		}
+
+		response, err := server.announce(request, time.Now())
+		if err != nil {
+			writeBencode(w, map[string]interface{}{"failure reason": err.Error()})
+			return
+		}
+		writeBencode(w, response)
+	})
+
+	mux.HandleFunc("GET /scrape", func(w http.ResponseWriter, r *http.Request) {
+		writeBencode(w, server.scrape(r.URL.Query()["info_hash"], time.Now()))
+	})
+
+	return mux
+}
+
+func writeBencode(w http.ResponseWriter, body map[string]interface{}) {
+	encoded, err := encodeBencode(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	if _, err := w.Write(encoded); err != nil {
+		log.Debug().Msg(fmt.Sprintf("[Tracker] failed to write response: %s", err))
+	}
+}
+
+// parseAnnounceRequest reads the announce parameters. The address is taken
+// from the ip parameter if there is one, which clients behind a NAT send.
+func parseAnnounceRequest(r *http.Request) (AnnounceRequest, error) {
+	query := r.URL.Query()
+
+	request := AnnounceRequest{
+		infoHash: query.Get("info_hash"),
+		peerId:   query.Get("peer_id"),
+		event:    query.Get("event"),
+		numWant:  defaultNumWant,
+		compact:  query.Get("compact") == "1",
+		noPeerId: query.Get("no_peer_id") == "1",
+	}
+	if len(request.infoHash) != 20 {
+		return request, errors.New("invalid info_hash")
+	}
+	if len(request.peerId) != 20 {
+		return request, errors.New("invalid peer_id")
+	}
+
+	port, err := strconv.Atoi(query.Get("port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return request, errors.New("invalid port")
+	}
+
+	request.left, err = strconv.Atoi(query.Get("left"))
+	if err != nil || request.left < 0 {
+		return request, errors.New("invalid left")
+	}
+
+	if numWant := query.Get("numwant"); numWant != "" {
+		request.numWant, err = strconv.Atoi(numWant)
+		if err != nil || request.numWant < 0 {
+			return request, errors.New("invalid numwant")
+		}
+		request.numWant = min(request.numWant, maxNumWant)
+	}
+
+	ip, err := netip.ParseAddr(query.Get("ip"))
+	if err != nil {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return request, err
+		}
+		if ip, err = netip.ParseAddr(host); err != nil {
+			return request, err
+		}
+	}
+	request.address = netip.AddrPortFrom(ip.Unmap(), uint16(port))
+	return request, nil
+}
+
+func (s *TrackerServer) announce(request AnnounceRequest, now time.Time) (map[string]interface{}, error) {
+	if s.whitelist != nil && !s.whitelist[request.infoHash] {
+		return nil, errors.New("torrent is not tracked here")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	swarm := s.getSwarm(request.infoHash, now)
+	switch request.event {
+	case "stopped":
+		delete(swarm.peers, request.peerId)
+	case "completed":
+		swarm.downloaded++
+		fallthrough
+	default:
+		swarm.peers[request.peerId] = &TrackerPeer{peerId: request.peerId, address: request.address, left: request.left, lastSeen: now}
+	}
+
+	complete, incomplete := swarm.count()
+	response := map[string]interface{}{
+		"interval":     int(s.interval / time.Second),
+		"min interval": int(s.interval / 2 / time.Second),
+		"complete":     complete,
+		"incomplete":   incomplete,
+	}
+
+	// a random selection spreads the load over the swarm
+	var peers []*TrackerPeer
+	for _, peer := range swarm.peers {
+		if peer.peerId != request.peerId {
+			peers = append(peers, peer)
+		}
+	}
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	peers = peers[:min(len(peers), request.numWant)]
+
+	if request.compact {
+		var peers4, peers6 []byte
+		for _, peer := range peers {
+			compact := binary.BigEndian.AppendUint16(peer.address.Addr().AsSlice(), peer.address.Port())
+			if peer.address.Addr().Is4() {
+				peers4 = append(peers4, compact...)
+			} else {
+				peers6 = append(peers6, compact...)
+			}
+		}
+		response["peers"] = string(peers4)
+		if len(peers6) > 0 {
+			response["peers6"] = string(peers6)
+		}
+	} else {
+		list := []interface{}{}
+		for _, peer := range peers {
+			entry := map[string]interface{}{"ip": peer.address.Addr().String(), "port": int(peer.address.Port())}
+			if !request.noPeerId {
+				entry["peer id"] = peer.peerId
+			}
+			list = append(list, entry)
+		}
+		response["peers"] = list
+	}
+	return response, nil
+}
+
+// scrape returns the stats of the torrents, of all of them if no info hash
+// is given.
+func (s *TrackerServer) scrape(infoHashes []string, now time.Time) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(infoHashes) == 0 {
+		for infoHash := range s.torrents {
+			infoHashes = append(infoHashes, infoHash)
+		}
+	}
+
+	files := map[string]interface{}{}
+	for _, infoHash := range infoHashes {
+		swarm, ok := s.torrents[infoHash]
+		if !ok && (s.whitelist == nil || !s.whitelist[infoHash]) {
+			continue
+		}
+		if ok {
+			s.expirePeers(swarm, now)
+		} else {
+			swarm = &TrackerSwarm{}
+		}
+
+		complete, incomplete := swarm.count()
+		files[infoHash] = map[string]interface{}{
+			"complete":   complete,
+			"incomplete": incomplete,
+			"downloaded": swarm.downloaded,
+		}
+	}
+	return map[string]interface{}{"files": files}
+}
+
+func (s *TrackerServer) getSwarm(infoHash string, now time.Time) *TrackerSwarm {
+	swarm, ok := s.torrents[infoHash]
+	if !ok {
+		swarm = &TrackerSwarm{peers: make(map[string]*TrackerPeer)}
+		s.torrents[infoHash] = swarm
+	}
+	s.expirePeers(swarm, now)
+	return swarm
+}
+
+func (s *TrackerServer) expirePeers(swarm *TrackerSwarm, now time.Time) {
+	for peerId, peer := range swarm.peers {
+		if now.Sub(peer.lastSeen) > s.interval {
+			delete(swarm.peers, peerId)
+		}
+	}
+}
+
+// count returns the number of seeders and leechers.
+func (t *TrackerSwarm) count() (int, int) {
+	complete := 0
+	for _, peer := range t.peers {
+		if peer.left == 0 {
+			complete++
+		}
+	}
+	return complete, len(t.peers) - complete
+}
+
+func RunTracker(address string, server *TrackerServer) error {
+	log.Info().Msg(fmt.Sprintf("[Tracker] listening on %s", address))
+	return http.ListenAndServe(address, NewTrackerHandler(server))
+}
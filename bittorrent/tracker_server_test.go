@@ -0,0 +1,234 @@
+package bittorrent
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const trackerTestHash = "12345678901234567890"
+
+func newTestTracker(t *testing.T, whitelist map[string]bool) (*TrackerServer, string) {
+	server := NewTrackerServer(time.Minute, whitelist)
+	httpServer := httptest.NewServer(NewTrackerHandler(server))
+	t.Cleanup(httpServer.Close)
+	return server, httpServer.URL + "/announce"
+}
+
+func testTrackerRequest(peerId string, port int, left int) Tracker {
+	return Tracker{TrackerRequest: TrackerRequest{
+		InfoHash: []byte(trackerTestHash),
+		PeerId:   peerId,
+		Port:     port,
+		Left:     left,
+		Compact:  1,
+	}}
+}
+
+func TestTrackerServerAnnounce(t *testing.T) {
+	_, announceUrl := newTestTracker(t, nil)
+
+	seeder := testTrackerRequest("-GB0001-seeder000000", 6881, 0)
+	response, err := getTrackerData(seeder, announceUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Interval != 60 || response.MinInterval != 30 || len(response.Peers) != 0 || response.Complete != 1 {
+		t.Errorf("unexpected response to first announce %+v", response)
+	}
+
+	leecher := testTrackerRequest("-GB0001-leecher00000", 6882, 100)
+	leecher.TrackerRequest.Ip = "192.0.2.10"
+	response, err = getTrackerData(leecher, announceUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []netip.AddrPort{netip.MustParseAddrPort("127.0.0.1:6881")}
+	if !reflect.DeepEqual(response.Peers, expected) || response.Complete != 1 || response.Incomplete != 1 {
+		t.Errorf("unexpected response %+v, expected peers %v", response, expected)
+	}
+
+	// the ip parameter is used over the address the request came from
+	response, err = getTrackerData(seeder, announceUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []netip.AddrPort{netip.MustParseAddrPort("192.0.2.10:6882")}
+	if !reflect.DeepEqual(response.Peers, expected) {
+		t.Errorf("peers = %v, expected %v", response.Peers, expected)
+	}
+}
+
+func TestTrackerServerPeerLists(t *testing.T) {
+	server, announceUrl := newTestTracker(t, nil)
+
+	now := time.Now()
+	for _, peer := range []AnnounceRequest{
+		{infoHash: trackerTestHash, peerId: "-GB0001-aaaaaaaaaaaa", address: netip.MustParseAddrPort("10.0.0.1:6881")},
+		{infoHash: trackerTestHash, peerId: "-GB0001-bbbbbbbbbbbb", address: netip.MustParseAddrPort("[2001:db8::1]:6882")},
+	} {
+		if _, err := server.announce(peer, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []netip.AddrPort{netip.MustParseAddrPort("10.0.0.1:6881"), netip.MustParseAddrPort("[2001:db8::1]:6882")}
+	for _, compact := range []int{0, 1} {
+		tracker := testTrackerRequest("-GB0001-cccccccccccc", 6883, 100)
+		tracker.TrackerRequest.Compact = compact
+		response, err := getTrackerData(tracker, announceUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		peers := response.Peers
+		if len(peers) == 2 && peers[0].Addr().Is6() {
+			peers[0], peers[1] = peers[1], peers[0]
+		}
+		if !reflect.DeepEqual(peers, expected) {
+			t.Errorf("compact=%d: peers = %v, expected %v", compact, peers, expected)
+		}
+	}
+
+	response, err := server.announce(AnnounceRequest{infoHash: trackerTestHash, peerId: "-GB0001-dddddddddddd", numWant: 1, noPeerId: true}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := response["peers"].([]interface{})
+	if len(peers) != 1 {
+		t.Fatalf("expected numwant to limit the peers to one, got %v", peers)
+	}
+	if _, ok := peers[0].(map[string]interface{})["peer id"]; ok {
+		t.Errorf("expected no peer id with no_peer_id")
+	}
+}
+
+func TestTrackerServerExpiresPeers(t *testing.T) {
+	server := NewTrackerServer(time.Minute, nil)
+
+	start := time.Now()
+	first := AnnounceRequest{infoHash: trackerTestHash, peerId: "-GB0001-aaaaaaaaaaaa", address: netip.MustParseAddrPort("10.0.0.1:6881"), numWant: 10}
+	second := AnnounceRequest{infoHash: trackerTestHash, peerId: "-GB0001-bbbbbbbbbbbb", address: netip.MustParseAddrPort("10.0.0.2:6881"), numWant: 10}
+
+	server.announce(first, start)
+	response, _ := server.announce(second, start.Add(30*time.Second))
+	if len(response["peers"].([]interface{})) != 1 {
+		t.Errorf("expected the first peer within the interval")
+	}
+
+	response, _ = server.announce(second, start.Add(90*time.Second))
+	if len(response["peers"].([]interface{})) != 0 {
+		t.Errorf("expected the first peer to expire after the interval")
+	}
+
+	second.event = "stopped"
+	server.announce(second, start.Add(91*time.Second))
+	files := server.scrape(nil, start.Add(91*time.Second))["files"].(map[string]interface{})
+	stats := files[trackerTestHash].(map[string]interface{})
+	if stats["complete"] != 0 || stats["incomplete"] != 0 {
+		t.Errorf("expected an empty swarm after stopped, got %v", stats)
+	}
+}
+
+func TestTrackerServerScrape(t *testing.T) {
+	_, announceUrl := newTestTracker(t, nil)
+
+	for _, tracker := range []Tracker{
+		testTrackerRequest("-GB0001-seeder000000", 6881, 0),
+		testTrackerRequest("-GB0001-leecher00000", 6882, 100),
+	} {
+		if _, err := getTrackerData(tracker, announceUrl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	completed := testTrackerRequest("-GB0001-leecher00000", 6882, 0)
+	query := completed.getTrackerRequestQueryParams()
+	query.Set("event", "completed")
+	response, err := http.Get(announceUrl + "?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	result, err := scrapeTracker(announceUrl, []byte(trackerTestHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ScrapeResult{Complete: 2, Incomplete: 0, Downloaded: 1}
+	if result != expected {
+		t.Errorf("scrapeTracker() = %+v, expected %+v", result, expected)
+	}
+}
+
+func TestTrackerServerWhitelist(t *testing.T) {
+	whitelist, err := ParseTrackerWhitelist("# tracked torrents\n3132333435363738393031323334353637383930\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !whitelist[trackerTestHash] || len(whitelist) != 1 {
+		t.Fatalf("ParseTrackerWhitelist() = %v", whitelist)
+	}
+	if _, err := ParseTrackerWhitelist("not a hash"); err == nil {
+		t.Errorf("expected an error for an invalid line")
+	}
+
+	_, announceUrl := newTestTracker(t, whitelist)
+
+	if _, err := getTrackerData(testTrackerRequest("-GB0001-seeder000000", 6881, 0), announceUrl); err != nil {
+		t.Errorf("expected the whitelisted torrent to be tracked, got %v", err)
+	}
+
+	other := testTrackerRequest("-GB0001-seeder000000", 6881, 0)
+	other.TrackerRequest.InfoHash = []byte("abcdefghijabcdefghij")
+	_, err = getTrackerData(other, announceUrl)
+	if err == nil || !strings.Contains(err.Error(), "not tracked") {
+		t.Errorf("expected a failure for a torrent that isn't whitelisted, got %v", err)
+	}
+
+	if _, err := scrapeTracker(announceUrl, []byte("abcdefghijabcdefghij")); err == nil {
+		t.Errorf("expected scrape of a torrent that isn't whitelisted to fail")
+	}
+}
+
+func TestTrackerServerInvalidAnnounce(t *testing.T) {
+	_, announceUrl := newTestTracker(t, nil)
+
+	tests := []struct {
+		name   string
+		modify func(query url.Values)
+	}{
+		{"Short info hash", func(query url.Values) { query.Set("info_hash", "short") }},
+		{"Missing peer id", func(query url.Values) { query.Del("peer_id") }},
+		{"Invalid port", func(query url.Values) { query.Set("port", "70000") }},
+		{"Negative left", func(query url.Values) { query.Set("left", "-1") }},
+		{"Invalid numwant", func(query url.Values) { query.Set("numwant", "many") }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := testTrackerRequest("-GB0001-seeder000000", 6881, 0).getTrackerRequestQueryParams()
+			tt.modify(query)
+
+			response, err := http.Get(announceUrl + "?" + query.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+
+			body, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := parseTrackerResponse(string(body)); err == nil {
+				t.Errorf("expected a failure reason, got %q", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,342 @@
+package bittorrent
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetTrackerRequestQueryParams(t *testing.T) {
+	tests := []struct {
+		tracker Tracker
+		want    string
+	}{
+		{
+			tracker: Tracker{
+				TrackerRequest: TrackerRequest{
+					InfoHash:   []byte("12345678901234567890"),
+					PeerId:     "00112233445566778899",
+					Port:       6881,
+					Uploaded:   0,
+					Downloaded: 0,
+					Left:       1000,
+					Compact:    1,
+				},
+			},
+			want: "compact=1&downloaded=0&info_hash=12345678901234567890&left=1000&peer_id=00112233445566778899&port=6881&uploaded=0",
+		},
+		{
+			tracker: Tracker{
+				TrackerRequest: TrackerRequest{
+					InfoHash: []byte("09876543210987654321"),
+					PeerId:   "00112233445566778899",
+					Ip:       "203.0.113.7",
+					Port:     7881,
+					Left:     1000,
+					Compact:  1,
+				},
+			},
+			want: "compact=1&downloaded=0&info_hash=09876543210987654321&ip=203.0.113.7&left=1000&peer_id=00112233445566778899&port=7881&uploaded=0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.tracker.TrackerRequest.InfoHash), func(t *testing.T) {
+			got := tt.tracker.getTrackerRequestQueryParams().Encode()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getTrackerRequestQueryParams() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPeersStringToIpList(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []netip.AddrPort
+		wantErr  bool
+	}{
+		{
+			input: string([]byte{
+				192, 168, 1, 1, 0x1F, 0x90, // 192.168.1.1:8080
+				127, 0, 0, 1, 0x00, 0x50, // 127.0.0.1:80
+			}),
+			expected: []netip.AddrPort{
+				netip.MustParseAddrPort("192.168.1.1:8080"),
+				netip.MustParseAddrPort("127.0.0.1:80"),
+			},
+		},
+		{
+			input: string([]byte{
+				10, 0, 0, 1, 0x1F, 0x90, // 10.0.0.1:8080
+			}),
+			expected: []netip.AddrPort{
+				netip.MustParseAddrPort("10.0.0.1:8080"),
+			},
+		},
+		{
+			input:    string([]byte{}),
+			expected: []netip.AddrPort{},
+		},
+		{
+			input: string([]byte{
+				10, 0, 0, 1, 0x1F, // truncated entry
+			}),
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		result, err := peersStringToIpList(test.input)
+		if (err != nil) != test.wantErr {
+			t.Errorf("Expected error %v but got %v", test.wantErr, err)
+		}
+		if len(result) != len(test.expected) {
+			t.Errorf("Expected length %d but got %d", len(test.expected), len(result))
+		}
+		for i := range result {
+			if result[i] != test.expected[i] {
+				t.Errorf("Expected %s but got %s", test.expected[i], result[i])
+			}
+		}
+	}
+}
+
+func TestPeers6StringToIpList(t *testing.T) {
+	input := string([]byte{
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x1A, 0xE1, // [2001:db8::1]:6881
+	})
+
+	result, err := peers6StringToIpList(input)
+	if err != nil {
+		t.Fatalf("peers6StringToIpList() unexpected error %v", err)
+	}
+
+	expected := []netip.AddrPort{netip.MustParseAddrPort("[2001:db8::1]:6881")}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("peers6StringToIpList() = %v, expected %v", result, expected)
+	}
+
+	if _, err := peers6StringToIpList(input[:17]); err == nil {
+		t.Errorf("expected error for truncated peers6")
+	}
+}
+
+func TestGetPeersFromResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		response map[string]interface{}
+		expected []netip.AddrPort
+		wantErr  bool
+	}{
+		{
+			name: "Compact peers and peers6",
+			response: map[string]interface{}{
+				"peers":  string([]byte{10, 0, 0, 1, 0x1A, 0xE1}),
+				"peers6": string([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x1A, 0xE2}),
+			},
+			expected: []netip.AddrPort{
+				netip.MustParseAddrPort("10.0.0.1:6881"),
+				netip.MustParseAddrPort("[::1]:6882"),
+			},
+		},
+		{
+			name: "Dictionary peers",
+			response: map[string]interface{}{
+				"peers": []interface{}{
+					map[string]interface{}{"peer id": "-GB0001-000000000000", "ip": "10.0.0.2", "port": 6881},
+					map[string]interface{}{"ip": "2001:db8::2", "port": 51413},
+					map[string]interface{}{"ip": "::ffff:10.0.0.3", "port": 6881},
+					map[string]interface{}{"ip": "tracker.example.com", "port": 6881},
+				},
+			},
+			expected: []netip.AddrPort{
+				netip.MustParseAddrPort("10.0.0.2:6881"),
+				netip.MustParseAddrPort("[2001:db8::2]:51413"),
+				netip.MustParseAddrPort("10.0.0.3:6881"),
+			},
+		},
+		{
+			name:     "No peers",
+			response: map[string]interface{}{"interval": 1800},
+			expected: []netip.AddrPort{},
+		},
+		{
+			name: "Invalid port",
+			response: map[string]interface{}{
+				"peers": []interface{}{map[string]interface{}{"ip": "10.0.0.2", "port": 70000}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := getPeersFromResponse(tt.response)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getPeersFromResponse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("getPeersFromResponse() = %v, expected %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseTrackerResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected TrackerResponse
+		wantErr  error
+	}{
+		{
+			name: "All fields",
+			body: "d8:completei5e10:incompletei3e8:intervali1800e12:min intervali900e5:peers6:" +
+				string([]byte{10, 0, 0, 1, 0x1A, 0xE1}) + "10:tracker id3:abc15:warning message4:slowe",
+			expected: TrackerResponse{
+				Complete:    5,
+				Incomplete:  3,
+				Interval:    1800,
+				MinInterval: 900,
+				TrackerId:   "abc",
+				Warning:     &TrackerWarningError{Message: "slow"},
+				Peers:       []netip.AddrPort{netip.MustParseAddrPort("10.0.0.1:6881")},
+			},
+		},
+		{
+			name:    "Failure reason",
+			body:    "d14:failure reason17:torrent not founde",
+			wantErr: &TrackerFailureError{Reason: "torrent not found"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseTrackerResponse(tt.body)
+			if !reflect.DeepEqual(err, tt.wantErr) {
+				t.Fatalf("parseTrackerResponse() error = %v, expected %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("parseTrackerResponse() = %+v, expected %+v", result, tt.expected)
+			}
+		})
+	}
+
+	for _, body := range []string{"not bencode", "l4:spame", "d5:peers0:e"} {
+		if _, err := parseTrackerResponse(body); err == nil {
+			t.Errorf("parseTrackerResponse(%q) expected error", body)
+		}
+	}
+}
+
+func TestGetAnnounceUrl(t *testing.T) {
+	tracker := Tracker{TrackerRequest: TrackerRequest{InfoHash: []byte("12345678901234567890"), PeerId: "00112233445566778899", Port: 6881}}
+	params := "compact=0&downloaded=0&info_hash=12345678901234567890&left=0&peer_id=00112233445566778899&port=6881&uploaded=0"
+
+	tests := []struct {
+		name       string
+		trackerUrl string
+		want       string
+		wantErr    bool
+	}{
+		{name: "Plain url", trackerUrl: "http://tracker.example/announce", want: "http://tracker.example/announce?" + params},
+		{name: "Passkey in the query", trackerUrl: "http://tracker.example/announce?passkey=abc123", want: "http://tracker.example/announce?compact=0&downloaded=0&info_hash=12345678901234567890&left=0&passkey=abc123&peer_id=00112233445566778899&port=6881&uploaded=0"},
+		{name: "Passkey in the path", trackerUrl: "https://tracker.example/abc123/announce", want: "https://tracker.example/abc123/announce?" + params},
+		{name: "Invalid url", trackerUrl: "http://tracker.example/%zz", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tracker.getAnnounceUrl(tt.trackerUrl)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getAnnounceUrl() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("getAnnounceUrl() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrackerAnnounce(t *testing.T) {
+	defer func(backoff time.Duration) { announceBackoff = backoff }(announceBackoff)
+	announceBackoff = time.Millisecond
+
+	var requests []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Query())
+		switch len(requests) {
+		case 1:
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		case 2:
+			w.Write([]byte("d8:intervali60e10:tracker id3:abc5:peers0:e"))
+		default:
+			w.Write([]byte("d14:failure reason6:bannede"))
+		}
+	}))
+	defer server.Close()
+
+	tracker := Tracker{TrackerRequest: TrackerRequest{InfoHash: []byte("12345678901234567890")}}
+	if err := tracker.announce(server.URL, nil); err != nil {
+		t.Fatalf("announce() unexpected error %v", err)
+	}
+	if tracker.Interval != 60 || tracker.TrackerId != "abc" || len(requests) != 2 {
+		t.Errorf("unexpected tracker state %+v after %d requests", tracker, len(requests))
+	}
+
+	err := tracker.announce(server.URL, nil)
+	var failure *TrackerFailureError
+	if !errors.As(err, &failure) || failure.Reason != "banned" {
+		t.Errorf("announce() error = %v, expected tracker failure", err)
+	}
+	if len(requests) != 3 {
+		t.Errorf("expected failure reason not to be retried, got %d requests", len(requests))
+	}
+	if requests[2].Get("trackerid") != "abc" {
+		t.Errorf("expected tracker id to be sent back, got %q", requests[2].Get("trackerid"))
+	}
+}
+
+func TestTrackerAnnounceGivesUp(t *testing.T) {
+	defer func(backoff time.Duration) { announceBackoff = backoff }(announceBackoff)
+	announceBackoff = time.Millisecond
+
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.Write([]byte("garbage"))
+	}))
+	defer server.Close()
+
+	tracker := Tracker{}
+	if err := tracker.announce(server.URL, nil); err == nil {
+		t.Errorf("expected announce to fail")
+	}
+	if attempts != maxAnnounceAttempts {
+		t.Errorf("expected %d attempts, got %d", maxAnnounceAttempts, attempts)
+	}
+}
+
+func TestTrackerAnnounceStopped(t *testing.T) {
+	defer func(backoff time.Duration) { announceBackoff = backoff }(announceBackoff)
+	announceBackoff = time.Hour
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("garbage"))
+	}))
+	defer server.Close()
+
+	stop := make(chan struct{})
+	time.AfterFunc(20*time.Millisecond, func() { close(stop) })
+
+	tracker := Tracker{}
+	if err := tracker.announce(server.URL, stop); !errors.Is(err, ErrDownloadStopped) {
+		t.Errorf("announce() error = %v, expected ErrDownloadStopped", err)
+	}
+}
@@ -0,0 +1,110 @@
+package bittorrent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+type PeerTransport string
+
+const (
+	TRANSPORT_TCP  PeerTransport = "tcp"
+	TRANSPORT_UTP  PeerTransport = "utp"
+	TRANSPORT_BOTH PeerTransport = "both"
+)
+
+// PeerListener accepts peer connections over TCP and uTP on the same port.
+type PeerListener struct {
+	tcp      net.Listener
+	utp      *UtpListener
+	accepted chan net.Conn
+	closing  chan struct{}
+	once     sync.Once
+}
+
+func ParsePeerTransport(value string) (PeerTransport, error) {
+	switch transport := PeerTransport(value); transport {
+	case TRANSPORT_TCP, TRANSPORT_UTP, TRANSPORT_BOTH:
+		return transport, nil
+	default:
+		return "", fmt.Errorf("invalid transport %s, expected tcp, utp or both", value)
+	}
+}
+
+// dialPeerTransport connects to the peer, both tries uTP first and falls
+// back to TCP.
+func dialPeerTransport(peer netip.AddrPort, transport PeerTransport) (net.Conn, error) {
+	// AddrPort formats IPv6 addresses in brackets, so both families dial the same way
+	switch transport {
+	case TRANSPORT_UTP:
+		return dialUtp(peer.String())
+	case TRANSPORT_BOTH:
+		conn, err := dialUtp(peer.String())
+		if err == nil {
+			return conn, nil
+		}
+		log.Debug().Msg(fmt.Sprintf("[Peer] uTP connection to %s failed, falling back to TCP: %s", peer, err))
+		return net.Dial("tcp", peer.String())
+	default:
+		return net.Dial("tcp", peer.String())
+	}
+}
+
+// listenPeers listens for peers on the address over TCP and uTP.
+func listenPeers(address string) (*PeerListener, error) {
+	tcp, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	// uTP has to use the port TCP got if the address asked for any port
+	utp, err := listenUtp(tcp.Addr().String())
+	if err != nil {
+		tcp.Close()
+		return nil, err
+	}
+
+	l := &PeerListener{tcp: tcp, utp: utp, accepted: make(chan net.Conn), closing: make(chan struct{})}
+	go l.acceptFrom(tcp)
+	go l.acceptFrom(utp)
+	return l, nil
+}
+
+func (l *PeerListener) acceptFrom(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		select {
+		case l.accepted <- conn:
+		case <-l.closing:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (l *PeerListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.closing:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *PeerListener) Close() error {
+	l.once.Do(func() { close(l.closing) })
+	return errors.Join(l.tcp.Close(), l.utp.Close())
+}
+
+func (l *PeerListener) Addr() net.Addr {
+	return l.tcp.Addr()
+}
@@ -0,0 +1,299 @@
+package bittorrent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// UPnP Internet Gateway Devices are found with SSDP multicast and
+// controlled with SOAP requests to the URL from their device description.
+const (
+	ssdpAddress    = "239.255.255.250:1900"
+	upnpDeviceType = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	// upnpOnlyPermanentLeases is the error of gateways that can't expire mappings
+	upnpOnlyPermanentLeases = 725
+)
+
+// ssdpTimeout is how long gateways get to answer the search.
+var ssdpTimeout = 2 * time.Second
+
+// upnpServiceTypes are the services that can map ports, in order of preference.
+var upnpServiceTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+type UpnpGateway struct {
+	client       *http.Client
+	controlUrl   string
+	serviceType  string
+	localAddress netip.Addr
+}
+
+// UpnpError is the fault a gateway answers a failed action with.
+type UpnpError struct {
+	Code        int
+	Description string
+}
+
+func (e *UpnpError) Error() string {
+	return fmt.Sprintf("upnp error %d: %s", e.Code, e.Description)
+}
+
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlUrl  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+type upnpDescription struct {
+	UrlBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+type soapArgument struct {
+	name  string
+	value string
+}
+
+// discoverUpnp searches for a gateway at the SSDP address and returns the
+// first one that has a service to map ports with.
+func discoverUpnp(address string) (*UpnpGateway, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	group, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return nil, err
+	}
+
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddress + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: " + strconv.Itoa(int(ssdpTimeout/time.Second)) + "\r\n" +
+		"ST: " + upnpDeviceType + "\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(search), group); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(ssdpTimeout))
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, fmt.Errorf("no UPnP gateway found: %w", err)
+		}
+
+		response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil || response.StatusCode != http.StatusOK || response.Header.Get("Location") == "" {
+			continue
+		}
+
+		// the gateway forwards to the address we reach it from
+		localAddress, err := getLocalAddress(from.(*net.UDPAddr).AddrPort().Addr().Unmap())
+		if err != nil {
+			return nil, err
+		}
+
+		gateway, err := getUpnpGateway(response.Header.Get("Location"), localAddress)
+		if err != nil {
+			log.Debug().Msg(fmt.Sprintf("[UPnP] ignoring gateway %s: %s", from, err))
+			continue
+		}
+		return gateway, nil
+	}
+}
+
+// getUpnpGateway reads the device description at the location for the
+// control URL of a service that maps ports.
+func getUpnpGateway(location string, localAddress netip.Addr) (*UpnpGateway, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	response, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("device description returned %s", response.Status)
+	}
+
+	var description upnpDescription
+	if err := xml.NewDecoder(response.Body).Decode(&description); err != nil {
+		return nil, fmt.Errorf("invalid device description: %w", err)
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if description.UrlBase != "" {
+		if base, err = url.Parse(description.UrlBase); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, serviceType := range upnpServiceTypes {
+		if controlUrl := findUpnpService(description.Device, serviceType); controlUrl != "" {
+			control, err := base.Parse(controlUrl)
+			if err != nil {
+				return nil, err
+			}
+			return &UpnpGateway{client: client, controlUrl: control.String(), serviceType: serviceType, localAddress: localAddress}, nil
+		}
+	}
+	return nil, errors.New("device has no WAN connection service")
+}
+
+// findUpnpService returns the control URL of the service type in the
+// device or one of its embedded devices.
+func findUpnpService(device upnpDevice, serviceType string) string {
+	for _, service := range device.Services {
+		if service.ServiceType == serviceType {
+			return service.ControlUrl
+		}
+	}
+	for _, embedded := range device.Devices {
+		if controlUrl := findUpnpService(embedded, serviceType); controlUrl != "" {
+			return controlUrl
+		}
+	}
+	return ""
+}
+
+func (g *UpnpGateway) addMapping(protocol string, internalPort int, externalPort int, lifetime time.Duration) (netip.AddrPort, time.Duration, error) {
+	add := func(lifetime time.Duration) error {
+		_, err := g.soapRequest("AddPortMapping", []soapArgument{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(externalPort)},
+			{"NewProtocol", protocol},
+			{"NewInternalPort", strconv.Itoa(internalPort)},
+			{"NewInternalClient", g.localAddress.String()},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", "bittorrent-client-go"},
+			{"NewLeaseDuration", strconv.Itoa(int(lifetime / time.Second))},
+		})
+		return err
+	}
+
+	err := add(lifetime)
+	var upnpErr *UpnpError
+	if errors.As(err, &upnpErr) && upnpErr.Code == upnpOnlyPermanentLeases {
+		lifetime = 0
+		err = add(lifetime)
+	}
+	if err != nil {
+		return netip.AddrPort{}, 0, err
+	}
+
+	response, err := g.soapRequest("GetExternalIPAddress", nil)
+	if err != nil {
+		return netip.AddrPort{}, 0, err
+	}
+	// gateways without a WAN connection answer with an empty address
+	externalIp, _ := netip.ParseAddr(response["NewExternalIPAddress"])
+	return netip.AddrPortFrom(externalIp, uint16(externalPort)), lifetime, nil
+}
+
+func (g *UpnpGateway) deleteMapping(protocol string, internalPort int, externalPort int) error {
+	_, err := g.soapRequest("DeletePortMapping", []soapArgument{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(externalPort)},
+		{"NewProtocol", protocol},
+	})
+	return err
+}
+
+func (g *UpnpGateway) String() string {
+	return "UPnP gateway " + g.controlUrl
+}
+
+// soapRequest calls the action on the service and returns the values of
+// the response by element name.
+func (g *UpnpGateway) soapRequest(action string, arguments []soapArgument) (map[string]string, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + g.serviceType + `">`)
+	for _, argument := range arguments {
+		body.WriteString("<" + argument.name + ">")
+		xml.EscapeText(&body, []byte(argument.value))
+		body.WriteString("</" + argument.name + ">")
+	}
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	request, err := http.NewRequest(http.MethodPost, g.controlUrl, &body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	request.Header.Set("SOAPAction", `"`+g.serviceType+"#"+action+`"`)
+
+	response, err := g.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	values, err := parseSoapResponse(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response to %s: %w", action, err)
+	}
+
+	if response.StatusCode != http.StatusOK {
+		code, err := strconv.Atoi(values["errorCode"])
+		if err != nil {
+			return nil, fmt.Errorf("%s returned %s", action, response.Status)
+		}
+		return nil, &UpnpError{Code: code, Description: values["errorDescription"]}
+	}
+	return values, nil
+}
+
+// parseSoapResponse collects the text of the elements in the response,
+// which is all that the actions and faults we use return.
+func parseSoapResponse(body io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	decoder := xml.NewDecoder(body)
+
+	var name string
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			name = token.Name.Local
+		case xml.CharData:
+			if text := strings.TrimSpace(string(token)); name != "" && text != "" {
+				values[name] = text
+			}
+		case xml.EndElement:
+			name = ""
+		}
+	}
+}
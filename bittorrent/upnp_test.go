@@ -0,0 +1,201 @@
+package bittorrent
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const upnpTestDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+	<device>
+		<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+		<deviceList>
+			<device>
+				<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+				<deviceList>
+					<device>
+						<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+						<serviceList>
+							<service>
+								<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+								<controlURL>/ctl/IPConn</controlURL>
+							</service>
+						</serviceList>
+					</device>
+				</deviceList>
+			</device>
+		</deviceList>
+	</device>
+</root>`
+
+// fakeUpnpGateway answers SSDP searches and the SOAP actions for port
+// mappings like a home router.
+type fakeUpnpGateway struct {
+	ssdp            net.PacketConn
+	server          *httptest.Server
+	permanentLeases bool
+	mu              sync.Mutex
+	mappings        map[string]string
+	leases          []string
+}
+
+func newFakeUpnpGateway(t *testing.T) *fakeUpnpGateway {
+	ssdp, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := &fakeUpnpGateway{ssdp: ssdp, mappings: make(map[string]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /rootDesc.xml", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, upnpTestDescription)
+	})
+	mux.HandleFunc("POST /ctl/IPConn", g.handleControl)
+	g.server = httptest.NewServer(mux)
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := ssdp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if !strings.HasPrefix(string(buf[:n]), "M-SEARCH * HTTP/1.1\r\n") || !strings.Contains(string(buf[:n]), upnpDeviceType) {
+				continue
+			}
+			response := "HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=120\r\nST: " + upnpDeviceType + "\r\nLOCATION: " + g.server.URL + "/rootDesc.xml\r\n\r\n"
+			ssdp.WriteTo([]byte(response), from)
+		}
+	}()
+
+	t.Cleanup(func() {
+		ssdp.Close()
+		g.server.Close()
+	})
+	return g
+}
+
+func (g *fakeUpnpGateway) handleControl(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	arguments := make(map[string]string)
+	for _, match := range regexp.MustCompile(`<(New\w+)>([^<]*)</New\w+>`).FindAllStringSubmatch(string(body), -1) {
+		arguments[match[1]] = match[2]
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	action := strings.TrimPrefix(strings.Trim(r.Header.Get("SOAPAction"), `"`), "urn:schemas-upnp-org:service:WANIPConnection:1#")
+	key := arguments["NewProtocol"] + "/" + arguments["NewExternalPort"]
+	switch action {
+	case "AddPortMapping":
+		if g.permanentLeases && arguments["NewLeaseDuration"] != "0" {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>725</errorCode><errorDescription>OnlyPermanentLeasesSupported</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`)
+			return
+		}
+		g.mappings[key] = arguments["NewInternalClient"] + ":" + arguments["NewInternalPort"]
+		g.leases = append(g.leases, arguments["NewLeaseDuration"])
+		io.WriteString(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:AddPortMappingResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"/></s:Body></s:Envelope>`)
+	case "DeletePortMapping":
+		delete(g.mappings, key)
+		io.WriteString(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:DeletePortMappingResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"/></s:Body></s:Envelope>`)
+	case "GetExternalIPAddress":
+		io.WriteString(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"><NewExternalIPAddress>203.0.113.7</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><detail><UPnPError><errorCode>401</errorCode><errorDescription>Invalid Action</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`)
+	}
+}
+
+func TestUpnpPortMapping(t *testing.T) {
+	for _, permanentLeases := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Permanent leases %v", permanentLeases), func(t *testing.T) {
+			fake := newFakeUpnpGateway(t)
+			fake.permanentLeases = permanentLeases
+
+			gateway, err := discoverUpnp(fake.ssdp.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gateway.controlUrl != fake.server.URL+"/ctl/IPConn" {
+				t.Errorf("control url = %s", gateway.controlUrl)
+			}
+
+			mapping, err := newPortMapping(gateway, 6881)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := netip.MustParseAddrPort("203.0.113.7:6881")
+			if external := mapping.externalAddress(); external != expected {
+				t.Errorf("externalAddress() = %s, expected %s", external, expected)
+			}
+
+			fake.mu.Lock()
+			for _, key := range []string{"TCP/6881", "UDP/6881"} {
+				if fake.mappings[key] != "127.0.0.1:6881" {
+					t.Errorf("mapping %s = %q, expected 127.0.0.1:6881", key, fake.mappings[key])
+				}
+			}
+			expectedLease := "3600"
+			if permanentLeases {
+				expectedLease = "0"
+			}
+			for _, lease := range fake.leases {
+				if lease != expectedLease {
+					t.Errorf("lease duration = %s, expected %s", lease, expectedLease)
+				}
+			}
+			fake.mu.Unlock()
+
+			if err := mapping.Close(); err != nil {
+				t.Fatal(err)
+			}
+			fake.mu.Lock()
+			if len(fake.mappings) != 0 {
+				t.Errorf("mappings left after close: %v", fake.mappings)
+			}
+			fake.mu.Unlock()
+		})
+	}
+}
+
+func TestUpnpError(t *testing.T) {
+	fake := newFakeUpnpGateway(t)
+	gateway, err := discoverUpnp(fake.ssdp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = gateway.soapRequest("GetGenericPortMappingEntry", nil)
+	expected := &UpnpError{Code: 401, Description: "Invalid Action"}
+	if upnpErr, ok := err.(*UpnpError); !ok || *upnpErr != *expected {
+		t.Errorf("soapRequest() error = %v, expected %v", err, expected)
+	}
+}
+
+func TestDiscoverUpnpWithoutGateway(t *testing.T) {
+	silent, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	timeout := ssdpTimeout
+	ssdpTimeout = 100 * time.Millisecond
+	defer func() { ssdpTimeout = timeout }()
+
+	if _, err := discoverUpnp(silent.LocalAddr().String()); err == nil {
+		t.Error("expected an error without a gateway")
+	}
+}
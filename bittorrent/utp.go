@@ -0,0 +1,760 @@
+package bittorrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	utpTypeData  = 0
+	utpTypeFin   = 1
+	utpTypeState = 2
+	utpTypeReset = 3
+	utpTypeSyn   = 4
+)
+
+const (
+	utpStateSynSent = iota
+	utpStateConnected
+	utpStateClosed
+)
+
+const (
+	utpVersion      = 1
+	utpHeaderLength = 20
+	// utpPacketSize is the payload of a data packet, small enough to fit
+	// into a single IP packet on common links.
+	utpPacketSize      = 1400
+	utpReceiveWindow   = 1 << 20
+	utpTargetDelay     = 100000 // microseconds
+	utpMaxWindowGain   = 3000   // bytes per round trip
+	utpMinTimeout      = 500 * time.Millisecond
+	utpInitialTimeout  = time.Second
+	utpTickInterval    = 50 * time.Millisecond
+	utpAcceptBacklog   = 64
+	utpDuplicateAcks   = 3
+	utpCloseTimeout    = 5 * time.Second
+	utpMaxTransmission = 5
+)
+
+var utpConnectTimeout = 5 * time.Second
+
+var errUtpTimeout = errors.New("uTP connection timed out")
+var errUtpReset = errors.New("uTP connection reset by peer")
+
+type utpHeader struct {
+	packetType    uint8
+	connectionId  uint16
+	timestamp     uint32
+	timestampDiff uint32
+	windowSize    uint32
+	seqNr         uint16
+	ackNr         uint16
+}
+
+type utpPacket struct {
+	header        utpHeader
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+}
+
+type utpConnKey struct {
+	address netip.AddrPort
+	id      uint16
+}
+
+// utpSocket multiplexes the uTP connections of one UDP socket.
+type utpSocket struct {
+	conn    net.PacketConn
+	mu      sync.Mutex
+	conns   map[utpConnKey]*UtpConn
+	accepts chan *UtpConn
+	closing chan struct{}
+	closed  bool
+	// dialed sockets belong to a single connection and close with it
+	dialed bool
+}
+
+// UtpConn is a BEP 29 uTP connection with LEDBAT congestion control.
+type UtpConn struct {
+	socket *utpSocket
+	remote *net.UDPAddr
+	recvId uint16
+	sendId uint16
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	state int
+	err   error
+
+	seqNr      uint16
+	ackNr      uint16
+	inflight   []*utpPacket
+	curWindow  int
+	maxWindow  float64
+	peerWindow int
+	duplicates int
+
+	replyMicro uint32
+	baseDelay  utpDelayHistory
+	rtt        time.Duration
+	rttVar     time.Duration
+	timeout    time.Duration
+
+	received bytes.Buffer
+	reorder  map[uint16]*utpPacket
+	eof      bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// waitDeadline ends the wait for the connect or close handshake
+	waitDeadline time.Time
+	// wakeTimer fires at the earliest deadline, one per connection
+	wakeTimer *time.Timer
+}
+
+// UtpListener accepts incoming uTP connections on a UDP socket.
+type UtpListener struct {
+	socket *utpSocket
+}
+
+// utpDelayHistory keeps the minimum delay of the current and the previous
+// minute, the lower of the two is the base delay LEDBAT measures against.
+type utpDelayHistory struct {
+	current  uint32
+	previous uint32
+	started  time.Time
+}
+
+func listenUtp(address string) (*UtpListener, error) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	socket := newUtpSocket(conn)
+	socket.accepts = make(chan *UtpConn, utpAcceptBacklog)
+	go socket.readLoop()
+
+	return &UtpListener{socket: socket}, nil
+}
+
+func (l *UtpListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.socket.accepts:
+		return conn, nil
+	case <-l.socket.closing:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *UtpListener) Close() error {
+	return l.socket.close()
+}
+
+func (l *UtpListener) Addr() net.Addr {
+	return l.socket.conn.LocalAddr()
+}
+
+// dialUtp opens a uTP connection to the address from a fresh UDP socket.
+func dialUtp(address string) (net.Conn, error) {
+	remote, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+
+	socket := newUtpSocket(conn)
+	socket.dialed = true
+
+	c := newUtpConn(socket, remote, uint16(rand.Intn(math.MaxUint16)))
+	c.sendId = c.recvId + 1
+	c.seqNr = 1
+
+	socket.mu.Lock()
+	socket.conns[c.key()] = c
+	socket.mu.Unlock()
+	go socket.readLoop()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.send(utpTypeSyn, nil)
+	go c.tick()
+
+	deadline := time.Now().Add(utpConnectTimeout)
+	c.waitDeadline = deadline
+	c.wakeAtDeadline()
+	for c.state == utpStateSynSent && time.Now().Before(deadline) {
+		c.cond.Wait()
+	}
+
+	if c.state != utpStateConnected {
+		err := c.err
+		if err == nil {
+			err = errUtpTimeout
+		}
+		c.fail(err)
+		return nil, fmt.Errorf("error connecting over uTP: %w", err)
+	}
+	return c, nil
+}
+
+func newUtpSocket(conn net.PacketConn) *utpSocket {
+	return &utpSocket{
+		conn:    conn,
+		conns:   make(map[utpConnKey]*UtpConn),
+		closing: make(chan struct{}),
+	}
+}
+
+func newUtpConn(socket *utpSocket, remote *net.UDPAddr, recvId uint16) *UtpConn {
+	c := &UtpConn{
+		socket:     socket,
+		remote:     remote,
+		recvId:     recvId,
+		maxWindow:  utpPacketSize,
+		peerWindow: utpPacketSize,
+		timeout:    utpInitialTimeout,
+		reorder:    make(map[uint16]*utpPacket),
+		baseDelay:  utpDelayHistory{current: math.MaxUint32, previous: math.MaxUint32},
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (s *utpSocket) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			s.close()
+			return
+		}
+
+		header, payload, err := parseUtpPacket(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		address := addr.(*net.UDPAddr).AddrPort()
+		address = netip.AddrPortFrom(address.Addr().Unmap(), address.Port())
+
+		s.mu.Lock()
+		c, ok := s.conns[utpConnKey{address, header.connectionId}]
+		if !ok && header.packetType == utpTypeSyn {
+			c, ok = s.conns[utpConnKey{address, header.connectionId + 1}]
+			if !ok {
+				s.accept(addr.(*net.UDPAddr), address, header)
+				s.mu.Unlock()
+				continue
+			}
+		}
+		s.mu.Unlock()
+
+		if ok {
+			c.receive(header, bytes.Clone(payload))
+		} else if header.packetType != utpTypeReset {
+			reset := utpHeader{packetType: utpTypeReset, connectionId: header.connectionId, ackNr: header.seqNr}
+			s.conn.WriteTo(reset.marshal(nil), addr)
+		}
+	}
+}
+
+// accept answers a SYN with a new connection, the socket lock is held.
+func (s *utpSocket) accept(remote *net.UDPAddr, address netip.AddrPort, syn utpHeader) {
+	if s.accepts == nil || len(s.accepts) == cap(s.accepts) {
+		reset := utpHeader{packetType: utpTypeReset, connectionId: syn.connectionId, ackNr: syn.seqNr}
+		s.conn.WriteTo(reset.marshal(nil), remote)
+		return
+	}
+
+	c := newUtpConn(s, remote, syn.connectionId+1)
+	c.sendId = syn.connectionId
+	c.seqNr = uint16(rand.Intn(math.MaxUint16))
+	c.ackNr = syn.seqNr
+	c.state = utpStateConnected
+	c.replyMicro = utpNow() - syn.timestamp
+	c.peerWindow = int(syn.windowSize)
+	s.conns[utpConnKey{address, c.recvId}] = c
+
+	// the SYN is acknowledged without using up a sequence number, the first
+	// data packet has the same one
+	c.mu.Lock()
+	c.sendState()
+	c.mu.Unlock()
+
+	go c.tick()
+	s.accepts <- c
+}
+
+func (s *utpSocket) remove(c *UtpConn) {
+	s.mu.Lock()
+	delete(s.conns, c.key())
+	closeSocket := s.dialed && len(s.conns) == 0
+	s.mu.Unlock()
+
+	if closeSocket {
+		s.close()
+	}
+}
+
+func (s *utpSocket) close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.closing)
+	conns := make([]*UtpConn, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		c.mu.Lock()
+		c.fail(net.ErrClosed)
+		c.mu.Unlock()
+	}
+	return s.conn.Close()
+}
+
+func (c *UtpConn) key() utpConnKey {
+	address := c.remote.AddrPort()
+	return utpConnKey{netip.AddrPortFrom(address.Addr().Unmap(), address.Port()), c.recvId}
+}
+
+func (c *UtpConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.received.Len() == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if !c.readDeadline.IsZero() && !time.Now().Before(c.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+
+	n, _ := c.received.Read(p)
+	return n, nil
+}
+
+// Write splits p into packets and blocks until all of them fit into the
+// congestion window and are sent.
+func (c *UtpConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	written := 0
+	for written < len(p) {
+		size := min(len(p)-written, utpPacketSize)
+
+		for len(c.inflight) > 0 && c.curWindow+size > min(int(c.maxWindow), c.peerWindow) {
+			if c.err != nil {
+				return written, c.err
+			}
+			if !c.writeDeadline.IsZero() && !time.Now().Before(c.writeDeadline) {
+				return written, os.ErrDeadlineExceeded
+			}
+			c.cond.Wait()
+		}
+		if c.err != nil {
+			return written, c.err
+		}
+
+		c.send(utpTypeData, bytes.Clone(p[written:written+size]))
+		written += size
+	}
+	return written, nil
+}
+
+// Close waits until the sent data is acknowledged and ends the connection
+// with a FIN.
+func (c *UtpConn) Close() error {
+	c.mu.Lock()
+	if c.state == utpStateClosed {
+		c.mu.Unlock()
+		return nil
+	}
+
+	deadline := time.Now().Add(utpCloseTimeout)
+	c.waitDeadline = deadline
+	c.wakeAtDeadline()
+	for len(c.inflight) > 0 && c.err == nil && time.Now().Before(deadline) {
+		c.cond.Wait()
+	}
+
+	if c.err == nil {
+		c.send(utpTypeFin, nil)
+		// a peer that already sent its FIN does not need to wait for ours
+		for !c.eof && len(c.inflight) > 0 && c.err == nil && time.Now().Before(deadline) {
+			c.cond.Wait()
+		}
+	}
+
+	c.fail(net.ErrClosed)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *UtpConn) LocalAddr() net.Addr {
+	return c.socket.conn.LocalAddr()
+}
+
+func (c *UtpConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *UtpConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *UtpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	// a deadline that already passed ends the waits right away
+	c.cond.Broadcast()
+	c.wakeAtDeadline()
+	return nil
+}
+
+func (c *UtpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeDeadline = t
+	// a deadline that already passed ends the waits right away
+	c.cond.Broadcast()
+	c.wakeAtDeadline()
+	return nil
+}
+
+// wakeAtDeadline sets the connection's timer to wake up all waiters at the
+// earliest deadline that hasn't passed, so they can check their deadlines.
+// Deadlines are set for every message, so the timer is reset instead of
+// starting a new one each time. The lock is held.
+func (c *UtpConn) wakeAtDeadline() {
+	now := time.Now()
+	var next time.Time
+	for _, deadline := range []time.Time{c.readDeadline, c.writeDeadline, c.waitDeadline} {
+		if deadline.After(now) && (next.IsZero() || deadline.Before(next)) {
+			next = deadline
+		}
+	}
+
+	switch {
+	case next.IsZero():
+		if c.wakeTimer != nil {
+			c.wakeTimer.Stop()
+		}
+	case c.wakeTimer == nil:
+		c.wakeTimer = time.AfterFunc(next.Sub(now), c.wake)
+	default:
+		c.wakeTimer.Reset(next.Sub(now))
+	}
+}
+
+func (c *UtpConn) wake() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cond.Broadcast()
+	// the deadlines that are left still need their wake up
+	c.wakeAtDeadline()
+}
+
+// fail closes the connection with err, the lock is held.
+func (c *UtpConn) fail(err error) {
+	if c.state == utpStateClosed {
+		return
+	}
+	c.state = utpStateClosed
+	if c.err == nil {
+		c.err = err
+	}
+	if c.wakeTimer != nil {
+		c.wakeTimer.Stop()
+	}
+	c.cond.Broadcast()
+	go c.socket.remove(c)
+}
+
+// send transmits a packet that uses up a sequence number and keeps it until
+// it is acknowledged, the lock is held.
+func (c *UtpConn) send(packetType uint8, payload []byte) {
+	packet := &utpPacket{header: utpHeader{packetType: packetType, seqNr: c.seqNr}, payload: payload}
+	c.seqNr++
+	c.inflight = append(c.inflight, packet)
+	c.curWindow += len(payload)
+	c.transmit(packet)
+}
+
+func (c *UtpConn) transmit(packet *utpPacket) {
+	packet.header.connectionId = c.sendId
+	if packet.header.packetType == utpTypeSyn {
+		packet.header.connectionId = c.recvId
+	}
+	packet.header.ackNr = c.ackNr
+	packet.header.timestamp = utpNow()
+	packet.header.timestampDiff = c.replyMicro
+	packet.header.windowSize = uint32(max(utpReceiveWindow-c.received.Len(), 0))
+	packet.sentAt = time.Now()
+	packet.transmissions++
+
+	c.socket.conn.WriteTo(packet.header.marshal(packet.payload), c.remote)
+}
+
+func (c *UtpConn) sendState() {
+	header := utpHeader{
+		packetType:    utpTypeState,
+		connectionId:  c.sendId,
+		timestamp:     utpNow(),
+		timestampDiff: c.replyMicro,
+		windowSize:    uint32(max(utpReceiveWindow-c.received.Len(), 0)),
+		seqNr:         c.seqNr,
+		ackNr:         c.ackNr,
+	}
+	c.socket.conn.WriteTo(header.marshal(nil), c.remote)
+}
+
+func (c *UtpConn) receive(header utpHeader, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.cond.Broadcast()
+
+	if c.state == utpStateClosed {
+		return
+	}
+
+	if header.packetType == utpTypeReset {
+		c.fail(errUtpReset)
+		return
+	}
+
+	c.peerWindow = int(header.windowSize)
+	c.replyMicro = utpNow() - header.timestamp
+
+	if c.state == utpStateSynSent {
+		if header.packetType != utpTypeState {
+			return
+		}
+		c.state = utpStateConnected
+		c.ackNr = header.seqNr - 1
+	}
+
+	if header.packetType != utpTypeSyn {
+		c.acknowledge(header, len(payload) == 0)
+	}
+
+	switch header.packetType {
+	case utpTypeData, utpTypeFin:
+		c.deliver(&utpPacket{header: header, payload: payload})
+		c.sendState()
+	case utpTypeSyn:
+		// our answer to the SYN got lost
+		c.sendState()
+	}
+}
+
+// acknowledge removes the packets the peer has received from the in flight
+// queue and adjusts the congestion window to the measured delay.
+func (c *UtpConn) acknowledge(header utpHeader, empty bool) {
+	acked := 0
+	for len(c.inflight) > 0 && !utpSeqLess(header.ackNr, c.inflight[0].header.seqNr) {
+		packet := c.inflight[0]
+		c.inflight = c.inflight[1:]
+		c.curWindow -= len(packet.payload)
+		acked += len(packet.payload)
+
+		// retransmitted packets give no reliable round trip time
+		if packet.transmissions == 1 {
+			c.updateTimeout(time.Since(packet.sentAt))
+		}
+	}
+
+	if acked == 0 {
+		if empty && header.packetType == utpTypeState && len(c.inflight) > 0 {
+			c.duplicates++
+			if c.duplicates == utpDuplicateAcks {
+				c.maxWindow = max(c.maxWindow/2, utpPacketSize)
+				c.transmit(c.inflight[0])
+			}
+		}
+		return
+	}
+	c.duplicates = 0
+
+	if header.timestampDiff == 0 {
+		return
+	}
+	c.baseDelay.add(header.timestampDiff, time.Now())
+	queuingDelay := float64(header.timestampDiff - c.baseDelay.base())
+
+	// LEDBAT: grow the window while the queuing delay is below the target
+	// and shrink it when it is above
+	offTarget := (utpTargetDelay - queuingDelay) / utpTargetDelay
+	windowFactor := float64(min(acked, int(c.maxWindow))) / max(c.maxWindow, float64(acked))
+	c.maxWindow = max(c.maxWindow+utpMaxWindowGain*offTarget*windowFactor, utpPacketSize)
+}
+
+// deliver adds an incoming packet to the read buffer in sequence order.
+func (c *UtpConn) deliver(packet *utpPacket) {
+	// old duplicates and packets too far ahead of the window are dropped
+	ahead := packet.header.seqNr - c.ackNr
+	if ahead == 0 || int(ahead) > utpReceiveWindow/utpPacketSize {
+		return
+	}
+	c.reorder[packet.header.seqNr] = packet
+
+	for {
+		next, ok := c.reorder[c.ackNr+1]
+		if !ok {
+			return
+		}
+		delete(c.reorder, c.ackNr+1)
+		c.ackNr++
+
+		if next.header.packetType == utpTypeFin {
+			c.eof = true
+			return
+		}
+		c.received.Write(next.payload)
+	}
+}
+
+func (c *UtpConn) updateTimeout(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.timeout = max(c.rtt+4*c.rttVar, utpMinTimeout)
+}
+
+// tick resends the oldest unacknowledged packet when it timed out and
+// closes the connection when the peer stopped answering.
+func (c *UtpConn) tick() {
+	ticker := time.NewTicker(utpTickInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.mu.Lock()
+		if c.state == utpStateClosed {
+			c.mu.Unlock()
+			return
+		}
+
+		if len(c.inflight) > 0 && time.Since(c.inflight[0].sentAt) >= c.timeout {
+			packet := c.inflight[0]
+			if packet.transmissions >= utpMaxTransmission {
+				c.fail(errUtpTimeout)
+			} else {
+				c.maxWindow = utpPacketSize
+				c.timeout *= 2
+				c.transmit(packet)
+			}
+			c.cond.Broadcast()
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (h *utpDelayHistory) add(sample uint32, now time.Time) {
+	if now.Sub(h.started) > time.Minute {
+		h.previous = h.current
+		h.current = sample
+		h.started = now
+		return
+	}
+	h.current = min(h.current, sample)
+}
+
+func (h *utpDelayHistory) base() uint32 {
+	return min(h.current, h.previous)
+}
+
+func (h utpHeader) marshal(payload []byte) []byte {
+	packet := make([]byte, utpHeaderLength, utpHeaderLength+len(payload))
+	packet[0] = h.packetType<<4 | utpVersion
+	binary.BigEndian.PutUint16(packet[2:4], h.connectionId)
+	binary.BigEndian.PutUint32(packet[4:8], h.timestamp)
+	binary.BigEndian.PutUint32(packet[8:12], h.timestampDiff)
+	binary.BigEndian.PutUint32(packet[12:16], h.windowSize)
+	binary.BigEndian.PutUint16(packet[16:18], h.seqNr)
+	binary.BigEndian.PutUint16(packet[18:20], h.ackNr)
+	return append(packet, payload...)
+}
+
+// parseUtpPacket returns the header and payload of a packet. Extensions
+// such as selective acks are skipped.
+func parseUtpPacket(packet []byte) (utpHeader, []byte, error) {
+	if len(packet) < utpHeaderLength {
+		return utpHeader{}, nil, errors.New("uTP packet too short")
+	}
+	if packet[0]&0x0F != utpVersion || packet[0]>>4 > utpTypeSyn {
+		return utpHeader{}, nil, errors.New("invalid uTP packet")
+	}
+
+	header := utpHeader{
+		packetType:    packet[0] >> 4,
+		connectionId:  binary.BigEndian.Uint16(packet[2:4]),
+		timestamp:     binary.BigEndian.Uint32(packet[4:8]),
+		timestampDiff: binary.BigEndian.Uint32(packet[8:12]),
+		windowSize:    binary.BigEndian.Uint32(packet[12:16]),
+		seqNr:         binary.BigEndian.Uint16(packet[16:18]),
+		ackNr:         binary.BigEndian.Uint16(packet[18:20]),
+	}
+
+	extension := packet[1]
+	offset := utpHeaderLength
+	for extension != 0 {
+		if offset+2 > len(packet) || offset+2+int(packet[offset+1]) > len(packet) {
+			return utpHeader{}, nil, errors.New("invalid uTP extension")
+		}
+		extension = packet[offset]
+		offset += 2 + int(packet[offset+1])
+	}
+
+	return header, packet[offset:], nil
+}
+
+// utpSeqLess compares sequence numbers that wrap around.
+func utpSeqLess(a uint16, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+func utpNow() uint32 {
+	return uint32(time.Now().UnixMicro())
+}
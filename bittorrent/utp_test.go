@@ -0,0 +1,228 @@
+package bittorrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// lossyPacketConn drops every nth packet it reads.
+type lossyPacketConn struct {
+	net.PacketConn
+	every int
+	count atomic.Int64
+}
+
+func (c *lossyPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || c.count.Add(1)%int64(c.every) != 0 {
+			return n, addr, err
+		}
+	}
+}
+
+func TestParseUtpPacket(t *testing.T) {
+	header := utpHeader{
+		packetType:    utpTypeData,
+		connectionId:  4242,
+		timestamp:     1,
+		timestampDiff: 2,
+		windowSize:    3,
+		seqNr:         65535,
+		ackNr:         7,
+	}
+
+	parsed, payload, err := parseUtpPacket(header.marshal([]byte("payload")))
+	if err != nil || parsed != header || string(payload) != "payload" {
+		t.Errorf("parseUtpPacket() = %+v, %q, %v", parsed, payload, err)
+	}
+
+	// a selective ack extension in front of the payload
+	packet := header.marshal(nil)
+	packet[1] = 1
+	packet = append(packet, 0, 4, 0xFF, 0xFF, 0xFF, 0xFF)
+	packet = append(packet, []byte("payload")...)
+	_, payload, err = parseUtpPacket(packet)
+	if err != nil || string(payload) != "payload" {
+		t.Errorf("parseUtpPacket() with extension = %q, %v", payload, err)
+	}
+
+	if _, _, err := parseUtpPacket(packet[:10]); err == nil {
+		t.Errorf("parseUtpPacket() expected error for short packet")
+	}
+}
+
+func TestUtpSeqLess(t *testing.T) {
+	tests := []struct {
+		a, b     uint16
+		expected bool
+	}{
+		{a: 1, b: 2, expected: true},
+		{a: 2, b: 1, expected: false},
+		{a: 65535, b: 0, expected: true},
+		{a: 0, b: 65535, expected: false},
+		{a: 5, b: 5, expected: false},
+	}
+
+	for _, tt := range tests {
+		if result := utpSeqLess(tt.a, tt.b); result != tt.expected {
+			t.Errorf("utpSeqLess(%d, %d) = %v, expected %v", tt.a, tt.b, result, tt.expected)
+		}
+	}
+}
+
+func testUtpTransfer(t *testing.T, listener net.Listener, size int) {
+	data := make([]byte, size)
+	rand.Read(data)
+
+	received := make(chan []byte)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+
+		buf, _ := io.ReadAll(conn)
+		conn.Write([]byte("done"))
+		received <- buf
+	}()
+
+	conn, err := dialUtp(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dialUtp() unexpected error %v", err)
+	}
+
+	if n, err := conn.Write(data); err != nil || n != len(data) {
+		t.Fatalf("Write() = %d, %v", n, err)
+	}
+	// half close is not possible, the FIN is sent by Close after the data
+	// and the reply is read from the buffer
+	go conn.Close()
+
+	select {
+	case buf := <-received:
+		if !bytes.Equal(buf, data) {
+			t.Fatalf("received %d bytes, expected %d", len(buf), len(data))
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatalf("transfer did not finish")
+	}
+}
+
+func TestUtpTransfer(t *testing.T) {
+	listener, err := listenUtp("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listenUtp() unexpected error %v", err)
+	}
+	defer listener.Close()
+
+	testUtpTransfer(t, listener, 1<<20)
+}
+
+func TestUtpTransferWithLoss(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	socket := newUtpSocket(&lossyPacketConn{PacketConn: conn, every: 10})
+	socket.accepts = make(chan *UtpConn, utpAcceptBacklog)
+	go socket.readLoop()
+	listener := &UtpListener{socket: socket}
+	defer listener.Close()
+
+	testUtpTransfer(t, listener, 64*1024)
+}
+
+func TestUtpReadDeadline(t *testing.T) {
+	listener, err := listenUtp("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listenUtp() unexpected error %v", err)
+	}
+	defer listener.Close()
+
+	conn, err := dialUtp(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dialUtp() unexpected error %v", err)
+	}
+	defer conn.Close()
+
+	// deadlines set for every message share the connection's timer
+	for range 100 {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Minute))
+	}
+	utp := conn.(*UtpConn)
+	utp.mu.Lock()
+	timer := utp.wakeTimer
+	utp.mu.Unlock()
+	conn.SetReadDeadline(time.Now().Add(time.Minute))
+	utp.mu.Lock()
+	if utp.wakeTimer != timer {
+		t.Errorf("expected the deadline to reset the timer instead of starting a new one")
+	}
+	utp.mu.Unlock()
+
+	// the read deadline still wakes the reader after the earlier write deadline
+	conn.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read() error = %v, expected deadline exceeded", err)
+	}
+}
+
+func TestDialUtpTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { utpConnectTimeout = timeout }(utpConnectTimeout)
+	utpConnectTimeout = 100 * time.Millisecond
+
+	// a UDP socket that never answers
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	_, err = dialUtp(conn.LocalAddr().String())
+	if !errors.Is(err, errUtpTimeout) {
+		t.Errorf("dialUtp() error = %v, expected timeout", err)
+	}
+}
+
+func TestListenPeersAcceptsBothTransports(t *testing.T) {
+	listener, err := listenPeers("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listenPeers() unexpected error %v", err)
+	}
+	defer listener.Close()
+
+	peer := netip.MustParseAddrPort(listener.Addr().String())
+	for _, transport := range []PeerTransport{TRANSPORT_TCP, TRANSPORT_UTP} {
+		conn, err := dialPeerTransport(peer, transport)
+		if err != nil {
+			t.Fatalf("dialPeerTransport(%s) unexpected error %v", transport, err)
+		}
+		conn.Write([]byte(transport))
+
+		accepted, err := listener.Accept()
+		if err != nil {
+			t.Fatalf("Accept() unexpected error %v", err)
+		}
+		buf := make([]byte, len(transport))
+		if _, err := io.ReadFull(accepted, buf); err != nil || string(buf) != string(transport) {
+			t.Errorf("accepted connection read %q, %v", buf, err)
+		}
+
+		conn.Close()
+		accepted.Close()
+	}
+}
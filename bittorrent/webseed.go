@@ -0,0 +1,126 @@
+package bittorrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const webSeedTimeout time.Duration = time.Duration(30 * time.Second)
+
+// downloadWebSeedPiece downloads a piece from a BEP 19 web seed with one
+// Range request for every file the piece has data in.
+func downloadWebSeedPiece(network *PeerNetwork, torrentMeta TorrentMeta, seedUrl string, piece int) ([]byte, error) {
+	client := newWebSeedClient(network, torrentMeta.InfoHash)
+
+	pieceStart := piece * torrentMeta.PieceLength
+	pieceEnd := pieceStart + getPieceLength(piece, torrentMeta)
+
+	var downloadedPiece []byte
+	offset := 0
+	for _, file := range torrentMeta.getFiles() {
+		fileStart := offset
+		fileEnd := offset + file.length
+		offset = fileEnd
+
+		if fileEnd <= pieceStart || fileStart >= pieceEnd {
+			continue
+		}
+
+		start := max(pieceStart, fileStart) - fileStart
+		end := min(pieceEnd, fileEnd) - fileStart
+
+		// padding is zeros and not stored on the web seed
+		if file.padding {
+			downloadedPiece = append(downloadedPiece, make([]byte, end-start)...)
+			continue
+		}
+
+		data, err := getWebSeedRange(client, getWebSeedFileUrl(torrentMeta, seedUrl, file), start, end)
+		if err != nil {
+			return nil, err
+		}
+		downloadedPiece = append(downloadedPiece, data...)
+	}
+
+	if !torrentMeta.verifyPiece(piece, downloadedPiece) {
+		return nil, errPieceCorrupt
+	}
+
+	return downloadedPiece, nil
+}
+
+// getWebSeedFileUrl returns the url of a file on the web seed. For single
+// file torrents the url is the file itself unless it ends with a slash,
+// multi file torrents are stored below a directory named after the torrent.
+func getWebSeedFileUrl(torrentMeta TorrentMeta, seedUrl string, file File) string {
+	if len(torrentMeta.Keys) == 0 && !strings.HasSuffix(seedUrl, "/") {
+		return seedUrl
+	}
+
+	parts := []string{strings.TrimSuffix(seedUrl, "/"), url.PathEscape(torrentMeta.Name)}
+	if len(torrentMeta.Keys) > 0 {
+		for _, part := range file.path {
+			parts = append(parts, url.PathEscape(part))
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// getWebSeedRange returns the bytes from start up to end of the file.
+func getWebSeedRange(client *http.Client, fileUrl string, start int, end int) ([]byte, error) {
+	request, err := http.NewRequest(http.MethodGet, fileUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, errors.New("error requesting piece from web seed")
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+		data, err := io.ReadAll(io.LimitReader(response.Body, int64(end-start)))
+		if err != nil || len(data) != end-start {
+			return nil, errors.New("error reading piece from web seed")
+		}
+		return data, nil
+	case http.StatusOK:
+		// the server ignored the range and sends the whole file
+		data, err := io.ReadAll(io.LimitReader(response.Body, int64(end)))
+		if err != nil || len(data) != end {
+			return nil, errors.New("error reading piece from web seed")
+		}
+		return data[start:], nil
+	default:
+		return nil, fmt.Errorf("web seed returned %s", response.Status)
+	}
+}
+
+// newWebSeedClient returns a client whose connections count against the
+// same bandwidth limits as peer connections.
+func newWebSeedClient(peerNetwork *PeerNetwork, infoHash string) *http.Client {
+	dialer := &net.Dialer{Timeout: webSeedTimeout}
+
+	transport := &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			return newRateLimitedConn(conn, peerNetwork.bandwidth, peerNetwork.bandwidthForTorrent(infoHash)), nil
+		},
+	}
+
+	return &http.Client{Transport: transport, Timeout: webSeedTimeout}
+}
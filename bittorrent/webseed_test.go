@@ -0,0 +1,151 @@
+package bittorrent
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newWebSeedServer serves the given files with Range support.
+func newWebSeedServer(t *testing.T, files map[string][]byte) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func webSeedTorrent(data []byte, pieceLength int, keys []File) TorrentMeta {
+	torrentMeta := TorrentMeta{InfoHash: "webseed", Name: "multi", PieceLength: pieceLength, Length: len(data), Keys: keys}
+	for start := 0; start < len(data); start += pieceLength {
+		end := min(start+pieceLength, len(data))
+		torrentMeta.Pieces = append(torrentMeta.Pieces, convertToPieceHash(data[start:end]))
+	}
+	return torrentMeta
+}
+
+func TestDownloadWebSeedPieceMultiFile(t *testing.T) {
+	data := []byte("aaaaaaaaaaaaaaabbbbbbbbbbccccccccccccc")
+	torrentMeta := webSeedTorrent(data, 10, multiFileTorrent().Keys)
+
+	server := newWebSeedServer(t, map[string][]byte{
+		"/seed/multi/a.mkv":      data[:15],
+		"/seed/multi/b.srt":      data[15:25],
+		"/seed/multi/empty":      {},
+		"/seed/multi/docs/c.nfo": data[25:],
+	})
+
+	for piece := range torrentMeta.Pieces {
+		result, err := downloadWebSeedPiece(newTestNetwork(), torrentMeta, server.URL+"/seed/", piece)
+		if err != nil {
+			t.Fatalf("downloadWebSeedPiece(%d) unexpected error %v", piece, err)
+		}
+
+		start := piece * torrentMeta.PieceLength
+		expected := data[start:min(start+torrentMeta.PieceLength, len(data))]
+		if !bytes.Equal(result, expected) {
+			t.Errorf("downloadWebSeedPiece(%d) = %q, expected %q", piece, result, expected)
+		}
+	}
+}
+
+func TestDownloadWebSeedPieceSingleFile(t *testing.T) {
+	data := []byte("0123456789abcdef")
+	torrentMeta := webSeedTorrent(data, 8, nil)
+	torrentMeta.Name = "single.bin"
+
+	server := newWebSeedServer(t, map[string][]byte{
+		"/files/single.bin": data,
+		"/corrupt.bin":      []byte("0123456789XXXXXX"),
+	})
+
+	tests := []struct {
+		name    string
+		url     string
+		wantErr bool
+	}{
+		{name: "Directory url", url: server.URL + "/files/"},
+		{name: "File url", url: server.URL + "/files/single.bin"},
+		{name: "Corrupt data", url: server.URL + "/corrupt.bin", wantErr: true},
+		{name: "Missing file", url: server.URL + "/missing.bin", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := downloadWebSeedPiece(newTestNetwork(), torrentMeta, tt.url, 1)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("downloadWebSeedPiece() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(result) != "89abcdef" {
+				t.Errorf("downloadWebSeedPiece() = %q, expected %q", result, "89abcdef")
+			}
+		})
+	}
+}
+
+func TestDownloadTorrentPiecesFromWebSeed(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+	torrentMeta := webSeedTorrent(data, 8, nil)
+	torrentMeta.Name = "single.bin"
+
+	server := newWebSeedServer(t, map[string][]byte{"/single.bin": data})
+	peers := []Peer{{0, netip.AddrPort{}, "idle", server.URL + "/single.bin", false}}
+
+	picker := newPiecePicker(getTorrentPieces(torrentMeta), false)
+	results, err := downloadTorrentPieces(newTestNetwork(), torrentMeta, picker, peers, newDownloadControl(nil))
+	if err != nil {
+		t.Fatalf("downloadTorrentPieces() unexpected error %v", err)
+	}
+
+	downloaded := make([][]byte, len(torrentMeta.Pieces))
+	for _, result := range results {
+		downloaded[result.piece] = result.result
+	}
+	expected := [][]byte{data[:8], data[8:16], data[16:]}
+	if !reflect.DeepEqual(downloaded, expected) {
+		t.Errorf("downloaded %q, expected %q", downloaded, expected)
+	}
+}
+
+func TestFailingWebSeedBacksOff(t *testing.T) {
+	defer func(delay time.Duration) { webSeedRetryDelay = delay }(webSeedRetryDelay)
+	webSeedRetryDelay = time.Millisecond
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+
+	torrentMeta := webSeedTorrent([]byte("0123456789abcdefghij"), 8, nil)
+	torrentMeta.Name = "single.bin"
+	peers := []Peer{{0, netip.AddrPort{}, "idle", server.URL + "/single.bin", false}}
+
+	start := time.Now()
+	picker := newPiecePicker(getTorrentPieces(torrentMeta), false)
+	_, err := downloadTorrentPieces(newTestNetwork(), torrentMeta, picker, peers, newDownloadControl(nil))
+	if !errors.Is(err, ErrNoPeers) {
+		t.Errorf("expected ErrNoPeers once the web seed is dropped, got %v", err)
+	}
+	if int(requests.Load()) != maxPeerFailures {
+		t.Errorf("web seed got %d requests, expected %d", requests.Load(), maxPeerFailures)
+	}
+
+	// the delay doubles after every failure but the last
+	backoff := webSeedRetryDelay * (1<<(maxPeerFailures-1) - 1)
+	if elapsed := time.Since(start); elapsed < backoff {
+		t.Errorf("download gave up after %s, expected at least %s of backoff", elapsed, backoff)
+	}
+}
@@ -1,45 +1,137 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/k0kubun/go-ansi"
 	"github.com/rs/zerolog"
+	"github.com/schollz/progressbar/v3"
+	"github.com/vdjuketic/bittorrent-client-go/bittorrent"
 )
 
-const DOWNLOAD_COMMAND = "download"
+const (
+	DOWNLOAD_COMMAND = "download"
+	DAEMON_COMMAND   = "daemon"
+	LIST_COMMAND     = "list"
+	PAUSE_COMMAND    = "pause"
+	RESUME_COMMAND   = "resume"
+	REMOVE_COMMAND   = "remove"
+	LIMIT_COMMAND    = "limit"
+	SERVE_COMMAND    = "serve"
+	SCRAPE_COMMAND   = "scrape"
+	TRACKER_COMMAND  = "tracker"
+)
+
+// Exit codes follow sysexits.h, so scripts can tell a bad torrent from a
+// tracker that is down.
+const (
+	EXIT_FAILURE         = 1
+	EXIT_USAGE           = 64
+	EXIT_INVALID_TORRENT = 65
+	EXIT_TRACKER         = 69
+	EXIT_IO              = 74
+)
+
+// stringList collects the values of a flag that can be given more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("Expected a command")
-		os.Exit(1)
+		usageError("Expected a command")
 	}
 
 	switch command := os.Args[1]; command {
 	case DOWNLOAD_COMMAND:
 		handleDownloadCommand()
+	case DAEMON_COMMAND:
+		handleDaemonCommand()
+	case SERVE_COMMAND:
+		handleServeCommand()
+	case SCRAPE_COMMAND:
+		handleScrapeCommand()
+	case TRACKER_COMMAND:
+		handleTrackerCommand()
+	case LIST_COMMAND, PAUSE_COMMAND, RESUME_COMMAND, REMOVE_COMMAND, LIMIT_COMMAND:
+		handleControlCommand(command)
 	default:
-		fmt.Printf("Command not supported.")
-		os.Exit(1)
+		usageError("Command not supported.")
+	}
+}
+
+// usageError reports flags that are missing or wrong.
+func usageError(message string) {
+	fmt.Fprintln(os.Stderr, message)
+	os.Exit(EXIT_USAGE)
+}
+
+// fail prints the error without a stack trace and exits with the code for
+// its kind.
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "Error:", err)
+	os.Exit(getExitCode(err))
+}
+
+func getExitCode(err error) int {
+	var metainfoErr *bittorrent.MetainfoError
+	var trackerErr *bittorrent.TrackerError
+	var pathErr *fs.PathError
+
+	switch {
+	case errors.As(err, &metainfoErr):
+		return EXIT_INVALID_TORRENT
+	case errors.As(err, &trackerErr):
+		return EXIT_TRACKER
+	case errors.As(err, &pathErr):
+		return EXIT_IO
 	}
+	return EXIT_FAILURE
 }
 
 func handleDownloadCommand() {
 	downloadCmd := flag.NewFlagSet(DOWNLOAD_COMMAND, flag.ExitOnError)
 	output := downloadCmd.String("output", "", "output location")
-	torrentFile := downloadCmd.String("torrent", "", "torrent file location")
+	var torrentFiles stringList
+	downloadCmd.Var(&torrentFiles, "torrent", "torrent file location, can be repeated to download several torrents into the output directory")
+	var magnets stringList
+	downloadCmd.Var(&magnets, "magnet", "magnet link, can be repeated and combined with -torrent")
+	encryption := downloadCmd.String("encryption", string(bittorrent.ENCRYPTION_DISABLE), "peer connection encryption: prefer, require or disable")
+	transport := downloadCmd.String("transport", string(bittorrent.TRANSPORT_TCP), "peer transport: tcp, utp or both")
+	lsd := downloadCmd.Bool("lsd", false, "find peers on the local network with local service discovery")
+	mapPort := downloadCmd.Bool("port-mapping", false, "map the listening port on the gateway with UPnP, PCP or NAT-PMP")
+	port := downloadCmd.Int("port", bittorrent.DefaultListenPort, "port to accept peers on, 0 for any free port")
 	debug := downloadCmd.Bool("debug", false, "enable debug logging")
+	downloadLimit := downloadCmd.Int("download-limit", 0, "download limit in KiB/s, 0 for unlimited")
+	uploadLimit := downloadCmd.Int("upload-limit", 0, "upload limit in KiB/s, 0 for unlimited")
+	daemon := downloadCmd.String("daemon", "", "address of a running daemon to hand the download to")
+	sequential := downloadCmd.Bool("sequential", false, "download pieces in order, e.g. to preview media while it downloads")
+	files := downloadCmd.String("files", "", "comma separated file indexes or glob patterns to download, each optionally followed by =skip, =normal or =high")
 	downloadCmd.Parse(os.Args[2:])
 
 	if *output == "" {
-		fmt.Println("output not specified")
-		os.Exit(1)
+		usageError("output not specified")
 	}
 
-	if *torrentFile == "" {
-		fmt.Println("torrent file not specified")
-		os.Exit(1)
+	if len(torrentFiles) == 0 && len(magnets) == 0 {
+		usageError("torrent file or magnet link not specified")
 	}
 
 	if *debug {
@@ -48,24 +140,486 @@ func handleDownloadCommand() {
 		zerolog.SetGlobalLevel(zerolog.ErrorLevel)
 	}
 
-	handleDownload(*output, *torrentFile)
+	if *daemon != "" {
+		// the daemon's connections are set up when it starts, not per torrent
+		downloadCmd.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "encryption", "transport", "lsd", "port-mapping", "port":
+				usageError(fmt.Sprintf("-%s can't be used with -daemon, pass it to the daemon command instead", f.Name))
+			}
+		})
+
+		request := bittorrent.AddTorrentRequest{
+			Files:         *files,
+			Sequential:    *sequential,
+			DownloadLimit: *downloadLimit * 1024,
+			UploadLimit:   *uploadLimit * 1024,
+		}
+		handleDaemonDownload(*daemon, *output, torrentFiles, magnets, request)
+		return
+	}
+
+	torrentOptions := []bittorrent.TorrentOption{bittorrent.WithFiles(*files)}
+	if *sequential {
+		torrentOptions = append(torrentOptions, bittorrent.WithSequential())
+	}
+
+	progress := &downloadProgress{finished: make(map[string]int), total: make(map[string]int)}
+	client := newClient(*encryption, *transport, *lsd, *mapPort,
+		bittorrent.WithListenPort(*port),
+		bittorrent.WithBandwidthLimits(*downloadLimit*1024, *uploadLimit*1024),
+		bittorrent.WithProgress(progress.update))
+
+	err := handleDownload(client, progress, *output, torrentFiles, magnets, torrentOptions)
+	client.Close()
+	if err != nil {
+		fail(err)
+	}
 }
 
-func handleDownload(output string, torrentFile string) {
-	fmt.Printf("downloading %s to %s\n", torrentFile, output)
+// newClient creates the client of the commands that download, invalid flag
+// values end the process.
+func newClient(encryption string, transport string, lsd bool, mapPort bool, options ...bittorrent.Option) *bittorrent.Client {
+	policy, err := bittorrent.ParseEncryptionPolicy(encryption)
+	if err != nil {
+		usageError(err.Error())
+	}
+	peerTransport, err := bittorrent.ParsePeerTransport(transport)
+	if err != nil {
+		usageError(err.Error())
+	}
+
+	options = append(options, bittorrent.WithEncryption(policy), bittorrent.WithTransport(peerTransport))
+	if lsd {
+		options = append(options, bittorrent.WithLocalDiscovery())
+	}
+	if mapPort {
+		options = append(options, bittorrent.WithPortMapping())
+	}
 
-	file, err := os.ReadFile(torrentFile)
+	// trackers and peers see the same client across runs
+	if configDir, err := os.UserConfigDir(); err == nil {
+		options = append(options, bittorrent.WithPeerIdFile(filepath.Join(configDir, "bittorrent-client-go", "peer_id")))
+	}
+
+	client, err := bittorrent.NewClient(options...)
 	if err != nil {
-		fmt.Println("Invalid torrent file location.")
-		panic(err)
+		fail(err)
+	}
+
+	if mapPort {
+		// mappings would otherwise stay on the gateway until they expire
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			// a second signal ends the process right away
+			signal.Stop(signals)
+			client.Close()
+			os.Exit(EXIT_FAILURE)
+		}()
+	}
+	return client
+}
+
+// downloadProgress shows the finished pieces of all torrents in a single
+// progress bar.
+type downloadProgress struct {
+	mu       sync.Mutex
+	bar      *progressbar.ProgressBar
+	finished map[string]int
+	// total grows once the metadata of magnet links is fetched
+	total map[string]int
+}
+
+func (p *downloadProgress) start(torrents []*bittorrent.Torrent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	totalPieces := 0
+	for _, torrent := range torrents {
+		status := torrent.Status()
+		p.total[status.InfoHash] = status.TotalPieces
+		totalPieces += status.TotalPieces
+	}
+	p.bar = getProgressBar(totalPieces)
+}
+
+func (p *downloadProgress) update(torrent *bittorrent.Torrent, finishedPieces int, totalPieces int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.finished[torrent.InfoHash()] = finishedPieces
+	p.total[torrent.InfoHash()] = totalPieces
+	totalFinished, total := 0, 0
+	for _, pieces := range p.finished {
+		totalFinished += pieces
+	}
+	for _, pieces := range p.total {
+		total += pieces
+	}
+
+	if total != p.bar.GetMax() {
+		p.bar.ChangeMax(total)
+	}
+	p.bar.Set(totalFinished)
+}
+
+// getMagnetOutputName returns the name of the output of a magnet link in a
+// directory shared with other torrents. The display name comes from
+// whoever made the link, so only its last element is used.
+func getMagnetOutputName(magnet bittorrent.Magnet) string {
+	name := filepath.Base(magnet.Name)
+	if magnet.Name == "" || name == "." || name == ".." || name == string(filepath.Separator) {
+		return magnet.InfoHash
+	}
+	return name
+}
+
+// handleDownload downloads the torrents and magnet links and returns why
+// any of them failed. A single torrent is written to output, several go
+// into the output directory.
+func handleDownload(client *bittorrent.Client, progress *downloadProgress, output string, torrentFiles []string, magnets []string, torrentOptions []bittorrent.TorrentOption) error {
+	several := len(torrentFiles)+len(magnets) > 1
+	if several {
+		err := os.MkdirAll(output, 0755)
+		if err != nil {
+			return fmt.Errorf("failed to create output directory: %w", err)
+		}
+	}
+
+	// torrents start once the progress bar knows the total
+	torrentOptions = append(torrentOptions, bittorrent.WithPaused())
+	var torrents []*bittorrent.Torrent
+
+	for _, torrentFile := range torrentFiles {
+		file, err := os.ReadFile(torrentFile)
+		if err != nil {
+			return fmt.Errorf("failed to read torrent file: %w", err)
+		}
+
+		torrentOutput := output
+		if several {
+			torrentMeta, err := bittorrent.ParseTorrent(file)
+			if err != nil {
+				return fmt.Errorf("%s: %w", torrentFile, err)
+			}
+			torrentOutput = filepath.Join(output, torrentMeta.Name)
+		}
+
+		torrent, err := client.AddTorrent(file, torrentOutput, torrentOptions...)
+		if err != nil {
+			return fmt.Errorf("%s: %w", torrentFile, err)
+		}
+
+		fmt.Printf("downloading %s to %s\n", torrentFile, torrentOutput)
+		if !several {
+			for _, path := range torrent.Files() {
+				fmt.Println(path)
+			}
+		}
+		torrents = append(torrents, torrent)
+	}
+
+	for _, uri := range magnets {
+		magnet, err := bittorrent.ParseMagnet(uri)
+		if err != nil {
+			return fmt.Errorf("%s: %w", uri, err)
+		}
+
+		torrentOutput := output
+		if several {
+			torrentOutput = filepath.Join(output, getMagnetOutputName(magnet))
+		}
+
+		torrent, err := client.AddMagnet(uri, torrentOutput, torrentOptions...)
+		if err != nil {
+			return fmt.Errorf("%s: %w", uri, err)
+		}
+
+		fmt.Printf("downloading %s to %s\n", torrent.Name(), torrentOutput)
+		torrents = append(torrents, torrent)
+	}
+
+	progress.start(torrents)
+	for _, torrent := range torrents {
+		torrent.Start()
+	}
+
+	var errs []error
+	for _, torrent := range torrents {
+		if err := torrent.Wait(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to download %s: %w", torrent.Name(), err))
+			continue
+		}
+		fmt.Printf("\nDownloaded %s to %s", torrent.Name(), torrent.Status().Output)
+	}
+	if len(errs) > 0 {
+		fmt.Println()
+	}
+	return errors.Join(errs...)
+}
+
+func getProgressBar(numJobs int) *progressbar.ProgressBar {
+	var bar *progressbar.ProgressBar
+
+	if zerolog.GlobalLevel() == zerolog.DebugLevel {
+		bar = progressbar.NewOptions(numJobs,
+			progressbar.OptionSetVisibility(false))
+	} else {
+		bar = progressbar.NewOptions(numJobs,
+			progressbar.OptionSetWriter(ansi.NewAnsiStdout()),
+			progressbar.OptionEnableColorCodes(true),
+			progressbar.OptionShowBytes(true),
+			progressbar.OptionSetWidth(15),
+			//TODO change when multiple file torrents are supported
+			progressbar.OptionSetDescription("[cyan][1/1][reset] Downloading file..."),
+			progressbar.OptionSetTheme(progressbar.Theme{
+				Saucer:        "[green]=[reset]",
+				SaucerHead:    "[green]>[reset]",
+				SaucerPadding: " ",
+				BarStart:      "[",
+				BarEnd:        "]",
+			}))
+	}
+	return bar
+}
+
+func handleDaemonCommand() {
+	daemonCmd := flag.NewFlagSet(DAEMON_COMMAND, flag.ExitOnError)
+	listen := daemonCmd.String("listen", bittorrent.DefaultDaemonAddress, "address of the control API")
+	maxConnections := daemonCmd.Int("max-connections", bittorrent.DefaultMaxConnections, "maximum number of open peer connections")
+	downloadLimit := daemonCmd.Int("download-limit", 0, "download limit in KiB/s, 0 for unlimited")
+	uploadLimit := daemonCmd.Int("upload-limit", 0, "upload limit in KiB/s, 0 for unlimited")
+	encryption := daemonCmd.String("encryption", string(bittorrent.ENCRYPTION_DISABLE), "peer connection encryption: prefer, require or disable")
+	transport := daemonCmd.String("transport", string(bittorrent.TRANSPORT_TCP), "peer transport: tcp, utp or both")
+	lsd := daemonCmd.Bool("lsd", false, "find peers on the local network with local service discovery")
+	mapPort := daemonCmd.Bool("port-mapping", false, "map the listening port on the gateway with UPnP, PCP or NAT-PMP")
+	port := daemonCmd.Int("port", bittorrent.DefaultListenPort, "port to accept peers on, 0 for any free port")
+	debug := daemonCmd.Bool("debug", false, "enable debug logging")
+	daemonCmd.Parse(os.Args[2:])
+
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+
+	client := newClient(*encryption, *transport, *lsd, *mapPort,
+		bittorrent.WithListenPort(*port),
+		bittorrent.WithMaxConnections(*maxConnections),
+		bittorrent.WithBandwidthLimits(*downloadLimit*1024, *uploadLimit*1024))
+	defer client.Close()
+
+	err := bittorrent.RunDaemon(*listen, client)
+	if err != nil {
+		client.Close()
+		fail(fmt.Errorf("daemon stopped: %w", err))
+	}
+}
+
+// handleDaemonDownload adds the torrent files and magnet links to the
+// daemon, request holds the settings every torrent is added with.
+func handleDaemonDownload(address string, output string, torrentFiles []string, magnets []string, request bittorrent.AddTorrentRequest) {
+	client := bittorrent.NewDaemonClient(address)
+	several := len(torrentFiles)+len(magnets) > 1
+
+	// the daemon resolves relative paths against its own working directory
+	output, err := filepath.Abs(output)
+	if err != nil {
+		fail(fmt.Errorf("invalid output location: %w", err))
+	}
+
+	for _, torrentFile := range torrentFiles {
+		file, err := os.ReadFile(torrentFile)
+		if err != nil {
+			fail(fmt.Errorf("failed to read torrent file: %w", err))
+		}
+
+		torrentOutput := output
+		if several {
+			torrentMeta, err := bittorrent.ParseTorrent(file)
+			if err != nil {
+				fail(fmt.Errorf("%s: %w", torrentFile, err))
+			}
+			torrentOutput = filepath.Join(torrentOutput, torrentMeta.Name)
+		}
+
+		request.Torrent, request.Output = file, torrentOutput
+		addDaemonTorrent(client, request)
+	}
+
+	for _, uri := range magnets {
+		magnet, err := bittorrent.ParseMagnet(uri)
+		if err != nil {
+			fail(fmt.Errorf("%s: %w", uri, err))
+		}
+
+		torrentOutput := output
+		if several {
+			torrentOutput = filepath.Join(torrentOutput, getMagnetOutputName(magnet))
+		}
+
+		request.Torrent, request.Magnet, request.Output = nil, uri, torrentOutput
+		addDaemonTorrent(client, request)
+	}
+}
+
+func addDaemonTorrent(client bittorrent.DaemonClient, request bittorrent.AddTorrentRequest) {
+	status, err := client.AddTorrent(request)
+	if err != nil {
+		fail(err)
+	}
+	fmt.Printf("added %s (%s) to daemon, downloading to %s\n", status.Name, status.InfoHash, status.Output)
+}
+
+func handleControlCommand(command string) {
+	controlCmd := flag.NewFlagSet(command, flag.ExitOnError)
+	daemon := controlCmd.String("daemon", bittorrent.DefaultDaemonAddress, "address of the running daemon")
+	infoHash := controlCmd.String("hash", "", "info hash of the torrent")
+	downloadLimit := controlCmd.Int("download-limit", 0, "download limit in KiB/s, 0 for unlimited")
+	uploadLimit := controlCmd.Int("upload-limit", 0, "upload limit in KiB/s, 0 for unlimited")
+	controlCmd.Parse(os.Args[2:])
+
+	client := bittorrent.NewDaemonClient(*daemon)
+
+	if *infoHash == "" && command != LIST_COMMAND && command != LIMIT_COMMAND {
+		usageError("hash not specified")
+	}
+
+	var statuses []bittorrent.TorrentStatus
+	var err error
+
+	switch command {
+	case LIST_COMMAND:
+		statuses, err = client.ListTorrents()
+	case PAUSE_COMMAND:
+		var status bittorrent.TorrentStatus
+		status, err = client.PauseTorrent(*infoHash)
+		statuses = append(statuses, status)
+	case RESUME_COMMAND:
+		var status bittorrent.TorrentStatus
+		status, err = client.ResumeTorrent(*infoHash)
+		statuses = append(statuses, status)
+	case REMOVE_COMMAND:
+		err = client.RemoveTorrent(*infoHash)
+	case LIMIT_COMMAND:
+		err = client.SetLimits(*infoHash, bittorrent.LimitsRequest{Download: *downloadLimit * 1024, Upload: *uploadLimit * 1024})
 	}
 
-	result := downloadTorrent(string(file))
-	err = os.WriteFile(output, result, 0644)
 	if err != nil {
-		fmt.Println("Failed to write torrent to file.")
-		panic(err)
+		fail(err)
+	}
+
+	for _, status := range statuses {
+		fmt.Printf("%s  %-12s %5.1f%%  %3d peers  %6d KiB/s down  %6d KiB/s up  %s\n",
+			status.InfoHash, status.Status, status.Progress*100, status.Peers,
+			status.DownloadRate/1024, status.UploadRate/1024, status.Name)
+	}
+}
+
+func handleServeCommand() {
+	serveCmd := flag.NewFlagSet(SERVE_COMMAND, flag.ExitOnError)
+	torrentFile := serveCmd.String("torrent", "", "torrent file location")
+	listen := serveCmd.String("listen", bittorrent.DefaultServeAddress, "address to serve the torrent's files on")
+	output := serveCmd.String("output", "", "directory to store the downloaded data in, a temporary directory by default")
+	encryption := serveCmd.String("encryption", string(bittorrent.ENCRYPTION_DISABLE), "peer connection encryption: prefer, require or disable")
+	transport := serveCmd.String("transport", string(bittorrent.TRANSPORT_TCP), "peer transport: tcp, utp or both")
+	lsd := serveCmd.Bool("lsd", false, "find peers on the local network with local service discovery")
+	mapPort := serveCmd.Bool("port-mapping", false, "map the listening port on the gateway with UPnP, PCP or NAT-PMP")
+	debug := serveCmd.Bool("debug", false, "enable debug logging")
+	serveCmd.Parse(os.Args[2:])
+
+	if *torrentFile == "" {
+		usageError("torrent file not specified")
 	}
 
-	fmt.Printf("\nDownloaded %s to %s", torrentFile, output)
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+
+	file, err := os.ReadFile(*torrentFile)
+	if err != nil {
+		fail(fmt.Errorf("failed to read torrent file: %w", err))
+	}
+
+	if *output == "" {
+		*output, err = os.MkdirTemp("", "bittorrent-client-go")
+		if err != nil {
+			fail(fmt.Errorf("failed to create temporary directory: %w", err))
+		}
+	}
+
+	client := newClient(*encryption, *transport, *lsd, *mapPort)
+	err = client.Serve(*listen, file, *output)
+	client.Close()
+	if err != nil {
+		fail(err)
+	}
+}
+
+func handleScrapeCommand() {
+	scrapeCmd := flag.NewFlagSet(SCRAPE_COMMAND, flag.ExitOnError)
+	torrentFile := scrapeCmd.String("torrent", "", "torrent file location")
+	scrapeCmd.Parse(os.Args[2:])
+
+	if *torrentFile == "" {
+		usageError("torrent file not specified")
+	}
+
+	file, err := os.ReadFile(*torrentFile)
+	if err != nil {
+		fail(fmt.Errorf("failed to read torrent file: %w", err))
+	}
+
+	scrapes, err := bittorrent.ScrapeTorrent(file)
+	if err != nil {
+		fail(err)
+	}
+
+	for _, scrape := range scrapes {
+		if scrape.Err != nil {
+			fmt.Printf("%s\n  error: %s\n", scrape.Tracker, scrape.Err)
+			continue
+		}
+		fmt.Printf("%s\n  seeders: %d  leechers: %d  completed: %d\n", scrape.Tracker, scrape.Result.Complete, scrape.Result.Incomplete, scrape.Result.Downloaded)
+	}
+}
+
+func handleTrackerCommand() {
+	trackerCmd := flag.NewFlagSet(TRACKER_COMMAND, flag.ExitOnError)
+	listen := trackerCmd.String("listen", bittorrent.DefaultTrackerAddress, "address to serve announce and scrape requests on")
+	interval := trackerCmd.Duration("interval", bittorrent.DefaultTrackerInterval, "announce interval, peers that don't announce again within it are dropped")
+	whitelistFile := trackerCmd.String("whitelist", "", "file with the hex info hashes to track, one per line, all torrents are tracked by default")
+	debug := trackerCmd.Bool("debug", false, "enable debug logging")
+	trackerCmd.Parse(os.Args[2:])
+
+	if *interval < time.Second {
+		usageError("interval has to be at least a second")
+	}
+
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+
+	var whitelist map[string]bool
+	if *whitelistFile != "" {
+		content, err := os.ReadFile(*whitelistFile)
+		if err != nil {
+			fail(fmt.Errorf("failed to read whitelist: %w", err))
+		}
+		whitelist, err = bittorrent.ParseTrackerWhitelist(string(content))
+		if err != nil {
+			fail(fmt.Errorf("invalid whitelist: %w", err))
+		}
+	}
+
+	err := bittorrent.RunTracker(*listen, bittorrent.NewTrackerServer(*interval, whitelist))
+	if err != nil {
+		fail(fmt.Errorf("tracker stopped: %w", err))
+	}
 }